@@ -0,0 +1,344 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package bootverifier is a client for the TKey boot verifier's
+// application protocol. To talk to a verifier, connect to the TKey
+// and wrap the connection:
+//
+//	tk, err := bootverifier.Connect(port)
+//	bv := bootverifier.New(tk)
+//
+// The verifier has to be running, either started from flash in
+// command mode or loaded by the client.
+package bootverifier
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// Client talks to the boot verifier over a Transport.
+type Client struct {
+	t Transport
+}
+
+// New returns a Client using the connection in t.
+func New(t Transport) *Client {
+	return &Client{t: t}
+}
+
+// EraseAreas asks the verifier to erase all app storage areas. The
+// user has to confirm by touching the TKey three times.
+func (c *Client) EraseAreas() error {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdEraseAreas, id)
+	if err != nil {
+		return err
+	}
+
+	tkeyclient.Dump("erase areas tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return err
+	}
+
+	// Read response
+	const margin = 2
+	c.t.SetReadTimeoutNoErr(UserPresenceTimeout + margin)
+	defer c.t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := c.t.ReadFrame(RspEraseAreas, id)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	tkeyclient.Dump("erase areas rx", rx)
+
+	if rx[2] != tkeyclient.StatusOK {
+		return &StatusError{CmdEraseAreas, rx[2]}
+	}
+
+	return nil
+}
+
+// Reset asks the running app to reset the TKey, passing fwType to
+// firmware and verifierDst as next app data. There is no response;
+// the TKey resets immediately.
+func (c *Client) Reset(fwType FwResetType, verifierDst ResetDst) error {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdReset, id)
+	if err != nil {
+		return err
+	}
+
+	tx[2] = uint8(fwType)
+	tx[3] = uint8(verifierDst)
+
+	tkeyclient.Dump("reset tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+// GetPubkey returns the vendor public key installed on flash.
+func (c *Client) GetPubkey() ([ed25519.PublicKeySize]byte, error) {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdGetPubkey, id)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("NewFrameBuf: %w", err)
+	}
+
+	tkeyclient.Dump("get pubkey tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return [32]byte{}, err
+	}
+
+	c.t.SetReadTimeoutNoErr(ReadTimeout)
+	defer c.t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := c.t.ReadFrame(RspGetPubkey, id)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("ReadFrame: %w", err)
+	}
+
+	tkeyclient.Dump("get pubkey rx", rx)
+
+	if rx[2] != tkeyclient.StatusOK {
+		return [32]byte{}, &StatusError{CmdGetPubkey, rx[2]}
+	}
+
+	pubkey := [ed25519.PublicKeySize]byte{}
+	copy(pubkey[:], rx[3:3+len(pubkey)])
+
+	return pubkey, nil
+}
+
+// GetMetadata returns the digest and signature of the app installed
+// in slot 1, as recorded on flash. Both are all zeroes if no app is
+// installed.
+func (c *Client) GetMetadata() ([blake2s.Size]byte, [ed25519.SignatureSize]byte, error) {
+	var digest [blake2s.Size]byte
+	var sig [ed25519.SignatureSize]byte
+
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdGetMetadata, id)
+	if err != nil {
+		return digest, sig, fmt.Errorf("NewFrameBuf: %w", err)
+	}
+
+	tkeyclient.Dump("get metadata tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return digest, sig, err
+	}
+
+	c.t.SetReadTimeoutNoErr(ReadTimeout)
+	defer c.t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := c.t.ReadFrame(RspGetMetadata, id)
+	if err != nil {
+		return digest, sig, fmt.Errorf("ReadFrame: %w", err)
+	}
+
+	tkeyclient.Dump("get metadata rx", rx)
+
+	if rx[2] != tkeyclient.StatusOK {
+		return digest, sig, &StatusError{CmdGetMetadata, rx[2]}
+	}
+
+	copy(digest[:], rx[3:3+len(digest)])
+	copy(sig[:], rx[3+len(digest):3+len(digest)+len(sig)])
+
+	return digest, sig, nil
+}
+
+// StorePubkey stores pubkey on flash, replacing any installed vendor
+// public key. The user has to confirm by touching the TKey three
+// times.
+func (c *Client) StorePubkey(pubkey [ed25519.PublicKeySize]byte) error {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdStorePubkey, id)
+	if err != nil {
+		return err
+	}
+
+	copy(tx[2:], pubkey[:])
+
+	tkeyclient.Dump("store pubkey tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return err
+	}
+
+	// Read response
+	const margin = 2
+	c.t.SetReadTimeoutNoErr(UserPresenceTimeout + margin)
+	defer c.t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := c.t.ReadFrame(RspStorePubkey, id)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	tkeyclient.Dump("set pubkey rx", rx)
+
+	if rx[2] != tkeyclient.StatusOK {
+		return &StatusError{CmdStorePubkey, rx[2]}
+	}
+
+	return nil
+}
+
+// SetPubkey sets the vendor public key used by a following Verify.
+// Nothing is stored on flash.
+func (c *Client) SetPubkey(pubkey [ed25519.PublicKeySize]byte) error {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdSetPubkey, id)
+	if err != nil {
+		return err
+	}
+
+	copy(tx[2:], pubkey[:])
+
+	tkeyclient.Dump("set pubkey tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return err
+	}
+
+	// Read response
+	c.t.SetReadTimeoutNoErr(ReadTimeout)
+	defer c.t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := c.t.ReadFrame(RspSetPubkey, id)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if rx[2] != tkeyclient.StatusOK {
+		return &StatusError{CmdSetPubkey, rx[2]}
+	}
+
+	return nil
+}
+
+// UpdateAppInit starts installing an app of size bytes with digest
+// and sig in slot 1. The user has to confirm by touching the TKey
+// three times. When it succeeds, slot 1 has been erased and the
+// verifier only accepts WriteChunk.
+func (c *Client) UpdateAppInit(size int, digest [blake2s.Size]byte, sig [ed25519.SignatureSize]byte) error {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdUpdateAppInit, id)
+	if err != nil {
+		return err
+	}
+
+	tx[2] = byte(size)
+	tx[3] = byte(size >> 8)
+	tx[4] = byte(size >> 16)
+	tx[5] = byte(size >> 24)
+	copy(tx[6:], digest[:])
+	copy(tx[38:], sig[:])
+
+	tkeyclient.Dump("update app1 tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return err
+	}
+
+	// Read response
+	const margin = 2
+	c.t.SetReadTimeoutNoErr(UserPresenceTimeout + margin)
+	defer c.t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := c.t.ReadFrame(RspUpdateAppInit, id)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	tkeyclient.Dump("update app1 rx", rx)
+
+	if rx[2] != tkeyclient.StatusOK {
+		return &StatusError{CmdUpdateAppInit, rx[2]}
+	}
+
+	return nil
+}
+
+// WriteChunk writes the next chunk, at most ChunkSize bytes, of the
+// app being installed. After the last chunk the verifier resets the
+// TKey.
+func (c *Client) WriteChunk(chunk []byte) error {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdUpdateAppChunk, id)
+	if err != nil {
+		return err
+	}
+
+	copy(tx[2:], chunk)
+
+	tkeyclient.Dump("update app1 chunk tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	// Read response
+	c.t.SetReadTimeoutNoErr(ReadTimeout)
+	defer c.t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := c.t.ReadFrame(RspUpdateAppChunk, id)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	if rx[2] != tkeyclient.StatusOK {
+		return &StatusError{CmdUpdateAppChunk, rx[2]}
+	}
+
+	return nil
+}
+
+// Verify sends
+// - framing header 1 byte
+// - 0x01 (verify) 1 byte
+// - digest 32 bytes
+// - signature 64 bytes
+//
+// There is no response. If the signature verifies against the key
+// from SetPubkey the TKey resets to start a verified app from the
+// client, otherwise the verifier halts.
+func (c *Client) Verify(digest [blake2s.Size]byte, sig [ed25519.SignatureSize]byte) error {
+	id := 0x01
+
+	tx, err := tkeyclient.NewFrameBuf(CmdVerify, id)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	copy(tx[2:], digest[:])
+	copy(tx[34:], sig[:])
+
+	tkeyclient.Dump("verify tx", tx)
+
+	if err = c.t.Write(tx); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// SharedUSBSerial is the USB serial number older TKeys all have.
+const SharedUSBSerial = "68de5d27"
+
+// Device is a TKey attached over USB.
+type Device struct {
+	// Port is its serial port.
+	Port string
+
+	// Serial is its USB serial number. Older TKeys all have the
+	// same one, SharedUSBSerial.
+	Serial string
+
+	// NameVersion and UDI are from firmware, nil unless Probe
+	// found firmware waiting for an app.
+	NameVersion *tkeyclient.NameVersion
+	UDI         *tkeyclient.UDI
+}
+
+// ListDevices returns the TKeys attached over USB, without talking
+// to them.
+func ListDevices() ([]Device, error) {
+	ports, err := tkeyclient.GetSerialPorts()
+	if err != nil {
+		return nil, withClass(ErrNoDevice, fmt.Errorf("couldn't list TKeys: %w", err))
+	}
+
+	devs := make([]Device, 0, len(ports))
+	for _, p := range ports {
+		devs = append(devs, Device{Port: p.DevPath, Serial: p.SerialNumber})
+	}
+
+	return devs, nil
+}
+
+// Probe asks the TKey on d.Port for its firmware name, version and
+// UDI. Only firmware waiting for an app answers, a TKey running an
+// app, like the verifier, is left with them nil. It only returns an
+// error if the port can't be opened.
+//
+// The verifier in command mode halts on a firmware command, so only
+// probe a TKey known not to wait for verifier commands.
+func (d *Device) Probe() error {
+	tk, err := Connect(d.Port)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tk.Close() }()
+
+	nameVer, err := GetNameVersion(tk)
+	if err != nil {
+		return nil
+	}
+
+	udi, err := GetUDI(tk)
+	if err != nil {
+		return nil
+	}
+
+	d.NameVersion = nameVer
+	d.UDI = udi
+
+	return nil
+}
+
+// matches reports whether sel selects d by serial port, USB serial
+// number or, if probed, UDI.
+func (d *Device) matches(sel string) bool {
+	if samePort(d.Port, sel) || d.Serial == sel {
+		return true
+	}
+
+	return d.UDI != nil && strings.EqualFold(d.UDI.String(), sel)
+}
+
+// SelectDevice returns the serial port of the one TKey selected by
+// sel: a serial port, a USB serial number or, if probe is set, a UDI
+// as shown by Device.UDI.String. A UDI can only select a TKey running
+// firmware, and finding it means probing every TKey not matching
+// otherwise, see Device.Probe. A serial port doesn't have to be on
+// USB, so it also selects a simulated TKey.
+func SelectDevice(sel string, probe bool) (string, error) {
+	devs, err := ListDevices()
+	if err != nil {
+		return "", err
+	}
+
+	found := matching(devs, sel)
+
+	// Talking to the TKeys is only needed for the UDI.
+	if len(found) == 0 && probe {
+		for _, d := range devs {
+			if err := d.Probe(); err == nil && d.matches(sel) {
+				found = append(found, d)
+			}
+		}
+	}
+
+	return selected(sel, found)
+}
+
+// matching returns the devices in devs that sel selects.
+func matching(devs []Device, sel string) []Device {
+	var found []Device
+	for _, d := range devs {
+		if d.matches(sel) {
+			found = append(found, d)
+		}
+	}
+
+	return found
+}
+
+// selected returns the serial port of the one device sel was found to
+// select, or, if none was found, sel itself if it is a serial port.
+func selected(sel string, found []Device) (string, error) {
+	switch {
+	case len(found) == 1:
+		return found[0].Port, nil
+	case len(found) > 1:
+		ports := make([]string, 0, len(found))
+		for _, d := range found {
+			ports = append(ports, d.Port)
+		}
+
+		return "", withClass(ErrManyDevices, fmt.Errorf("%q matches TKeys on %s", sel, strings.Join(ports, ", ")))
+	}
+
+	if _, err := os.Stat(sel); err == nil {
+		return sel, nil
+	}
+
+	return "", withClass(ErrNoDevice, fmt.Errorf("no TKey matching %q", sel))
+}
+
+// detectErr classifies an error from tkeyclient.DetectSerialPort.
+func detectErr(err error) error {
+	if errors.Is(err, tkeyclient.ErrManyDevices) {
+		return withClass(ErrManyDevices, fmt.Errorf("couldn't pick a TKey: %w", err))
+	}
+
+	return withClass(ErrNoDevice, fmt.Errorf("couldn't find any TKeys: %w", err))
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+func TestMatching(t *testing.T) {
+	dir := t.TempDir()
+	port := filepath.Join(dir, "ttyACM0")
+	if err := os.WriteFile(port, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "usb-Tillitis_MTA1-USB-V1_5c1e7a02-if00")
+	if err := os.Symlink(port, link); err != nil {
+		t.Fatal(err)
+	}
+
+	udi := &tkeyclient.UDI{}
+	if err := udi.Unpack([]byte{0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+
+	devs := []Device{
+		{Port: port, Serial: "5c1e7a02"},
+		{Port: filepath.Join(dir, "ttyACM1"), Serial: SharedUSBSerial, UDI: udi},
+		{Port: filepath.Join(dir, "ttyACM2"), Serial: SharedUSBSerial},
+	}
+
+	tests := []struct {
+		sel   string
+		ports []string
+	}{
+		{port, []string{port}},
+		{link, []string{port}},
+		{"5c1e7a02", []string{port}},
+		{SharedUSBSerial, []string{devs[1].Port, devs[2].Port}},
+		{udi.String(), []string{devs[1].Port}},
+		{"ttyACM0", nil},
+	}
+
+	for _, tt := range tests {
+		var ports []string
+		for _, d := range matching(devs, tt.sel) {
+			ports = append(ports, d.Port)
+		}
+
+		if !slices.Equal(ports, tt.ports) {
+			t.Errorf("%s: matches %v, expected %v", tt.sel, ports, tt.ports)
+		}
+	}
+}
+
+func TestSelected(t *testing.T) {
+	port := filepath.Join(t.TempDir(), "tkey-sim")
+	if err := os.WriteFile(port, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	one := []Device{{Port: "/dev/ttyACM0"}}
+	two := []Device{{Port: "/dev/ttyACM0"}, {Port: "/dev/ttyACM1"}}
+
+	tests := []struct {
+		name  string
+		sel   string
+		found []Device
+		port  string
+		err   error
+	}{
+		{"one", "5c1e7a02", one, "/dev/ttyACM0", nil},
+		{"two", SharedUSBSerial, two, "", ErrManyDevices},
+		{"not on USB", port, nil, port, nil},
+		{"none", "5c1e7a02", nil, "", ErrNoDevice},
+	}
+
+	for _, tt := range tests {
+		got, err := selected(tt.sel, tt.found)
+		if got != tt.port || !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+			t.Errorf("%s: got %q, %v, expected %q, %v", tt.name, got, err, tt.port, tt.err)
+		}
+	}
+}
+
+func TestUSBDeviceFind(t *testing.T) {
+	ports := []tkeyclient.SerialPort{
+		{DevPath: "/dev/ttyACM0", SerialNumber: "5c1e7a02"},
+		{DevPath: "/dev/ttyACM1", SerialNumber: SharedUSBSerial},
+		{DevPath: "/dev/ttyACM2", SerialNumber: SharedUSBSerial},
+	}
+
+	tests := []struct {
+		name string
+		dev  usbDevice
+		port string
+	}{
+		{"own serial", usbDevice{serial: "5c1e7a02"}, "/dev/ttyACM0"},
+		{"shared serial", usbDevice{serial: SharedUSBSerial}, ""},
+		{"no serial", usbDevice{}, ""},
+		{"gone", usbDevice{serial: "0badc0de"}, ""},
+		// Not found by serial number once the sysfs path is
+		// known, even if it is unique.
+		{"moved", usbDevice{serial: "5c1e7a02", sysfsPath: "/sys/devices/usb1/1-9"}, ""},
+	}
+
+	for _, tt := range tests {
+		port, ok := tt.dev.findIn(ports)
+		if port != tt.port || ok != (tt.port != "") {
+			t.Errorf("%s: found %q, %v, expected %q", tt.name, port, ok, tt.port)
+		}
+	}
+}
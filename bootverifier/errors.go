@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"errors"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// Errors returned by the client and transports, for use with
+// errors.Is. The messages of the errors returned are kept as they
+// were, so these are only wrapped, not part of the message.
+var (
+	// ErrNoDevice means that no TKey was found, or that its
+	// serial port couldn't be opened.
+	ErrNoDevice = errors.New("no TKey found")
+
+	// ErrManyDevices means that more than one TKey is attached
+	// and none was selected, or that the selection matches more
+	// than one.
+	ErrManyDevices = errors.New("more than one TKey")
+
+	// ErrPortClosed means that the serial port went away, usually
+	// because the TKey reset or was removed.
+	ErrPortClosed = errors.New("port closed")
+
+	// ErrTimeout means that the TKey didn't answer in time. It
+	// might have lost the frame or halted.
+	ErrTimeout = errors.New("no answer in time")
+
+	// ErrProtocol means that the TKey answered something else
+	// than expected, like another response or a frame with the
+	// wrong length. A frame with the NOK bit set gives
+	// tkeyclient.ErrResponseStatusNotOK instead.
+	ErrProtocol = errors.New("unexpected response")
+
+	// ErrStatus means that the verifier or firmware answered with
+	// a status other than STATUS_OK. Use errors.As with a
+	// *StatusError for the command and status.
+	ErrStatus = errors.New("status not OK")
+
+	// ErrNoTouch means that the user didn't touch the TKey in
+	// time. Nothing was changed.
+	ErrNoTouch = errors.New("touch not confirmed")
+
+	// ErrInvalidSize means that the verifier refused the app
+	// size. Nothing was changed.
+	ErrInvalidSize = errors.New("app size invalid")
+
+	// ErrFlashFailed means that a flash operation failed. The
+	// verifier has halted and what was being written might be
+	// lost.
+	ErrFlashFailed = errors.New("flash operation failed")
+
+	// ErrBadState means that the verifier doesn't accept the
+	// command in its current state, like a chunk when no app is
+	// being installed. Nothing was changed.
+	ErrBadState = errors.New("command not allowed in this state")
+)
+
+// errorClasses names the errors above in traces. An error can wrap
+// more than one of them, so it gets the first one it wraps.
+var errorClasses = []struct {
+	name  string
+	class error
+}{
+	{"no-device", ErrNoDevice},
+	{"many-devices", ErrManyDevices},
+	{"port-closed", ErrPortClosed},
+	{"timeout", ErrTimeout},
+	{"protocol", ErrProtocol},
+	{"status", ErrStatus},
+	{"nok", tkeyclient.ErrResponseStatusNotOK},
+}
+
+// className returns the name of the class of err in errorClasses, or
+// "" if it has none.
+func className(err error) string {
+	for _, c := range errorClasses {
+		if errors.Is(err, c.class) {
+			return c.name
+		}
+	}
+
+	return ""
+}
+
+// classNamed returns the error in errorClasses called name.
+func classNamed(name string) (error, bool) {
+	for _, c := range errorClasses {
+		if c.name == name {
+			return c.class, true
+		}
+	}
+
+	return nil, false
+}
+
+// classErr adds one of the errors above to err, without changing its
+// message.
+type classErr struct {
+	class error
+	err   error
+}
+
+func (e *classErr) Error() string {
+	return e.err.Error()
+}
+
+func (e *classErr) Unwrap() []error {
+	return []error{e.class, e.err}
+}
+
+// withClass returns err with class added, or nil if err is nil.
+func withClass(class, err error) error {
+	if err == nil || errors.Is(err, class) {
+		return err
+	}
+
+	return &classErr{class, err}
+}
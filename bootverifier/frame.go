@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"fmt"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// ParseFramingHdr parses the framing protocol header byte b, the same
+// way tkeyclient does.
+func ParseFramingHdr(b byte) (tkeyclient.FramingHdr, error) {
+	var f tkeyclient.FramingHdr
+
+	if (b & 0b1000_0000) != 0 {
+		return f, fmt.Errorf("reserved bit #7 is not zero")
+	}
+
+	// If bit #2 is set
+	if (b & 0b0000_0100) != 0 {
+		f.ResponseNotOK = true
+	}
+
+	f.ID = byte((b & 0b0110_0000) >> 5)
+	f.Endpoint = tkeyclient.Endpoint((b & 0b0001_1000) >> 3)
+	f.CmdLen = tkeyclient.CmdLen(b & 0b0000_0011)
+
+	return f, nil
+}
+
+// CheckFrame checks a whole response frame in rx against the
+// expected response and frame ID with the same rules as
+// tkeyclient.TillitisKey.ReadFrame. It is meant for Transport
+// implementations that don't use tkeyclient.
+func CheckFrame(rx []byte, expectedResp tkeyclient.Cmd, expectedID int) (tkeyclient.FramingHdr, error) {
+	hdr, err := ParseFramingHdr(rx[0])
+	if err != nil {
+		return hdr, withClass(ErrProtocol, fmt.Errorf("Couldn't parse framing header: %w", err))
+	}
+
+	if hdr.ResponseNotOK {
+		return hdr, tkeyclient.ErrResponseStatusNotOK
+	}
+
+	if hdr.CmdLen != expectedResp.CmdLen() {
+		return hdr, withClass(ErrProtocol, fmt.Errorf("Expected cmdlen %v (%d bytes), got %v (%d bytes)",
+			expectedResp.CmdLen(), expectedResp.CmdLen().Bytelen(),
+			hdr.CmdLen, hdr.CmdLen.Bytelen()))
+	}
+
+	if hdr.Endpoint != expectedResp.Endpoint() {
+		return hdr, withClass(ErrProtocol, fmt.Errorf("Message not meant for us: dest %v", hdr.Endpoint))
+	}
+
+	if hdr.ID != byte(expectedID) {
+		return hdr, withClass(ErrProtocol, fmt.Errorf("Expected ID %d, got %d", expectedID, hdr.ID))
+	}
+
+	if len(rx) != 1+hdr.CmdLen.Bytelen() {
+		return hdr, withClass(ErrProtocol, fmt.Errorf("short frame: %d bytes", len(rx)))
+	}
+
+	if rx[1] != expectedResp.Code() {
+		return hdr, withClass(ErrProtocol, fmt.Errorf("Expected cmd code 0x%x (%s), got 0x%x", expectedResp.Code(), expectedResp, rx[1]))
+	}
+
+	return hdr, nil
+}
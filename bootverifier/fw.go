@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"fmt"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// FwCmd is a command or response in the firmware protocol. It
+// implements tkeyclient.Cmd.
+type FwCmd struct {
+	code   byte
+	name   string
+	cmdLen tkeyclient.CmdLen
+}
+
+func (c FwCmd) Code() byte {
+	return c.code
+}
+
+func (c FwCmd) CmdLen() tkeyclient.CmdLen {
+	return c.cmdLen
+}
+
+func (c FwCmd) Endpoint() tkeyclient.Endpoint {
+	return tkeyclient.DestFW
+}
+
+func (c FwCmd) String() string {
+	return c.name
+}
+
+// Commands and responses in the firmware protocol, the same as in
+// tkeyclient.
+var (
+	FwCmdGetNameVersion   = FwCmd{0x01, "cmdGetNameVersion", tkeyclient.CmdLen1}
+	FwRspGetNameVersion   = FwCmd{0x02, "rspGetNameVersion", tkeyclient.CmdLen32}
+	FwCmdLoadApp          = FwCmd{0x03, "cmdLoadApp", tkeyclient.CmdLen128}
+	FwRspLoadApp          = FwCmd{0x04, "rspLoadApp", tkeyclient.CmdLen4}
+	FwCmdLoadAppData      = FwCmd{0x05, "cmdLoadAppData", tkeyclient.CmdLen128}
+	FwRspLoadAppData      = FwCmd{0x06, "rspLoadAppData", tkeyclient.CmdLen4}
+	FwRspLoadAppDataReady = FwCmd{0x07, "rspLoadAppDataReady", tkeyclient.CmdLen128}
+	FwCmdGetUDI           = FwCmd{0x08, "cmdGetUDI", tkeyclient.CmdLen1}
+	FwRspGetUDI           = FwCmd{0x09, "rspGetUDI", tkeyclient.CmdLen32}
+)
+
+// GetNameVersion asks firmware for its name and version. Only
+// firmware waiting for an app from the client answers, so it also
+// tells if that is what the TKey is running.
+func GetNameVersion(t Transport) (*tkeyclient.NameVersion, error) {
+	id := 2
+	tx, err := tkeyclient.NewFrameBuf(FwCmdGetNameVersion, id)
+	if err != nil {
+		return nil, err
+	}
+
+	tkeyclient.Dump("GetNameVersion tx", tx)
+	if err = t.Write(tx); err != nil {
+		return nil, err
+	}
+
+	t.SetReadTimeoutNoErr(ReadTimeout)
+	defer t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := t.ReadFrame(FwRspGetNameVersion, id)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFrame: %w", err)
+	}
+
+	nameVer := &tkeyclient.NameVersion{}
+	nameVer.Unpack(rx[2:])
+
+	return nameVer, nil
+}
+
+// GetUDI asks firmware for the Unique Device Identifier of the TKey.
+func GetUDI(t Transport) (*tkeyclient.UDI, error) {
+	id := 2
+	tx, err := tkeyclient.NewFrameBuf(FwCmdGetUDI, id)
+	if err != nil {
+		return nil, err
+	}
+
+	tkeyclient.Dump("GetUDI tx", tx)
+	if err = t.Write(tx); err != nil {
+		return nil, err
+	}
+
+	t.SetReadTimeoutNoErr(ReadTimeout)
+	defer t.SetReadTimeoutNoErr(0)
+
+	rx, _, err := t.ReadFrame(FwRspGetUDI, id)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFrame: %w", err)
+	}
+
+	if rx[2] != tkeyclient.StatusOK {
+		return nil, &StatusError{FwCmdGetUDI, rx[2]}
+	}
+
+	udi := &tkeyclient.UDI{}
+	if err = udi.Unpack(rx[3 : 3+8]); err != nil {
+		return nil, fmt.Errorf("couldn't unpack UDI: %w", err)
+	}
+
+	return udi, nil
+}
+
+// LoadApp loads bin into the TKey firmware over t and starts it,
+// like tkeyclient.TillitisKey.LoadApp. If secretPhrase isn't empty
+// its BLAKE2s digest is used as USS.
+func LoadApp(t Transport, bin []byte, secretPhrase []byte) error {
+	binLen := len(bin)
+	if binLen > tkeyclient.AppMaxSize {
+		return fmt.Errorf("File too big")
+	}
+
+	err := loadApp(t, binLen, secretPhrase)
+	if err != nil {
+		return err
+	}
+
+	// Load the file
+	var offset int
+	var deviceDigest [32]byte
+
+	for nsent := 0; offset < binLen; offset += nsent {
+		if binLen-offset <= FwCmdLoadAppData.CmdLen().Bytelen()-1 {
+			deviceDigest, nsent, err = loadAppData(t, bin[offset:], true)
+		} else {
+			_, nsent, err = loadAppData(t, bin[offset:], false)
+		}
+		if err != nil {
+			return fmt.Errorf("loadAppData: %w", err)
+		}
+	}
+	if offset > binLen {
+		return fmt.Errorf("transmitted more than expected")
+	}
+
+	digest := blake2s.Sum256(bin)
+
+	if deviceDigest != digest {
+		return withClass(ErrProtocol, fmt.Errorf("Different digests"))
+	}
+
+	// The app has now started automatically.
+	return nil
+}
+
+// loadApp sets the size and USS of the app to be loaded into the TKey.
+func loadApp(t Transport, size int, secretPhrase []byte) error {
+	id := 2
+	tx, err := tkeyclient.NewFrameBuf(FwCmdLoadApp, id)
+	if err != nil {
+		return err
+	}
+
+	// Set size
+	tx[2] = byte(size)
+	tx[3] = byte(size >> 8)
+	tx[4] = byte(size >> 16)
+	tx[5] = byte(size >> 24)
+
+	if len(secretPhrase) == 0 {
+		tx[6] = 0
+	} else {
+		tx[6] = 1
+		// Hash user's phrase as USS
+		uss := blake2s.Sum256(secretPhrase)
+		copy(tx[7:], uss[:])
+	}
+
+	tkeyclient.Dump("LoadApp tx", tx)
+	if err = t.Write(tx); err != nil {
+		return err
+	}
+
+	rx, _, err := t.ReadFrame(FwRspLoadApp, id)
+	if err != nil {
+		return fmt.Errorf("ReadFrame: %w", err)
+	}
+
+	if rx[2] != tkeyclient.StatusOK {
+		return &StatusError{FwCmdLoadApp, rx[2]}
+	}
+
+	return nil
+}
+
+// loadAppData loads a chunk of the raw app binary into the TKey.
+func loadAppData(t Transport, content []byte, last bool) ([32]byte, int, error) {
+	id := 2
+	tx, err := tkeyclient.NewFrameBuf(FwCmdLoadAppData, id)
+	if err != nil {
+		return [32]byte{}, 0, err
+	}
+
+	// Whatever isn't filled by content is left as zero padding.
+	copied := copy(tx[2:], content)
+
+	tkeyclient.Dump("LoadAppData tx", tx)
+
+	if err = t.Write(tx); err != nil {
+		return [32]byte{}, 0, err
+	}
+
+	var expectedResp tkeyclient.Cmd
+
+	if last {
+		expectedResp = FwRspLoadAppDataReady
+	} else {
+		expectedResp = FwRspLoadAppData
+	}
+
+	// Wait for reply
+	rx, _, err := t.ReadFrame(expectedResp, id)
+	if err != nil {
+		return [32]byte{}, 0, fmt.Errorf("ReadFrame: %w", err)
+	}
+
+	if rx[2] != tkeyclient.StatusOK {
+		return [32]byte{}, 0, &StatusError{FwCmdLoadAppData, rx[2]}
+	}
+
+	if last {
+		var digest [32]byte
+		copy(digest[:], rx[3:])
+		return digest, copied, nil
+	}
+
+	return [32]byte{}, copied, nil
+}
@@ -0,0 +1,296 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"fmt"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// AppCmd is a command or response in a device app protocol. It
+// implements tkeyclient.Cmd.
+type AppCmd struct {
+	code   byte
+	name   string
+	cmdLen tkeyclient.CmdLen
+}
+
+// NewAppCmd returns a device app command with code, a name used when
+// printing it, and the length of the command data.
+func NewAppCmd(code byte, name string, cmdLen tkeyclient.CmdLen) AppCmd {
+	return AppCmd{code, name, cmdLen}
+}
+
+func (c AppCmd) Code() byte {
+	return c.code
+}
+
+func (c AppCmd) CmdLen() tkeyclient.CmdLen {
+	return c.cmdLen
+}
+
+func (c AppCmd) Endpoint() tkeyclient.Endpoint {
+	return tkeyclient.DestApp
+}
+
+func (c AppCmd) String() string {
+	return c.name
+}
+
+// Commands and responses in the verifier protocol. See the README
+// for their layout.
+var (
+	CmdVerify         = AppCmd{0x01, "cmdVerify", tkeyclient.CmdLen128}
+	CmdUpdateAppInit  = AppCmd{0x03, "cmdUpdateAppInit", tkeyclient.CmdLen128}
+	CmdUpdateAppChunk = AppCmd{0x04, "cmdUpdateAppChunk", tkeyclient.CmdLen128}
+	CmdGetPubkey      = AppCmd{0x05, "cmdGetPubkey", tkeyclient.CmdLen1}
+	CmdStorePubkey    = AppCmd{0x06, "cmdStorePubkey", tkeyclient.CmdLen128}
+	CmdSetPubkey      = AppCmd{0x07, "cmdSetPubkey", tkeyclient.CmdLen128}
+	CmdEraseAreas     = AppCmd{0x08, "cmdEraseAreas", tkeyclient.CmdLen1}
+	CmdGetMetadata    = AppCmd{0x09, "cmdGetMetadata", tkeyclient.CmdLen1}
+	CmdReset          = AppCmd{0xfe, "cmdReset", tkeyclient.CmdLen4}
+
+	RspVerify         = AppCmd{0x01, "rspVerify", tkeyclient.CmdLen4}
+	RspUpdateAppInit  = AppCmd{0x03, "rspUpdateAppInit", tkeyclient.CmdLen4}
+	RspUpdateAppChunk = AppCmd{0x04, "rspUpdateAppChunk", tkeyclient.CmdLen4}
+	RspGetPubkey      = AppCmd{0x05, "rspGetPubkey", tkeyclient.CmdLen128}
+	RspStorePubkey    = AppCmd{0x06, "rspStorePubkey", tkeyclient.CmdLen4}
+	RspSetPubkey      = AppCmd{0x07, "rspSetPubkey", tkeyclient.CmdLen4}
+	RspEraseAreas     = AppCmd{0x08, "rspEraseAreas", tkeyclient.CmdLen4}
+	RspGetMetadata    = AppCmd{0x09, "rspGetMetadata", tkeyclient.CmdLen128}
+)
+
+// VerifierCommands are the commands a client can send to the
+// verifier.
+var VerifierCommands = []tkeyclient.Cmd{
+	CmdVerify, CmdUpdateAppInit, CmdUpdateAppChunk, CmdGetPubkey,
+	CmdStorePubkey, CmdSetPubkey, CmdEraseAreas, CmdGetMetadata,
+	CmdReset,
+}
+
+// VerifierResponses are the responses the verifier can send.
+var VerifierResponses = []tkeyclient.Cmd{
+	RspVerify, RspUpdateAppInit, RspUpdateAppChunk, RspGetPubkey,
+	RspStorePubkey, RspSetPubkey, RspEraseAreas, RspGetMetadata,
+}
+
+// ChunkSize is the number of app bytes carried by each
+// CmdUpdateAppChunk.
+const ChunkSize = 127
+
+// The verifier asks for user presence three times, each with a
+// timeout, before doing anything that changes flash.
+const devicePresenceTimeoutS = 20
+const devicePresenceRepeatDelayS = 1
+const devicePresenceRepeats = 3
+
+// UserPresenceTimeout is the longest time, in seconds, the verifier
+// might wait for the user to confirm by touching the TKey.
+const UserPresenceTimeout = (devicePresenceTimeoutS + devicePresenceRepeatDelayS) * devicePresenceRepeats
+
+// ReadTimeout is how long, in seconds, to wait for a response that
+// doesn't need user presence. A TKey that doesn't answer in time has
+// lost the frame or halted.
+const ReadTimeout = 2
+
+// VerifyTimeout is how long, in seconds, the verifier might take to
+// check a signature and reset after CmdVerify. A TKey still there and
+// silent after this has halted.
+const VerifyTimeout = 10
+
+// FwResetType is the reset type passed to firmware in struct reset,
+// telling it what to start after the reset.
+type FwResetType uint8
+
+const (
+	FwResetTypeStartDefault   FwResetType = 0
+	FwResetTypeStartFlash0    FwResetType = 1
+	FwResetTypeStartFlash1    FwResetType = 2
+	FwResetTypeStartFlash0Ver FwResetType = 3
+	FwResetTypeStartFlash1Ver FwResetType = 4
+	FwResetTypeStartClient    FwResetType = 5
+	FwResetTypeStartClientVer FwResetType = 6
+)
+
+func (t FwResetType) String() string {
+	switch t {
+	case FwResetTypeStartDefault:
+		return "START_DEFAULT"
+	case FwResetTypeStartFlash0:
+		return "START_FLASH0"
+	case FwResetTypeStartFlash1:
+		return "START_FLASH1"
+	case FwResetTypeStartFlash0Ver:
+		return "START_FLASH0_VER"
+	case FwResetTypeStartFlash1Ver:
+		return "START_FLASH1_VER"
+	case FwResetTypeStartClient:
+		return "START_CLIENT"
+	case FwResetTypeStartClientVer:
+		return "START_CLIENT_VER"
+	}
+
+	return fmt.Sprintf("FwResetType(%d)", uint8(t))
+}
+
+// FwResetTypeNames are short names for the reset types, as used on
+// command lines.
+var FwResetTypeNames = map[string]FwResetType{
+	"default":    FwResetTypeStartDefault,
+	"flash0":     FwResetTypeStartFlash0,
+	"flash1":     FwResetTypeStartFlash1,
+	"flash0-ver": FwResetTypeStartFlash0Ver,
+	"flash1-ver": FwResetTypeStartFlash1Ver,
+	"client":     FwResetTypeStartClient,
+	"client-ver": FwResetTypeStartClientVer,
+}
+
+// ParseFwResetType returns the reset type called name in
+// FwResetTypeNames.
+func ParseFwResetType(name string) (FwResetType, error) {
+	t, ok := FwResetTypeNames[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid reset type: %s", name)
+	}
+
+	return t, nil
+}
+
+// FwResetTypeFromInt returns the reset type i, or an error if i isn't
+// a known reset type.
+func FwResetTypeFromInt(i int) (FwResetType, error) {
+	if i < int(FwResetTypeStartDefault) || i > int(FwResetTypeStartClientVer) {
+		return 0, fmt.Errorf("invalid reset type: %d", i)
+	}
+
+	return FwResetType(i), nil
+}
+
+// ResetDst is the next app data the verifier expects to find after
+// a reset, telling it whether to verify and start the app in slot 1
+// or to wait for commands. See enum bv_nad in verifier/bv_nad.h.
+type ResetDst uint8
+
+const (
+	VerifierResetDstApp1    ResetDst = 0
+	VerifierResetDstCmdMode ResetDst = 1
+)
+
+func (d ResetDst) String() string {
+	switch d {
+	case VerifierResetDstApp1:
+		return "BV_NAD_BOOT_APP_1"
+	case VerifierResetDstCmdMode:
+		return "BV_NAD_WAIT_FOR_COMMAND"
+	}
+
+	return fmt.Sprintf("ResetDst(%d)", uint8(d))
+}
+
+// ResetDstNames are short names for the reset destinations, as used
+// on command lines.
+var ResetDstNames = map[string]ResetDst{
+	"app1":     VerifierResetDstApp1,
+	"cmd-mode": VerifierResetDstCmdMode,
+}
+
+// ParseResetDst returns the reset destination called name in
+// ResetDstNames.
+func ParseResetDst(name string) (ResetDst, error) {
+	d, ok := ResetDstNames[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid reset dst: %s", name)
+	}
+
+	return d, nil
+}
+
+// ResetDstFromInt returns the reset destination i, or an error if i
+// isn't a known destination.
+func ResetDstFromInt(i int) (ResetDst, error) {
+	if i < int(VerifierResetDstApp1) || i > int(VerifierResetDstCmdMode) {
+		return 0, fmt.Errorf("invalid reset dst: %d", i)
+	}
+
+	return ResetDst(i), nil
+}
+
+// Statuses in verifier responses. The verifier in verifier/ replies
+// StatusBad to every failure, the others are proposed. See the README.
+const (
+	StatusOK              = 0x00
+	StatusBad             = 0x01
+	StatusPresenceTimeout = 0x02
+	StatusInvalidSize     = 0x03
+	StatusFlashFailed     = 0x04
+	StatusBadState        = 0x05
+)
+
+// statusErrors are the errors for the verifier statuses, for
+// errors.Is on a StatusError.
+var statusErrors = map[byte]error{
+	StatusPresenceTimeout: ErrNoTouch,
+	StatusInvalidSize:     ErrInvalidSize,
+	StatusFlashFailed:     ErrFlashFailed,
+	StatusBadState:        ErrBadState,
+}
+
+// StatusError is returned when the verifier answers a command with a
+// status other than STATUS_OK.
+type StatusError struct {
+	Cmd    tkeyclient.Cmd
+	Status byte
+}
+
+func (e *StatusError) Error() string {
+	if e.Cmd.Endpoint() != tkeyclient.DestApp {
+		return fmt.Sprintf("%v not OK", e.Cmd)
+	}
+
+	switch e.Status {
+	case StatusBad:
+		switch e.Cmd {
+		case CmdEraseAreas, CmdStorePubkey, CmdUpdateAppInit:
+			return fmt.Sprintf("%v not OK: touch not confirmed, or the TKey failed and halted", e.Cmd)
+		}
+
+	case StatusPresenceTimeout:
+		return fmt.Sprintf("%v: touch not confirmed, nothing was changed", e.Cmd)
+
+	case StatusInvalidSize:
+		return fmt.Sprintf("%v: app size invalid, nothing was changed", e.Cmd)
+
+	case StatusFlashFailed:
+		switch e.Cmd {
+		case CmdUpdateAppInit, CmdUpdateAppChunk:
+			return fmt.Sprintf("%v: flash write failed, slot 1 may be empty. Remove and reinsert the TKey", e.Cmd)
+		case CmdEraseAreas:
+			return fmt.Sprintf("%v: flash erase failed, storage areas may be partly erased. Remove and reinsert the TKey", e.Cmd)
+		case CmdStorePubkey:
+			return fmt.Sprintf("%v: flash write failed, the pubkey may not be stored. Remove and reinsert the TKey", e.Cmd)
+		}
+
+		// Reading flash only fails for a verifier not started
+		// from flash.
+		return fmt.Sprintf("%v: flash access failed, is the verifier running from slot 0? Remove and reinsert the TKey", e.Cmd)
+
+	case StatusBadState:
+		return fmt.Sprintf("%v: not allowed by the verifier now, nothing was changed", e.Cmd)
+	}
+
+	return fmt.Sprintf("%v not OK", e.Cmd)
+}
+
+// Is reports whether target is ErrStatus or, for a verifier command,
+// the error for the status, like ErrNoTouch.
+func (e *StatusError) Is(target error) bool {
+	if target == ErrStatus {
+		return true
+	}
+
+	class, ok := statusErrors[e.Status]
+
+	return ok && e.Cmd.Endpoint() == tkeyclient.DestApp && target == class
+}
@@ -0,0 +1,287 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// Trace event kinds.
+const (
+	TraceTx        = "tx"
+	TraceRx        = "rx"
+	TraceTimeout   = "timeout"
+	TraceClose     = "close"
+	TraceReconnect = "reconnect"
+)
+
+// TraceEvent is one line in a trace file, written as a JSON object.
+type TraceEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// Cmd is the name of the command or response in a tx or rx
+	// frame, if known.
+	Cmd string `json:"cmd,omitempty"`
+	// Frame is a whole frame in hex, header byte included.
+	Frame string `json:"frame,omitempty"`
+	// Seconds is the read timeout set, 0 meaning none.
+	Seconds int `json:"seconds,omitempty"`
+	// Err is the error returned, if any.
+	Err string `json:"err,omitempty"`
+	// Class is the class of Err: no-device, many-devices,
+	// port-closed, timeout, protocol, status or nok, after the
+	// errors in this package.
+	Class string `json:"class,omitempty"`
+}
+
+// FwCommands are the commands a client can send to firmware.
+var FwCommands = []tkeyclient.Cmd{
+	FwCmdGetNameVersion, FwCmdLoadApp, FwCmdLoadAppData, FwCmdGetUDI,
+}
+
+// Trace is a Transport recording everything going through another
+// Transport as JSON lines.
+type Trace struct {
+	t    Transport
+	enc  *json.Encoder
+	cmds []tkeyclient.Cmd
+}
+
+// NewTrace returns a Transport that records everything going through
+// t to w. Frames sent are named after the first of cmds with the same
+// endpoint and code.
+func NewTrace(t Transport, w io.Writer, cmds ...tkeyclient.Cmd) *Trace {
+	return &Trace{
+		t:    t,
+		enc:  json.NewEncoder(w),
+		cmds: cmds,
+	}
+}
+
+func (tr *Trace) record(ev TraceEvent, err error) {
+	ev.Time = time.Now()
+	if err != nil {
+		ev.Err = err.Error()
+		ev.Class = className(err)
+	}
+
+	// A trace that can't be written shouldn't stop the client.
+	_ = tr.enc.Encode(ev)
+}
+
+// cmdName names the command in frame d sent by the client.
+func (tr *Trace) cmdName(d []byte) string {
+	if len(d) < 2 {
+		return ""
+	}
+
+	hdr, err := ParseFramingHdr(d[0])
+	if err != nil {
+		return ""
+	}
+
+	for _, cmd := range tr.cmds {
+		if cmd.Endpoint() == hdr.Endpoint && cmd.Code() == d[1] {
+			return cmd.String()
+		}
+	}
+
+	return ""
+}
+
+func (tr *Trace) Write(d []byte) error {
+	err := tr.t.Write(d)
+	tr.record(TraceEvent{Event: TraceTx, Cmd: tr.cmdName(d), Frame: hex.EncodeToString(d)}, err)
+
+	return err
+}
+
+func (tr *Trace) ReadFrame(expectedResp tkeyclient.Cmd, expectedID int) ([]byte, tkeyclient.FramingHdr, error) {
+	rx, hdr, err := tr.t.ReadFrame(expectedResp, expectedID)
+
+	ev := TraceEvent{Event: TraceRx, Frame: hex.EncodeToString(rx)}
+	if len(rx) > 1 && rx[1] == expectedResp.Code() {
+		ev.Cmd = expectedResp.String()
+	}
+	tr.record(ev, err)
+
+	return rx, hdr, err
+}
+
+func (tr *Trace) SetReadTimeoutNoErr(seconds int) {
+	tr.t.SetReadTimeoutNoErr(seconds)
+	tr.record(TraceEvent{Event: TraceTimeout, Seconds: seconds}, nil)
+}
+
+func (tr *Trace) Close() error {
+	err := tr.t.Close()
+	tr.record(TraceEvent{Event: TraceClose}, err)
+
+	return err
+}
+
+func (tr *Trace) Reconnect() error {
+	err := tr.t.Reconnect()
+	tr.record(TraceEvent{Event: TraceReconnect}, err)
+
+	return err
+}
+
+// Replay is a Transport playing back a session recorded by Trace. The
+// client has to send the same frames in the same order as when the
+// session was recorded.
+type Replay struct {
+	events []TraceEvent
+	err    error
+}
+
+// NewReplay reads a trace from r.
+func NewReplay(r io.Reader) (*Replay, error) {
+	var events []TraceEvent
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		var ev TraceEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+
+		// Read timeouts don't change what was sent or received.
+		if ev.Event == TraceTimeout {
+			continue
+		}
+
+		events = append(events, ev)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read trace: %w", err)
+	}
+
+	return &Replay{events: events}, nil
+}
+
+// next returns the next recorded event, which must be of kind event.
+func (r *Replay) next(event string) (TraceEvent, error) {
+	if r.err != nil {
+		return TraceEvent{}, r.err
+	}
+
+	if len(r.events) == 0 {
+		r.err = fmt.Errorf("replay: %s after end of trace", event)
+		return TraceEvent{}, r.err
+	}
+
+	ev := r.events[0]
+	if ev.Event != event {
+		r.err = fmt.Errorf("replay: %s, but trace has %s at %v", event, ev.Event, ev.Time)
+		return TraceEvent{}, r.err
+	}
+
+	r.events = r.events[1:]
+
+	return ev, nil
+}
+
+// recordedErr returns the error recorded in ev, if any, in its
+// class.
+func recordedErr(ev TraceEvent) error {
+	if ev.Err == "" {
+		return nil
+	}
+
+	err := errors.New(ev.Err)
+	if class, ok := classNamed(ev.Class); ok {
+		return &classErr{class, err}
+	}
+
+	return err
+}
+
+func (r *Replay) Write(d []byte) error {
+	ev, err := r.next(TraceTx)
+	if err != nil {
+		return err
+	}
+
+	if ev.Frame != hex.EncodeToString(d) {
+		r.err = fmt.Errorf("replay: sent %x, but trace has %s at %v", d, ev.Frame, ev.Time)
+		return r.err
+	}
+
+	return recordedErr(ev)
+}
+
+func (r *Replay) ReadFrame(expectedResp tkeyclient.Cmd, expectedID int) ([]byte, tkeyclient.FramingHdr, error) {
+	ev, err := r.next(TraceRx)
+	if err != nil {
+		return nil, tkeyclient.FramingHdr{}, err
+	}
+
+	if err = recordedErr(ev); err != nil {
+		return nil, tkeyclient.FramingHdr{}, err
+	}
+
+	rx, err := hex.DecodeString(ev.Frame)
+	if err != nil || len(rx) == 0 {
+		r.err = fmt.Errorf("replay: bad frame %q at %v", ev.Frame, ev.Time)
+		return nil, tkeyclient.FramingHdr{}, r.err
+	}
+
+	hdr, err := CheckFrame(rx, expectedResp, expectedID)
+	if err != nil {
+		return nil, hdr, err
+	}
+
+	return rx, hdr, nil
+}
+
+func (r *Replay) SetReadTimeoutNoErr(int) {
+}
+
+func (r *Replay) Close() error {
+	ev, err := r.next(TraceClose)
+	if err != nil {
+		return err
+	}
+
+	return recordedErr(ev)
+}
+
+func (r *Replay) Reconnect() error {
+	ev, err := r.next(TraceReconnect)
+	if err != nil {
+		return err
+	}
+
+	return recordedErr(ev)
+}
+
+// Err returns the first deviation from the trace, or an error if the
+// trace wasn't played to the end.
+func (r *Replay) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	if len(r.events) != 0 {
+		return fmt.Errorf("replay: %d events left, next is %s at %v", len(r.events), r.events[0].Event, r.events[0].Time)
+	}
+
+	return nil
+}
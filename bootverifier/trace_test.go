@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// newTestReplay returns a Replay of events.
+func newTestReplay(t *testing.T, events ...TraceEvent) *Replay {
+	t.Helper()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewReplay(&buf)
+	if err != nil {
+		t.Fatalf("NewReplay: %v", err)
+	}
+
+	return r
+}
+
+// frame returns a frame for cmd with frame ID id and data after the
+// command code.
+func frame(t *testing.T, cmd tkeyclient.Cmd, id int, data ...byte) []byte {
+	t.Helper()
+
+	f, err := tkeyclient.NewFrameBuf(cmd, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(f[2:], data)
+
+	return f
+}
+
+func TestReplay(t *testing.T) {
+	tx := frame(t, CmdGetPubkey, 2)
+	rx := frame(t, RspGetPubkey, 2, tkeyclient.StatusOK)
+	session := []TraceEvent{
+		{Event: TraceTimeout, Seconds: 2},
+		{Event: TraceTx, Frame: hex.EncodeToString(tx)},
+		{Event: TraceRx, Frame: hex.EncodeToString(rx)},
+		{Event: TraceRx, Err: "Read timeout", Class: "timeout"},
+		{Event: TraceClose},
+		{Event: TraceReconnect},
+	}
+
+	t.Run("same session", func(t *testing.T) {
+		r := newTestReplay(t, session...)
+
+		if err := r.Write(tx); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		got, _, err := r.ReadFrame(RspGetPubkey, 2)
+		if err != nil || !bytes.Equal(got, rx) {
+			t.Fatalf("ReadFrame: %x, %v", got, err)
+		}
+
+		// Recorded errors come back with their class.
+		if _, _, err := r.ReadFrame(RspGetPubkey, 2); !errors.Is(err, ErrTimeout) || err.Error() != "Read timeout" {
+			t.Errorf("expected recorded timeout, got %v", err)
+		}
+
+		if err := r.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+
+		if err := r.Reconnect(); err != nil {
+			t.Errorf("Reconnect: %v", err)
+		}
+
+		if err := r.Err(); err != nil {
+			t.Errorf("Err: %v", err)
+		}
+	})
+
+	t.Run("other frame sent", func(t *testing.T) {
+		r := newTestReplay(t, session...)
+
+		err := r.Write(frame(t, CmdGetPubkey, 3))
+		if err == nil {
+			t.Fatalf("Write of another frame succeeded")
+		}
+
+		// Nothing plays after a deviation.
+		if _, _, err := r.ReadFrame(RspGetPubkey, 2); err == nil {
+			t.Errorf("ReadFrame succeeded after deviation")
+		}
+
+		if r.Err() != err {
+			t.Errorf("Err: %v, expected %v", r.Err(), err)
+		}
+	})
+
+	t.Run("other response expected", func(t *testing.T) {
+		r := newTestReplay(t, session...)
+
+		if err := r.Write(tx); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if _, _, err := r.ReadFrame(RspSetPubkey, 2); !errors.Is(err, ErrProtocol) {
+			t.Errorf("expected protocol error, got %v", err)
+		}
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		r := newTestReplay(t, session...)
+
+		if err := r.Reconnect(); err == nil {
+			t.Errorf("Reconnect succeeded before the frames")
+		}
+	})
+
+	t.Run("not played to the end", func(t *testing.T) {
+		r := newTestReplay(t, session...)
+
+		if err := r.Write(tx); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if err := r.Err(); err == nil {
+			t.Errorf("expected events left")
+		}
+	})
+}
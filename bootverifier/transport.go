@@ -0,0 +1,247 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// Transport carries framing protocol frames to and from a TKey. The
+// methods other than Reconnect have the same meaning as the ones on
+// tkeyclient.TillitisKey.
+type Transport interface {
+	// Write writes a whole frame, header byte included.
+	Write(d []byte) error
+
+	// ReadFrame reads a response frame, expecting expectedResp
+	// with frame ID expectedID.
+	ReadFrame(expectedResp tkeyclient.Cmd, expectedID int) ([]byte, tkeyclient.FramingHdr, error)
+
+	// SetReadTimeoutNoErr sets the read timeout in seconds. 0
+	// means no timeout.
+	SetReadTimeoutNoErr(seconds int)
+
+	// Close closes the connection.
+	Close() error
+
+	// Reconnect opens the connection again after the TKey has
+	// reset and come back.
+	Reconnect() error
+}
+
+// Serial is a Transport over a TKey's serial port.
+type Serial struct {
+	*tkeyclient.TillitisKey
+
+	// devPath is the serial port in use.
+	devPath string
+
+	// dev identifies the TKey, to find it again after a reset.
+	dev usbDevice
+}
+
+// ReconnectTimeout is how long, in seconds, Reconnect waits for the
+// TKey to come back.
+const ReconnectTimeout = 10
+
+// portGoneTimeout is how long Reconnect waits for the old serial port
+// to go away before looking for the new one. It might already have
+// come back under the same name.
+const portGoneTimeout = 1 * time.Second
+
+// pollInterval is how often Reconnect looks for the serial port.
+const pollInterval = 50 * time.Millisecond
+
+// Connect opens the TKey serial port in port. If port is empty the
+// port is auto-detected, which fails with ErrManyDevices if there is
+// more than one TKey. Use SelectDevice to pick one of them.
+func Connect(port string) (*Serial, error) {
+	var err error
+
+	devPath := port
+	if devPath == "" {
+		devPath, err = tkeyclient.DetectSerialPort(true)
+		if err != nil {
+			return nil, detectErr(err)
+		}
+	}
+
+	tk := tkeyclient.New()
+	if err = tk.Connect(devPath, tkeyclient.WithSpeed(tkeyclient.SerialSpeed)); err != nil {
+		return nil, withClass(ErrNoDevice, fmt.Errorf("could not open %s: %w", devPath, err))
+	}
+
+	return &Serial{tk, devPath, identify(devPath)}, nil
+}
+
+// findPort returns the serial port of the TKey, if it is there: the
+// same USB device as before, or, for a TKey not on USB, the port
+// given to Connect.
+func (s *Serial) findPort() (string, bool) {
+	if s.dev != (usbDevice{}) {
+		return s.dev.find()
+	}
+
+	_, err := os.Stat(s.devPath)
+
+	return s.devPath, err == nil
+}
+
+// Reconnect waits for the TKey to come back after a reset and opens
+// its serial port again. It first waits a moment for the old port to
+// go away, then polls for the same TKey to come back, for at most
+// ReconnectTimeout seconds. With several TKeys plugged in it only
+// opens the one it was connected to.
+func (s *Serial) Reconnect() error {
+	gone := time.Now().Add(portGoneTimeout)
+	for time.Now().Before(gone) {
+		if _, ok := s.findPort(); !ok {
+			break
+		}
+		time.Sleep(pollInterval)
+	}
+
+	var err error
+	deadline := time.Now().Add(ReconnectTimeout * time.Second)
+
+	for {
+		if devPath, ok := s.findPort(); ok {
+			err = s.Connect(devPath, tkeyclient.WithSpeed(tkeyclient.SerialSpeed))
+			if err == nil {
+				s.devPath = devPath
+				return nil
+			}
+			err = fmt.Errorf("could not open %s: %w", devPath, err)
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return withClass(ErrNoDevice, err)
+			}
+
+			return withClass(ErrNoDevice, fmt.Errorf("TKey on %s didn't come back in %d s", s.devPath, ReconnectTimeout))
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitForReset waits for the TKey to reset after a command making it
+// reset, like CmdReset, and connects to it again. A TKey on USB drops
+// its serial port when it resets, while QEMU keeps it open, so this
+// reads until the port closes or timeout seconds pass in silence. It
+// returns whether the port closed.
+func WaitForReset(t Transport, timeout int) (bool, error) {
+	t.SetReadTimeoutNoErr(timeout)
+	_, _, err := t.ReadFrame(RspVerify, 0x01)
+	t.SetReadTimeoutNoErr(0)
+
+	switch {
+	case err == nil:
+		return false, withClass(ErrProtocol, errors.New("answer while waiting for reset"))
+	case errors.Is(err, ErrTimeout):
+		// Still there. Either it keeps the port when
+		// resetting, or it didn't reset.
+		return false, nil
+	case !errors.Is(err, ErrPortClosed):
+		return false, err
+	}
+
+	_ = t.Close()
+
+	if err := t.Reconnect(); err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// Port returns the serial port in use.
+func (s *Serial) Port() string {
+	return s.devPath
+}
+
+// USBSerial returns the USB serial number of the TKey, or "" if it
+// isn't on USB.
+func (s *Serial) USBSerial() string {
+	return s.dev.serial
+}
+
+// OwnUSBSerial reports whether the USB serial number of the TKey is
+// its own: not the one older TKeys all have, and not the one of
+// another TKey attached.
+func (s *Serial) OwnUSBSerial() bool {
+	if s.dev.serial == "" || s.dev.serial == SharedUSBSerial {
+		return false
+	}
+
+	devs, err := ListDevices()
+	if err != nil {
+		return false
+	}
+
+	for _, d := range devs {
+		if d.Serial == s.dev.serial && !samePort(d.Port, s.devPath) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Write is tkeyclient.TillitisKey.Write, with errors wrapping
+// ErrPortClosed.
+func (s *Serial) Write(d []byte) error {
+	return withClass(ErrPortClosed, s.TillitisKey.Write(d))
+}
+
+// tkeyclientTimeout is the message of the error
+// tkeyclient.TillitisKey.ReadFrame returns when nothing arrives in
+// time.
+const tkeyclientTimeout = "Read timeout"
+
+// ReadFrame is tkeyclient.TillitisKey.ReadFrame, with errors wrapping
+// ErrTimeout, ErrPortClosed or ErrProtocol.
+func (s *Serial) ReadFrame(expectedResp tkeyclient.Cmd, expectedID int) ([]byte, tkeyclient.FramingHdr, error) {
+	rx, hdr, err := s.TillitisKey.ReadFrame(expectedResp, expectedID)
+
+	return rx, hdr, readErrClass(err)
+}
+
+// readErrClass classifies an error from
+// tkeyclient.TillitisKey.ReadFrame.
+//
+// tkeyclient has no error values of its own other than
+// ErrResponseStatusNotOK. Its timeout is a plain fmt.Errorf, so only
+// the message tells it apart, and its errors from reading the port
+// wrap the error from the port with a "Read: " or "ReadFull: " prefix.
+// Everything else it returns is about the frame it got.
+func readErrClass(err error) error {
+	switch {
+	case err == nil, errors.Is(err, tkeyclient.ErrResponseStatusNotOK):
+		return err
+
+	case err.Error() == tkeyclientTimeout:
+		return withClass(ErrTimeout, err)
+
+	// The port closing, also in the middle of a frame.
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return withClass(ErrPortClosed, err)
+
+	// Any other error from reading the port, like EIO when the
+	// TKey is pulled out.
+	case errors.Unwrap(err) != nil &&
+		(strings.HasPrefix(err.Error(), "Read: ") || strings.HasPrefix(err.Error(), "ReadFull: ")):
+		return withClass(ErrPortClosed, err)
+	}
+
+	return withClass(ErrProtocol, err)
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+func TestReadErrClass(t *testing.T) {
+	// The errors are made like tkeyclient.TillitisKey.ReadFrame
+	// makes them.
+	tests := []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{"none", nil, ""},
+		{"timeout", fmt.Errorf("Read timeout"), "timeout"},
+		{"closed", fmt.Errorf("Read: %w", io.EOF), "port-closed"},
+		{"closed mid-frame", fmt.Errorf("ReadFull: %w", io.ErrUnexpectedEOF), "port-closed"},
+		{"pulled out", fmt.Errorf("Read: %w", syscall.EIO), "port-closed"},
+		{"nok", fmt.Errorf("%w; ReadFull: %w", tkeyclient.ErrResponseStatusNotOK, io.EOF), "nok"},
+		{"wrong id", fmt.Errorf("Expected ID %d, got %d", 2, 1), "protocol"},
+		{"wrong length", fmt.Errorf("Expected cmdlen %v (%d bytes), got %v (%d bytes)", tkeyclient.CmdLen128, 128, tkeyclient.CmdLen4, 4), "protocol"},
+		{"not wrapping", errors.New("Read: something"), "protocol"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := readErrClass(tt.err)
+
+			if got := className(err); got != tt.class {
+				t.Errorf("class %q, expected %q", got, tt.class)
+			}
+
+			if tt.err != nil && err.Error() != tt.err.Error() {
+				t.Errorf("message changed to %q", err)
+			}
+		})
+	}
+}
+
+func TestClassNameOrder(t *testing.T) {
+	// Reconnecting after the port closed fails with both, and is
+	// always taken for the TKey gone.
+	err := withClass(ErrNoDevice, withClass(ErrPortClosed, errors.New("gone")))
+
+	for range 100 {
+		if got := className(err); got != "no-device" {
+			t.Fatalf("class %q, expected no-device", got)
+		}
+	}
+}
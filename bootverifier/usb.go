@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"path/filepath"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// usbDevice identifies a TKey on USB across resets, when its serial
+// port might come back under another name.
+type usbDevice struct {
+	// serial is the USB serial number. Not all TKeys have a
+	// unique one.
+	serial string
+
+	// sysfsPath is the USB device in sysfs, the same as long as
+	// the TKey stays in the same USB port. Linux only.
+	sysfsPath string
+}
+
+// samePort reports whether a and b are the same serial port, after
+// following symlinks like the ones in /dev/serial/by-id.
+func samePort(a, b string) bool {
+	if ra, err := filepath.EvalSymlinks(a); err == nil {
+		a = ra
+	}
+
+	if rb, err := filepath.EvalSymlinks(b); err == nil {
+		b = rb
+	}
+
+	return a == b
+}
+
+// identify returns what identifies the TKey on serial port devPath,
+// or the zero usbDevice if it isn't a TKey on USB, like a simulated
+// one.
+func identify(devPath string) usbDevice {
+	ports, err := tkeyclient.GetSerialPorts()
+	if err != nil {
+		return usbDevice{}
+	}
+
+	for _, p := range ports {
+		if samePort(p.DevPath, devPath) {
+			return usbDevice{p.SerialNumber, sysfsPath(p.DevPath)}
+		}
+	}
+
+	return usbDevice{}
+}
+
+// find returns the serial port of the TKey identified by d, if it
+// is there.
+func (d usbDevice) find() (string, bool) {
+	ports, err := tkeyclient.GetSerialPorts()
+	if err != nil {
+		return "", false
+	}
+
+	return d.findIn(ports)
+}
+
+// findIn returns the serial port of the TKey identified by d among
+// ports, if it is there. The sysfs path is preferred, and if it is
+// known the serial number isn't used, so another TKey with the same
+// serial number is never picked.
+func (d usbDevice) findIn(ports []tkeyclient.SerialPort) (string, bool) {
+	if d.sysfsPath != "" {
+		for _, p := range ports {
+			if sysfsPath(p.DevPath) == d.sysfsPath {
+				return p.DevPath, true
+			}
+		}
+
+		return "", false
+	}
+
+	found := ""
+	for _, p := range ports {
+		if d.serial != "" && p.SerialNumber == d.serial {
+			if found != "" {
+				// Can't tell them apart.
+				return "", false
+			}
+			found = p.DevPath
+		}
+	}
+
+	return found, found != ""
+}
@@ -0,0 +1,26 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package bootverifier
+
+import (
+	"path/filepath"
+)
+
+// sysfsPath returns the USB device of serial port devPath in sysfs,
+// like /sys/devices/pci0000:00/0000:00:14.0/usb1/1-2, or "" if it
+// can't be found.
+func sysfsPath(devPath string) string {
+	if p, err := filepath.EvalSymlinks(devPath); err == nil {
+		devPath = p
+	}
+
+	// The tty's device is the USB interface, like 1-2:1.0, with
+	// the USB device as its parent.
+	iface, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", filepath.Base(devPath), "device"))
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Dir(iface)
+}
@@ -0,0 +1,12 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build !linux
+
+package bootverifier
+
+// sysfsPath returns "", there is no sysfs outside Linux. TKeys are
+// found again by USB serial number only.
+func sysfsPath(string) string {
+	return ""
+}
@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package cdi computes the Compound Device Identifiers firmware gives
+// apps, as described in doc/design.md, for when the UDS is known, as
+// in QEMU or the simulator.
+package cdi
+
+import (
+	"crypto/ed25519"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// Domain bits in the CDI computation.
+const (
+	DomainUSS     = 1 << 0
+	DomainChained = 1 << 1
+)
+
+// Domain returns the domain byte: 0 for a directly loaded app, 1 with
+// USS, 2 for a chained app, 3 with USS.
+func Domain(chained bool, useUSS bool) byte {
+	var domain byte
+	if chained {
+		domain |= DomainChained
+	}
+	if useUSS {
+		domain |= DomainUSS
+	}
+
+	return domain
+}
+
+// Compute computes the CDI firmware gives an app: BLAKE2s over the
+// UDS, the domain byte, the measurement (app digest or measured_id)
+// and, if used, the USS.
+func Compute(uds [32]byte, chained bool, measurement [32]byte, useUSS bool, uss [32]byte) [32]byte {
+	h, _ := blake2s.New256(nil)
+	h.Write(uds[:])
+	h.Write([]byte{Domain(chained, useUSS)})
+	h.Write(measurement[:])
+	if useUSS {
+		h.Write(uss[:])
+	}
+
+	var cdi [32]byte
+	copy(cdi[:], h.Sum(nil))
+
+	return cdi
+}
+
+// MeasuredID is what firmware computes from the CDI of the app asking
+// for a reset with a seed. It survives the reset and is used instead
+// of the app digest for the next app's CDI.
+func MeasuredID(cdi [32]byte, seed [32]byte) [32]byte {
+	return blake2s.Sum256(append(cdi[:], seed[:]...))
+}
+
+// MeasuredIDSeed is the seed the verifier passes to firmware for an
+// app verified with pubkey, see reset_if_verified() in
+// verifier/verify.c.
+func MeasuredIDSeed(pubkey [ed25519.PublicKeySize]byte) [32]byte {
+	return blake2s.Sum256(pubkey[:])
+}
+
+// Chain is what goes into the CDI of an app started by the verifier.
+type Chain struct {
+	UDS [32]byte
+
+	// Verifier is the verifier binary.
+	Verifier []byte
+
+	// VerifierUSS, if set, is the USS the client loaded the
+	// verifier with. The verifier on flash has none.
+	VerifierUSS *[32]byte
+
+	// Pubkey is the vendor public key the app is verified with.
+	Pubkey [ed25519.PublicKeySize]byte
+
+	// AppUSS, if set, is the USS the client loaded the verified
+	// app with.
+	AppUSS *[32]byte
+}
+
+// VerifierCDI returns the CDI of the verifier.
+func (c Chain) VerifierCDI() [32]byte {
+	return compute(c.UDS, false, blake2s.Sum256(c.Verifier), c.VerifierUSS)
+}
+
+// MeasuredID returns the measured_id firmware computes when the
+// verifier starts the app.
+func (c Chain) MeasuredID() [32]byte {
+	return MeasuredID(c.VerifierCDI(), MeasuredIDSeed(c.Pubkey))
+}
+
+// AppCDI returns the CDI of the app the verifier starts. It doesn't
+// depend on the app, only on who signed it.
+func (c Chain) AppCDI() [32]byte {
+	return compute(c.UDS, true, c.MeasuredID(), c.AppUSS)
+}
+
+func compute(uds [32]byte, chained bool, measurement [32]byte, uss *[32]byte) [32]byte {
+	if uss == nil {
+		return Compute(uds, chained, measurement, false, [32]byte{})
+	}
+
+	return Compute(uds, chained, measurement, true, *uss)
+}
@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package cdi_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/cdi"
+	"tkey-mgt/sim"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+var (
+	testUDS      = [32]byte{1, 2, 3}
+	testVerifier = bytes.Repeat([]byte("verifier"), 100)
+	testApp      = bytes.Repeat([]byte{0x42}, 1000)
+	testKey      = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x01}, ed25519.SeedSize))
+	testPubkey   = [ed25519.PublicKeySize]byte(testKey.Public().(ed25519.PublicKey))
+)
+
+func sign(bin []byte) [ed25519.SignatureSize]byte {
+	digest := blake2s.Sum256(bin)
+
+	return [ed25519.SignatureSize]byte(ed25519.Sign(testKey, digest[:]))
+}
+
+func TestCompute(t *testing.T) {
+	measurement := [32]byte{4, 5, 6}
+	uss := [32]byte{7, 8, 9}
+
+	tests := []struct {
+		chained, useUSS bool
+		domain          byte
+	}{
+		{false, false, 0},
+		{false, true, 1},
+		{true, false, 2},
+		{true, true, 3},
+	}
+
+	for _, tt := range tests {
+		if d := cdi.Domain(tt.chained, tt.useUSS); d != tt.domain {
+			t.Errorf("domain %d, expected %d", d, tt.domain)
+		}
+
+		in := append(append(testUDS[:], tt.domain), measurement[:]...)
+		if tt.useUSS {
+			in = append(in, uss[:]...)
+		}
+
+		if cdi.Compute(testUDS, tt.chained, measurement, tt.useUSS, uss) != blake2s.Sum256(in) {
+			t.Errorf("unexpected CDI for domain %d", tt.domain)
+		}
+	}
+}
+
+func TestChainFlash(t *testing.T) {
+	d := sim.New(sim.Config{VerifierBinary: testVerifier, Pubkey: testPubkey, App: testApp, AppSig: sign(testApp), UDS: testUDS})
+	if d.Mode() != sim.ModeApp {
+		t.Fatalf("expected app running, got %v", d.Mode())
+	}
+
+	c := cdi.Chain{UDS: testUDS, Verifier: testVerifier, Pubkey: testPubkey}
+	if c.AppCDI() != d.CDI() {
+		t.Errorf("predicted CDI %x, app got %x", c.AppCDI(), d.CDI())
+	}
+
+	// The app started by the verifier doesn't get the CDI it would
+	// get started directly.
+	if d.CDI() == cdi.Compute(testUDS, false, blake2s.Sum256(testApp), false, [32]byte{}) {
+		t.Errorf("app got the CDI of a directly loaded app")
+	}
+}
+
+func TestChainClientUSS(t *testing.T) {
+	d := sim.New(sim.Config{VerifierBinary: testVerifier, UDS: testUDS})
+	tr := sim.NewTransport(d)
+	bv := bootverifier.New(tr)
+
+	if err := bv.Reset(bootverifier.FwResetTypeStartClient, bootverifier.VerifierResetDstCmdMode); err != nil {
+		t.Fatal(err)
+	}
+	_ = tr.Reconnect()
+
+	if err := bootverifier.LoadApp(tr, testVerifier, []byte("verifier secret")); err != nil {
+		t.Fatalf("LoadApp verifier: %v", err)
+	}
+
+	if err := bv.SetPubkey(testPubkey); err != nil {
+		t.Fatalf("SetPubkey: %v", err)
+	}
+
+	if err := bv.Verify(blake2s.Sum256(testApp), sign(testApp)); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	_ = tr.Reconnect()
+
+	if err := bootverifier.LoadApp(tr, testApp, []byte("app secret")); err != nil {
+		t.Fatalf("LoadApp app: %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp {
+		t.Fatalf("expected app running, got %v", d.Mode())
+	}
+
+	verifierUSS := blake2s.Sum256([]byte("verifier secret"))
+	appUSS := blake2s.Sum256([]byte("app secret"))
+	c := cdi.Chain{UDS: testUDS, Verifier: testVerifier, VerifierUSS: &verifierUSS, Pubkey: testPubkey, AppUSS: &appUSS}
+	if c.AppCDI() != d.CDI() {
+		t.Errorf("predicted CDI %x, app got %x", c.AppCDI(), d.CDI())
+	}
+
+	// Without the USS the prediction is another CDI.
+	c.VerifierUSS = nil
+	if c.AppCDI() == d.CDI() {
+		t.Errorf("CDI doesn't depend on the verifier USS")
+	}
+}
@@ -8,8 +8,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"slices"
 
-	"github.com/tillitis/tkeyclient"
+	"tkey-mgt/bootverifier"
 )
 
 func usage() {
@@ -18,12 +19,11 @@ func usage() {
 }
 
 func main() {
-	var err error
-
 	cmd := flag.String("cmd", "", "Command. One of: reset, get-cdi, get-nameversion")
 	port := flag.String("port", "", "TKey serial port")
 	fwResType := flag.Int("fw-reset-type", 0, "Firmware reset type. Integer")
 	verifierResetDst := flag.Int("verifier-reset-dst", 0, "Verifier reset dst. Integer")
+	tracePath := flag.String("trace", "", "Record every frame sent and received to this file")
 
 	flag.Usage = usage
 
@@ -34,20 +34,24 @@ func main() {
 		os.Exit(1)
 	}
 
-	devPath := *port
-	if devPath == "" {
-		devPath, err = tkeyclient.DetectSerialPort(true)
+	var tk bootverifier.Transport
+
+	tk, err := bootverifier.Connect(*port)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if *tracePath != "" {
+		f, err := os.Create(*tracePath)
 		if err != nil {
-			fmt.Printf("couldn't find any TKeys\n")
+			_ = tk.Close()
+			fmt.Printf("couldn't create trace: %v\n", err)
 			os.Exit(1)
 		}
-	}
+		defer func() { _ = f.Close() }()
 
-	tk := tkeyclient.New()
-
-	if err = tk.Connect(devPath, tkeyclient.WithSpeed(tkeyclient.SerialSpeed)); err != nil {
-		fmt.Printf("Could not open %s: %v\n", devPath, err)
-		os.Exit(1)
+		tk = bootverifier.NewTrace(tk, f, slices.Concat(testappCommands, bootverifier.FwCommands)...)
 	}
 
 	defer func() { _ = tk.Close() }()
@@ -77,19 +81,19 @@ func main() {
 		fmt.Printf("%s%s %d\n", nameVer.Name0, nameVer.Name1, nameVer.Version)
 
 	case "reset":
-		rstType, err := fwResetTypeFromInt(*fwResType)
+		rstType, err := bootverifier.FwResetTypeFromInt(*fwResType)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			exit(1)
 		}
 
-		dst, err := resetDstFromInt(*verifierResetDst)
+		dst, err := bootverifier.ResetDstFromInt(*verifierResetDst)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			exit(1)
 		}
 
-		err = reset(tk, rstType, dst)
+		err = bootverifier.New(tk).Reset(rstType, dst)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			exit(1)
@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// errAuditBroken is returned when the audit log has been tampered
+// with.
+var errAuditBroken = errors.New("audit log chain broken")
+
+// auditEntry is one state-changing operation in the audit log, one
+// JSON object per line. Each entry includes the hash of the one
+// before it, so that changing, removing or reordering entries breaks
+// the chain.
+type auditEntry struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	// Operation is erase-areas, install, install-pubkey, boot or
+	// provision.
+	Operation string `json:"operation"`
+	// Port, USBSerial and, if known, UDI identify the TKey.
+	Port      string `json:"port,omitempty"`
+	USBSerial string `json:"usb_serial,omitempty"`
+	UDI       string `json:"udi,omitempty"`
+	// OldPubkey and NewPubkey are the vendor public key before and
+	// after, in hex. For boot NewPubkey is the one booted with.
+	OldPubkey string `json:"old_pubkey,omitempty"`
+	NewPubkey string `json:"new_pubkey,omitempty"`
+	AppDigest string `json:"app_digest,omitempty"`
+	// KeyNum is the key number in the signature file, in hex.
+	KeyNum string `json:"key_num,omitempty"`
+	// Outcome is "ok" or the class of the error, as in the JSON
+	// result.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// Prev is the hash of the entry before, empty for the first.
+	Prev string `json:"prev"`
+	// Hash is the BLAKE2s digest of this entry as JSON with Hash
+	// empty, in hex.
+	Hash string `json:"hash"`
+}
+
+// hash returns what e.Hash should be.
+func (e auditEntry) hash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	digest := blake2s.Sum256(b)
+
+	return hex.EncodeToString(digest[:])
+}
+
+// newAuditEntry returns an entry for operation from a command's
+// result and err, if it failed.
+func newAuditEntry(operation string, res *result, err error) auditEntry {
+	e := auditEntry{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		Port:      res.Port,
+		USBSerial: res.USBSerial,
+		UDI:       res.UDI,
+		OldPubkey: res.PreviousPubkey,
+		NewPubkey: res.Pubkey,
+		AppDigest: res.AppDigest,
+		KeyNum:    res.KeyNum,
+		Outcome:   "ok",
+	}
+	e.Host, _ = os.Hostname()
+
+	if err != nil {
+		e.Outcome = exitClasses[exitCode(err)]
+		e.Error = err.Error()
+	}
+
+	return e
+}
+
+// readAudit reads the entries in r, checking that they form an
+// unbroken chain.
+func readAudit(r io.Reader) ([]auditEntry, error) {
+	var entries []auditEntry
+	prev := ""
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+
+	for line := 1; s.Scan(); line++ {
+		var e auditEntry
+
+		dec := json.NewDecoder(bytes.NewReader(s.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return entries, fmt.Errorf("%w: line %d: %w", errAuditBroken, line, err)
+		}
+
+		switch {
+		case e.Seq != len(entries)+1:
+			return entries, fmt.Errorf("%w: line %d: entry %d, expected %d", errAuditBroken, line, e.Seq, len(entries)+1)
+		case e.Prev != prev:
+			return entries, fmt.Errorf("%w: line %d: doesn't follow the entry before", errAuditBroken, line)
+		case e.Hash != e.hash():
+			return entries, fmt.Errorf("%w: line %d: entry changed", errAuditBroken, line)
+		}
+
+		entries = append(entries, e)
+		prev = e.Hash
+	}
+
+	if err := s.Err(); err != nil {
+		return entries, fmt.Errorf("read audit log: %w", err)
+	}
+
+	return entries, nil
+}
+
+// checkAudit checks that the audit log in path, if there is one yet,
+// is unbroken, before doing anything to be recorded in it.
+func checkAudit(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't open audit log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	_, err = readAudit(f)
+
+	return err
+}
+
+// appendAudit adds e to the end of the audit log in path, creating
+// it if needed. It refuses to add to a broken chain.
+func appendAudit(path string, e auditEntry) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("couldn't open audit log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("couldn't lock audit log: %w", err)
+	}
+
+	entries, err := readAudit(f)
+	if err != nil {
+		return err
+	}
+
+	e.Seq = len(entries) + 1
+	if len(entries) > 0 {
+		e.Prev = entries[len(entries)-1].Hash
+	}
+	e.Hash = e.hash()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("couldn't write audit log: %w", err)
+	}
+
+	return f.Sync()
+}
+
+// verifyAudit checks the chain in the audit log in path and reports
+// the number of entries and the hash of the last one. Keep that hash
+// somewhere else to also detect entries removed from the end.
+func verifyAudit(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	entries, err := readAudit(f)
+	if err != nil {
+		return err
+	}
+
+	out.info("%d entries, chain intact\n", len(entries))
+	if len(entries) > 0 {
+		out.info("Last hash: %s\n", entries[len(entries)-1].Hash)
+	}
+	out.phase("audit-verify")
+
+	return nil
+}
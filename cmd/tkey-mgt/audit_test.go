@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAudit appends entries for operations to a new audit log and
+// returns its path.
+func writeAudit(t *testing.T, operations ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for i, op := range operations {
+		res := result{Port: "/dev/ttyACM0", UDI: "04030:8:1:08070605", PreviousPubkey: "cc", Pubkey: "aa", AppDigest: "bb"}
+		var err error
+		if i%2 == 1 {
+			err = errBadSignature
+		}
+
+		if err := appendAudit(path, newAuditEntry(op, &res, err)); err != nil {
+			t.Fatalf("appendAudit: %v", err)
+		}
+	}
+
+	return path
+}
+
+// readAuditFile reads the audit log in path.
+func readAuditFile(t *testing.T, path string) ([]auditEntry, error) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	return readAudit(f)
+}
+
+// editAudit replaces the lines of the audit log in path with what
+// edit returns.
+func editAudit(t *testing.T, path string, edit func([][]byte) [][]byte) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	lines = edit(lines)
+
+	if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	path := writeAudit(t, "install-pubkey", "install", "boot")
+
+	entries, err := readAuditFile(t, path)
+	if err != nil {
+		t.Fatalf("readAudit: %v", err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	if entries[0].Prev != "" || entries[1].Prev != entries[0].Hash || entries[2].Prev != entries[1].Hash {
+		t.Errorf("entries not chained")
+	}
+
+	if entries[0].Outcome != "ok" || entries[1].Outcome != "bad-signature" || entries[1].Error == "" {
+		t.Errorf("unexpected outcomes %q, %q", entries[0].Outcome, entries[1].Outcome)
+	}
+
+	if entries[2].Operation != "boot" || entries[2].UDI != "04030:8:1:08070605" || entries[2].OldPubkey != "cc" || entries[2].NewPubkey != "aa" || entries[2].AppDigest != "bb" {
+		t.Errorf("unexpected entry %+v", entries[2])
+	}
+
+	if err := checkAudit(filepath.Join(t.TempDir(), "none")); err != nil {
+		t.Errorf("checkAudit on a new log: %v", err)
+	}
+}
+
+func TestAuditBroken(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func([][]byte) [][]byte
+	}{
+		{"changed", func(l [][]byte) [][]byte {
+			l[1] = bytes.Replace(l[1], []byte(`"install"`), []byte(`"boot"`), 1)
+			return l
+		}},
+		{"removed", func(l [][]byte) [][]byte {
+			return append(l[:1], l[2:]...)
+		}},
+		{"reordered", func(l [][]byte) [][]byte {
+			l[1], l[2] = l[2], l[1]
+			return l
+		}},
+		{"unknown field", func(l [][]byte) [][]byte {
+			l[1] = bytes.Replace(l[1], []byte(`{`), []byte(`{"note":"x",`), 1)
+			return l
+		}},
+		{"not json", func(l [][]byte) [][]byte {
+			l[2] = []byte("garbage")
+			return l
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeAudit(t, "install-pubkey", "install", "boot")
+			editAudit(t, path, tt.edit)
+
+			if _, err := readAuditFile(t, path); !errors.Is(err, errAuditBroken) {
+				t.Errorf("expected broken chain, got %v", err)
+			}
+
+			if err := checkAudit(path); !errors.Is(err, errAuditBroken) {
+				t.Errorf("checkAudit: expected broken chain, got %v", err)
+			}
+
+			// Nothing is added to a broken chain.
+			before, _ := os.ReadFile(path)
+			if err := appendAudit(path, newAuditEntry("boot", &result{}, nil)); !errors.Is(err, errAuditBroken) {
+				t.Errorf("appendAudit: expected broken chain, got %v", err)
+			}
+			after, _ := os.ReadFile(path)
+			if !bytes.Equal(before, after) {
+				t.Errorf("appended to a broken chain")
+			}
+		})
+	}
+}
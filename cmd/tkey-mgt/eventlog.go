@@ -0,0 +1,355 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"tkey-mgt/bootverifier"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// errEventLogBroken is returned when a measured-boot event log
+// doesn't add up.
+var errEventLogBroken = errors.New("event log doesn't add up")
+
+// bootEvent is one thing measured during a verified boot, in the
+// style of a TCG event log: what it is, its digest and what the
+// digest is of.
+type bootEvent struct {
+	// Type is one of the eventTypes.
+	Type string `json:"type"`
+	// Digest is the BLAKE2s digest measured, in hex.
+	Digest string `json:"digest"`
+	// Data is what the digest is of, for the events where it isn't
+	// a binary.
+	Data string `json:"data,omitempty"`
+}
+
+// eventTypes are the events of a verified boot, in order:
+//
+//   - reset: the reset starting the verifier, with its reset type.
+//   - verifier: the digest of the verifier binary loaded by the
+//     client or, "flash-supplied", the digest of the one in slot 0
+//     given with -verifier-digest. Nothing can read slot 0, so
+//     without it the verifier is "flash-unknown", with an all-zero
+//     digest. Older logs have "flash-assumed" for the one built into
+//     tkey-mgt.
+//   - uss: "none" or "supplied", whether the verifier was loaded with
+//     a USS.
+//   - pubkey: the vendor public key the app was verified with. Its
+//     digest is the measured-ID seed, see cdi.MeasuredIDSeed.
+//   - reset: the reset the verifier asked for after verifying the
+//     app, with its reset type.
+//   - app: the digest of the app started, from slot 1 or loaded by
+//     the client.
+var eventTypes = []string{"reset", "verifier", "uss", "pubkey", "reset", "app"}
+
+// bootRecord is one verified boot in the event log, one JSON object
+// per line.
+type bootRecord struct {
+	Time time.Time `json:"time"`
+	// Command is the tkey-mgt command that booted.
+	Command string `json:"command"`
+	// Port and USBSerial identify the TKey.
+	Port      string      `json:"port,omitempty"`
+	USBSerial string      `json:"usb_serial,omitempty"`
+	Events    []bootEvent `json:"events"`
+	// Measurement is the digests of the events extended into one,
+	// like a TPM PCR, in hex. See extend.
+	Measurement string `json:"measurement"`
+}
+
+// measuredBoot is what went into a verified boot.
+type measuredBoot struct {
+	// client tells whether the client loaded the verifier and the
+	// app, instead of them starting from flash.
+	client bool
+	// verifier is the verifier binary the client loaded.
+	verifier []byte
+	// flashVerifier, if set, is the digest of the verifier in slot
+	// 0, as given by the operator.
+	flashVerifier *[blake2s.Size]byte
+	uss           bool
+	pubkey        [ed25519.PublicKeySize]byte
+	app           [blake2s.Size]byte
+}
+
+// events returns the events of b, in the order of eventTypes.
+func (b measuredBoot) events() []bootEvent {
+	text := func(typ string, data string) bootEvent {
+		digest := blake2s.Sum256([]byte(data))
+		return bootEvent{Type: typ, Digest: hex.EncodeToString(digest[:]), Data: data}
+	}
+
+	start, verified, from := bootverifier.FwResetTypeStartDefault, bootverifier.FwResetTypeStartFlash1Ver, "flash"
+	if b.client {
+		start, verified, from = bootverifier.FwResetTypeStartClient, bootverifier.FwResetTypeStartClientVer, "client"
+	}
+
+	var verifierDigest [blake2s.Size]byte
+	verifierFrom := "flash-unknown"
+	switch {
+	case b.client:
+		verifierDigest, verifierFrom = blake2s.Sum256(b.verifier), "client"
+	case b.flashVerifier != nil:
+		verifierDigest, verifierFrom = *b.flashVerifier, "flash-supplied"
+	}
+
+	uss := "none"
+	if b.uss {
+		uss = "supplied"
+	}
+
+	seed := blake2s.Sum256(b.pubkey[:])
+
+	return []bootEvent{
+		text("reset", resetTypeName(start)),
+		{Type: "verifier", Digest: hex.EncodeToString(verifierDigest[:]), Data: verifierFrom},
+		text("uss", uss),
+		{Type: "pubkey", Digest: hex.EncodeToString(seed[:]), Data: hex.EncodeToString(b.pubkey[:])},
+		text("reset", resetTypeName(verified)),
+		{Type: "app", Digest: hex.EncodeToString(b.app[:]), Data: from},
+	}
+}
+
+// parseVerifierDigest parses the digest of the verifier on flash, as
+// given with -verifier-digest.
+func parseVerifierDigest(s string) ([blake2s.Size]byte, error) {
+	var digest [blake2s.Size]byte
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(digest) {
+		return digest, fmt.Errorf("invalid -verifier-digest, expected %d bytes in hex", len(digest))
+	}
+	copy(digest[:], b)
+
+	return digest, nil
+}
+
+// extend returns the measurement of events: starting from all zeroes,
+// each event's digest is extended into it with
+// BLAKE2s(measurement, digest).
+func extend(events []bootEvent) (string, error) {
+	var m [blake2s.Size]byte
+
+	for _, e := range events {
+		digest, err := hex.DecodeString(e.Digest)
+		if err != nil || len(digest) != blake2s.Size {
+			return "", fmt.Errorf("bad digest in %s event", e.Type)
+		}
+
+		m = blake2s.Sum256(append(m[:], digest...))
+	}
+
+	return hex.EncodeToString(m[:]), nil
+}
+
+// logBoot records b in the event log, if there is one. The app has
+// started by then, so failing only makes the command fail.
+func (tk *tkey) logBoot(b measuredBoot) error {
+	if tk.eventLog == "" {
+		return nil
+	}
+
+	if !b.client {
+		b.flashVerifier = tk.verifierDigest
+	}
+
+	r := bootRecord{
+		Time:      time.Now().UTC(),
+		Command:   tk.out.res.Command,
+		Port:      tk.out.res.Port,
+		USBSerial: tk.out.res.USBSerial,
+		Events:    b.events(),
+	}
+	r.Measurement, _ = extend(r.Events)
+
+	if err := appendEventLog(tk.eventLog, r); err != nil {
+		return fmt.Errorf("app started, but %w", err)
+	}
+
+	return nil
+}
+
+// appendEventLog adds r to the end of the event log in path, creating
+// it if needed.
+func appendEventLog(path string, r bootRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("couldn't open event log: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	// provision boots several TKeys at once.
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("couldn't lock event log: %w", err)
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("couldn't write event log: %w", err)
+	}
+
+	return f.Sync()
+}
+
+// checkBootRecord checks that the events in r are the ones of a
+// verified boot, that each digest is of its data and that they add up
+// to the measurement.
+func checkBootRecord(r bootRecord) error {
+	types := make([]string, len(r.Events))
+	for i, e := range r.Events {
+		types[i] = e.Type
+	}
+
+	if !slices.Equal(types, eventTypes) {
+		return fmt.Errorf("events %v, expected %v", types, eventTypes)
+	}
+
+	for _, e := range r.Events {
+		var data []byte
+
+		switch e.Type {
+		case "reset":
+			if _, err := bootverifier.ParseFwResetType(e.Data); err != nil {
+				return err
+			}
+			data = []byte(e.Data)
+		case "verifier":
+			switch e.Data {
+			case "client", "flash-supplied", "flash-assumed":
+			case "flash-unknown":
+				if e.Digest != hex.EncodeToString(make([]byte, blake2s.Size)) {
+					return errors.New("unknown verifier with a digest")
+				}
+			default:
+				return fmt.Errorf("invalid verifier event %q", e.Data)
+			}
+			continue
+		case "app":
+			if e.Data != "client" && e.Data != "flash" {
+				return fmt.Errorf("invalid app event %q", e.Data)
+			}
+			continue
+		case "uss":
+			if e.Data != "none" && e.Data != "supplied" {
+				return fmt.Errorf("invalid uss event %q", e.Data)
+			}
+			data = []byte(e.Data)
+		case "pubkey":
+			pubkey, err := hex.DecodeString(e.Data)
+			if err != nil || len(pubkey) != ed25519.PublicKeySize {
+				return errors.New("invalid pubkey event")
+			}
+			data = pubkey
+		default:
+			continue
+		}
+
+		if digest := blake2s.Sum256(data); e.Digest != hex.EncodeToString(digest[:]) {
+			return fmt.Errorf("%s event digest isn't of its data", e.Type)
+		}
+	}
+
+	m, err := extend(r.Events)
+	if err != nil {
+		return err
+	}
+
+	if m != r.Measurement {
+		return errors.New("events don't add up to the measurement")
+	}
+
+	return nil
+}
+
+// readEventLog reads the boot records in r, checking each one.
+func readEventLog(r io.Reader) ([]bootRecord, error) {
+	var records []bootRecord
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+
+	for line := 1; s.Scan(); line++ {
+		var rec bootRecord
+
+		dec := json.NewDecoder(bytes.NewReader(s.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rec); err != nil {
+			return records, fmt.Errorf("%w: line %d: %w", errEventLogBroken, line, err)
+		}
+
+		if err := checkBootRecord(rec); err != nil {
+			return records, fmt.Errorf("%w: line %d: %w", errEventLogBroken, line, err)
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := s.Err(); err != nil {
+		return records, fmt.Errorf("read event log: %w", err)
+	}
+
+	return records, nil
+}
+
+// verifyEventLog checks the event log in path and shows what was
+// measured for each boot.
+func verifyEventLog(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("couldn't read file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	records, err := readEventLog(f)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range records {
+		tkey := r.USBSerial
+		if tkey == "" {
+			tkey = r.Port
+		}
+
+		// Checked by readEventLog, in the order of eventTypes.
+		ev := r.Events
+		pubkey, _ := hex.DecodeString(ev[3].Data)
+
+		out.info("Boot %d, %s by %s on %s:\n", i+1, r.Time.Format(time.RFC3339), r.Command, tkey)
+		out.info("  Resets:           %s, %s\n", ev[0].Data, ev[4].Data)
+		if ev[1].Data == "flash-unknown" {
+			out.info("  Verifier:         unknown (flash-unknown)\n")
+		} else {
+			out.info("  Verifier:         %s (%s)\n", ev[1].Digest, ev[1].Data)
+		}
+		out.info("  USS:              %s\n", ev[2].Data)
+		out.info("  Pubkey:           %s (fingerprint %s)\n", ev[3].Data, fingerprint([ed25519.PublicKeySize]byte(pubkey)))
+		out.info("  Measured-ID seed: %s\n", ev[3].Digest)
+		out.info("  App:              %s (%s)\n", ev[5].Digest, ev[5].Data)
+		out.info("  Measurement:      %s\n", r.Measurement)
+	}
+
+	out.info("%d boots, all events add up\n", len(records))
+	out.phase("event-log-verify")
+
+	return nil
+}
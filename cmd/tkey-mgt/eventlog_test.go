@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tkey-mgt/cdi"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+func TestEventLog(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	path := filepath.Join(t.TempDir(), "events.log")
+	clientApp := bytes.Repeat([]byte{0x43}, 3000)
+
+	tk := newTKey(tr, &output{w: io.Discard, res: result{Command: "boot"}})
+	tk.eventLog = path
+	if err := startVerifier(tk, pubkeyOf(testKey), clientApp, signApp(testKey, clientApp)); err != nil {
+		t.Fatalf("startVerifier: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	records, err := readEventLog(f)
+	if err != nil {
+		t.Fatalf("readEventLog: %v", err)
+	}
+
+	if len(records) != 1 || records[0].Command != "boot" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	ev := records[0].Events
+	digest := blake2s.Sum256(clientApp)
+	if ev[0].Data != "client" || ev[4].Data != "client-ver" || ev[2].Data != "none" || ev[5].Digest != hex.EncodeToString(digest[:]) {
+		t.Errorf("unexpected events %+v", ev)
+	}
+
+	// The verifier digest and the measured-ID seed in the log give
+	// the CDI the app got.
+	verifierDigest, _ := hex.DecodeString(ev[1].Digest)
+	seed, _ := hex.DecodeString(ev[3].Digest)
+	verifierCDI := cdi.Compute([32]byte{}, false, [32]byte(verifierDigest), false, [32]byte{})
+	if cdi.Compute([32]byte{}, true, cdi.MeasuredID(verifierCDI, [32]byte(seed)), false, [32]byte{}) != d.CDI() {
+		t.Errorf("event log doesn't give the app's CDI")
+	}
+}
+
+func TestEventLogFlash(t *testing.T) {
+	verifierDigest := blake2s.Sum256([]byte("verifier in slot 0"))
+
+	// The verifier on flash can't be read, so its digest is only
+	// known if given.
+	for _, tc := range []struct {
+		name   string
+		digest *[blake2s.Size]byte
+		data   string
+		want   [blake2s.Size]byte
+	}{
+		{"unknown", nil, "flash-unknown", [blake2s.Size]byte{}},
+		{"supplied", &verifierDigest, "flash-supplied", verifierDigest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, tr := newSim(t, testApp)
+			path := filepath.Join(t.TempDir(), "events.log")
+			newApp := bytes.Repeat([]byte{0x42}, 3000)
+
+			tk := allowIdentityChange(newTKey(tr, &output{w: io.Discard, res: result{Command: "rotate-pubkey"}}))
+			tk.eventLog = path
+			tk.verifierDigest = tc.digest
+			if err := rotatePubkey(tk, pubkeyOf(otherTestKey), newApp, signApp(otherTestKey, newApp)); err != nil {
+				t.Fatalf("rotatePubkey: %v", err)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = f.Close() }()
+
+			records, err := readEventLog(f)
+			if err != nil || len(records) != 1 {
+				t.Fatalf("readEventLog: %v, %d records", err, len(records))
+			}
+
+			ev := records[0].Events
+			if ev[0].Data != "default" || ev[1].Data != tc.data || ev[1].Digest != hex.EncodeToString(tc.want[:]) || ev[5].Data != "flash" {
+				t.Errorf("unexpected events %+v", ev)
+			}
+		})
+	}
+}
+
+func TestEventLogBroken(t *testing.T) {
+	r := bootRecord{Command: "boot", Events: measuredBoot{
+		client:   true,
+		verifier: bytes.Repeat([]byte("verifier"), 300),
+		pubkey:   pubkeyOf(testKey),
+		app:      blake2s.Sum256(testApp),
+	}.events()}
+	r.Measurement, _ = extend(r.Events)
+
+	tests := []struct {
+		name   string
+		change func(r *bootRecord)
+	}{
+		{"unchanged", func(r *bootRecord) {}},
+		{"app changed", func(r *bootRecord) { r.Events[5].Digest = r.Events[1].Digest }},
+		{"pubkey changed", func(r *bootRecord) { r.Events[3].Data = hex.EncodeToString(make([]byte, 32)) }},
+		{"seed changed", func(r *bootRecord) { r.Events[3].Digest = r.Events[1].Digest }},
+		{"uss changed", func(r *bootRecord) { r.Events[2].Data = "supplied" }},
+		{"reset changed", func(r *bootRecord) { r.Events[4].Data = "flash1" }},
+		{"verifier said measured", func(r *bootRecord) { r.Events[1].Data = "flash" }},
+		{"unknown verifier with a digest", func(r *bootRecord) { r.Events[1].Data = "flash-unknown" }},
+		{"event removed", func(r *bootRecord) { r.Events = r.Events[1:] }},
+		{"events reordered", func(r *bootRecord) { r.Events[1], r.Events[5] = r.Events[5], r.Events[1] }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := r
+			changed.Events = append([]bootEvent{}, r.Events...)
+			tt.change(&changed)
+
+			line, _ := json.Marshal(changed)
+			_, err := readEventLog(bytes.NewReader(append(line, '\n')))
+
+			if tt.name == "unchanged" {
+				if err != nil {
+					t.Errorf("readEventLog: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, errEventLogBroken) || exitCode(err) != exitEventLogBroken {
+				t.Errorf("expected broken event log, got %v", err)
+			}
+		})
+	}
+}
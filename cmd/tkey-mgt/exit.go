@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+
+	"tkey-mgt/bootverifier"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// Exit codes, one for each class of failure. They are documented in
+// the README and scripts depend on them, so don't renumber.
+const (
+	exitOK               = 0
+	exitFailure          = 1  // Anything not below
+	exitUsage            = 2  // Bad command line or unreadable input files
+	exitNoDevice         = 3  // No TKey found, also after a reset
+	exitConnection       = 4  // Port closed or no answer in time
+	exitProtocol         = 5  // Unexpected answer from the TKey
+	exitStatus           = 6  // Verifier answered with a failure status
+	exitBadSignature     = 7  // App signature doesn't verify against the pubkey
+	exitPartialInstall   = 8  // Install failed after slot 1 was erased
+	exitPubkeyMismatch   = 9  // Stored pubkey reads back different
+	exitAlreadyInstalled = 10 // Pubkey already installed, nothing done
+	exitNotMatching      = 11 // What is on the TKey isn't what was given
+	exitHalted           = 12 // TKey still there but silent, replug it
+	exitManyDevices      = 13 // More than one TKey, select one with -device
+	exitAuditBroken      = 14 // Audit log chain broken, it was tampered with
+	exitPinMismatch      = 15 // TKey reports another pubkey than pinned
+	exitPolicy           = 16 // Not allowed by the policy
+	exitIdentityChange   = 17 // App identity would change, see -allow-identity-change
+	exitEventLogBroken   = 18 // Event log doesn't add up, see event-log-verify
+	exitNoTouch          = 19 // User didn't touch the TKey in time, nothing changed
+	exitFlashFailed      = 20 // Verifier couldn't write or erase flash, replug it
+)
+
+// exitCode returns the exit code for the class of err.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+
+	// Before the protocol errors, which these might wrap.
+	case errors.Is(err, errPartialInstall):
+		return exitPartialInstall
+	case errors.Is(err, errBadSignature):
+		return exitBadSignature
+	case errors.Is(err, errPubkeyMismatch):
+		return exitPubkeyMismatch
+	case errors.Is(err, errAlreadyInstalled):
+		return exitAlreadyInstalled
+	case errors.Is(err, errNotMatching):
+		return exitNotMatching
+	case errors.Is(err, errHalted):
+		return exitHalted
+	case errors.Is(err, errAuditBroken):
+		return exitAuditBroken
+	case errors.Is(err, errPinMismatch):
+		return exitPinMismatch
+	case errors.Is(err, errEventLogBroken):
+		return exitEventLogBroken
+	case errors.Is(err, errPolicy):
+		return exitPolicy
+	case errors.Is(err, errIdentityChange):
+		return exitIdentityChange
+
+	case errors.Is(err, bootverifier.ErrManyDevices):
+		return exitManyDevices
+	case errors.Is(err, bootverifier.ErrNoDevice):
+		return exitNoDevice
+	case errors.Is(err, bootverifier.ErrPortClosed), errors.Is(err, bootverifier.ErrTimeout):
+		return exitConnection
+	case errors.Is(err, bootverifier.ErrProtocol), errors.Is(err, tkeyclient.ErrResponseStatusNotOK):
+		return exitProtocol
+	case errors.Is(err, bootverifier.ErrNoTouch):
+		return exitNoTouch
+	case errors.Is(err, bootverifier.ErrFlashFailed):
+		return exitFlashFailed
+	case errors.Is(err, bootverifier.ErrStatus):
+		return exitStatus
+	}
+
+	return exitFailure
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"tkey-mgt/cdi"
+)
+
+// errIdentityChange is returned when an operation would change the
+// identity of the verified app without -allow-identity-change.
+var errIdentityChange = errors.New("app identity would change")
+
+// checkIdentity tells the user whether an app verified with next,
+// instead of current, keeps its identity. The measured-ID seed of the
+// pubkey is measured together with the verifier's own CDI into the
+// app's CDI, see doc/design.md, so it decides every key the app
+// derives. If it changes checkIdentity returns errIdentityChange,
+// unless allowed.
+func (tk *tkey) checkIdentity(current, next [ed25519.PublicKeySize]byte) error {
+	seed := cdi.MeasuredIDSeed(current)
+	nextSeed := cdi.MeasuredIDSeed(next)
+	preserved := seed == nextSeed
+
+	tk.out.res.MeasuredIDSeed = hex.EncodeToString(seed[:])
+	tk.out.res.NewMeasuredIDSeed = hex.EncodeToString(nextSeed[:])
+	tk.out.res.IdentityPreserved = &preserved
+
+	if preserved {
+		tk.out.info("Measured-ID seed: %x\n", seed)
+		tk.out.info("App identity preserved, the app keeps deriving the same keys\n")
+
+		return nil
+	}
+
+	tk.out.info("Measured-ID seed now:   %x\n", seed)
+	tk.out.info("Measured-ID seed after: %x\n", nextSeed)
+	tk.out.info("App identity CHANGES, every key the app derives will be different\n")
+
+	if !tk.allowIdentityChange {
+		return fmt.Errorf("%w, give -allow-identity-change to go ahead", errIdentityChange)
+	}
+
+	return nil
+}
+
+// checkUSSIdentity tells the user that an app booted with a USS gets
+// another identity than when started from flash, since the USS goes
+// into the verifier's CDI and so into the app's. It returns
+// errIdentityChange, unless allowed.
+func (tk *tkey) checkUSSIdentity() error {
+	preserved := false
+	tk.out.res.IdentityPreserved = &preserved
+
+	tk.out.info("App identity CHANGES with a USS, every key the app derives will be different than when started from flash\n")
+
+	if !tk.allowIdentityChange {
+		return fmt.Errorf("%w, give -allow-identity-change to go ahead", errIdentityChange)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"tkey-mgt/cdi"
+	"tkey-mgt/sim"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+func TestIdentityInstall(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	newApp := bytes.Repeat([]byte{0x42}, 3000)
+
+	o := &output{w: io.Discard}
+	if err := updateApp1(newTKey(tr, o), newApp, signApp(testKey, newApp)); err != nil {
+		t.Fatalf("updateApp1: %v", err)
+	}
+
+	if o.res.IdentityPreserved == nil || !*o.res.IdentityPreserved {
+		t.Errorf("expected identity preserved")
+	}
+
+	// The seed is the one the verifier starts the app with.
+	resets := d.Resets()
+	seed := resets[len(resets)-1].MeasuredIDSeed
+	if o.res.MeasuredIDSeed != hex.EncodeToString(seed[:]) {
+		t.Errorf("measured-ID seed %s, the verifier used %x", o.res.MeasuredIDSeed, seed)
+	}
+}
+
+func TestIdentityInstallPubkey(t *testing.T) {
+	d, tr := newSim(t, testApp)
+
+	o := &output{w: io.Discard}
+	err := installPubkey(newTKey(tr, o), pubkeyOf(otherTestKey))
+	if !errors.Is(err, errIdentityChange) || exitCode(err) != exitIdentityChange {
+		t.Fatalf("expected identity change refused, got %v", err)
+	}
+
+	if d.Pubkey() != pubkeyOf(testKey) || slices.Contains(o.res.Phases, "store-pubkey") {
+		t.Errorf("pubkey stored despite identity change")
+	}
+
+	// Refused, the TKey is left running its app, not the verifier
+	// in command mode.
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(testApp) {
+		t.Errorf("expected the app in slot 1 started again, got %v (%s)", d.Mode(), d.HaltReason())
+	}
+
+	newSeed := cdi.MeasuredIDSeed(pubkeyOf(otherTestKey))
+	if o.res.IdentityPreserved == nil || *o.res.IdentityPreserved || o.res.NewMeasuredIDSeed != hex.EncodeToString(newSeed[:]) {
+		t.Errorf("unexpected identity in result %+v", o.res)
+	}
+}
+
+func TestIdentityBoot(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	clientApp := bytes.Repeat([]byte{0x43}, 3000)
+
+	// Another pubkey than the one on flash gives the app another
+	// identity than when started from flash.
+	err := startVerifier(newTKey(tr, &output{w: io.Discard}), pubkeyOf(otherTestKey), clientApp, signApp(otherTestKey, clientApp))
+	if !errors.Is(err, errIdentityChange) {
+		t.Fatalf("expected identity change refused, got %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(testApp) {
+		t.Errorf("expected the app in slot 1 started again, got %v (%s)", d.Mode(), d.HaltReason())
+	}
+
+	o := &output{w: io.Discard}
+	if err := startVerifier(newTKey(sim.NewTransport(d), o), pubkeyOf(testKey), clientApp, signApp(testKey, clientApp)); err != nil {
+		t.Fatalf("startVerifier: %v", err)
+	}
+
+	if o.res.IdentityPreserved == nil || !*o.res.IdentityPreserved {
+		t.Errorf("expected identity preserved")
+	}
+}
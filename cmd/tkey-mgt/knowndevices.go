@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"tkey-mgt/bootverifier"
+)
+
+// errPinMismatch is returned when a TKey reports another vendor
+// public key than the one pinned for it in known_devices.
+var errPinMismatch = errors.New("pubkey differs from the one pinned in known_devices")
+
+// errNoDeviceID is returned when pinning a TKey that can't be told
+// apart from other TKeys, see deviceID.
+var errNoDeviceID = errors.New("the TKey's USB serial number isn't its own, so it can't be pinned in known_devices")
+
+// pinHint tells what to do about errPinMismatch.
+const pinHint = "If the TKey got a new pubkey on purpose, remove its line from known_devices to pin the new one."
+
+// knownDevices pins the vendor public key of each TKey seen, like
+// SSH's known_hosts. The file has one line for each TKey: its
+// identity, see deviceID, and the pubkey last seen on it in hex.
+// Empty lines and lines starting with # are ignored.
+type knownDevices struct {
+	path string
+
+	// warnOnly makes a mismatch a warning instead of refusing.
+	warnOnly bool
+
+	// mu serializes the TKeys provisioned in parallel, the file
+	// lock other tkey-mgt processes.
+	mu sync.Mutex
+}
+
+// deviceID returns the identity of the TKey on s in known_devices:
+// its USB serial number or, if it has none, as in QEMU, its serial
+// port. It returns "" if the USB serial number isn't the TKey's own,
+// see bootverifier.Serial.OwnUSBSerial. The UDI would be, but firmware
+// only tells it while waiting for an app.
+func deviceID(s *bootverifier.Serial) string {
+	switch {
+	case s.USBSerial() == "":
+		return s.Port()
+	case !s.OwnUSBSerial():
+		return ""
+	}
+
+	return s.USBSerial()
+}
+
+// readPins reads the pins in r.
+func readPins(r io.Reader) (map[string][ed25519.PublicKeySize]byte, error) {
+	pins := map[string][ed25519.PublicKeySize]byte{}
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("known_devices line %d: expected device and pubkey", line)
+		}
+
+		b, err := hex.DecodeString(fields[1])
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("known_devices line %d: bad pubkey", line)
+		}
+
+		pins[fields[0]] = [ed25519.PublicKeySize]byte(b)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read known_devices: %w", err)
+	}
+
+	return pins, nil
+}
+
+// update reads the pins, lets fn change them and writes them back if
+// it returns true, all with the file locked.
+func (k *knownDevices) update(fn func(pins map[string][ed25519.PublicKeySize]byte) bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	f, err := os.OpenFile(k.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("couldn't open known_devices: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("couldn't lock known_devices: %w", err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("read known_devices: %w", err)
+	}
+
+	pins, err := readPins(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if !fn(pins) {
+		return nil
+	}
+
+	// Rewrite the file keeping its lines, comments too, in order,
+	// changing the pins that changed and adding new ones last.
+	var buf bytes.Buffer
+	done := map[string]bool{}
+
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && !strings.HasPrefix(fields[0], "#") {
+			if pubkey, ok := pins[fields[0]]; ok && !done[fields[0]] {
+				fmt.Fprintf(&buf, "%s %x\n", fields[0], pubkey)
+				done[fields[0]] = true
+			}
+
+			continue
+		}
+
+		buf.WriteString(line)
+	}
+
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+
+	for id, pubkey := range pins {
+		if !done[id] {
+			fmt.Fprintf(&buf, "%s %x\n", id, pubkey)
+		}
+	}
+
+	if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+		return fmt.Errorf("couldn't write known_devices: %w", err)
+	}
+
+	if err := f.Truncate(int64(buf.Len())); err != nil {
+		return fmt.Errorf("couldn't write known_devices: %w", err)
+	}
+
+	return f.Sync()
+}
+
+// check checks pubkey, read from the TKey id, against the one pinned
+// for it. The first time id is seen it pins pubkey and returns true.
+// It returns errPinMismatch if they differ, keeping the old pin.
+func (k *knownDevices) check(id string, pubkey [ed25519.PublicKeySize]byte) (bool, error) {
+	var first, mismatch bool
+	var pinned [ed25519.PublicKeySize]byte
+
+	err := k.update(func(pins map[string][ed25519.PublicKeySize]byte) bool {
+		var ok bool
+		if pinned, ok = pins[id]; !ok {
+			pins[id] = pubkey
+			first = true
+
+			return true
+		}
+
+		mismatch = pinned != pubkey
+
+		return false
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if mismatch {
+		return false, fmt.Errorf("%w: TKey %s has %s, pinned %s", errPinMismatch, id, fingerprint(pubkey), fingerprint(pinned))
+	}
+
+	return first, nil
+}
+
+// pin pins pubkey for the TKey id, replacing any pin it had.
+func (k *knownDevices) pin(id string, pubkey [ed25519.PublicKeySize]byte) error {
+	return k.update(func(pins map[string][ed25519.PublicKeySize]byte) bool {
+		if pins[id] == pubkey {
+			return false
+		}
+		pins[id] = pubkey
+
+		return true
+	})
+}
+
+// checkPin checks pubkey, read from tk, against known_devices, if
+// in use. On a mismatch it only warns if asked to.
+func (tk *tkey) checkPin(pubkey [ed25519.PublicKeySize]byte) error {
+	if tk.pins == nil {
+		return nil
+	}
+
+	if tk.id == "" {
+		return errNoDeviceID
+	}
+
+	first, err := tk.pins.check(tk.id, pubkey)
+	switch {
+	case errors.Is(err, errPinMismatch) && tk.pins.warnOnly:
+		tk.out.info("Warning: %v\n", err)
+		return nil
+	case err != nil:
+		return err
+	case first:
+		tk.out.info("Pinned pubkey %s for TKey %s\n", fingerprint(pubkey), tk.id)
+	}
+
+	return nil
+}
+
+// updatePin pins pubkey for tk, if known_devices is in use.
+func (tk *tkey) updatePin(pubkey [ed25519.PublicKeySize]byte) error {
+	if tk.pins == nil {
+		return nil
+	}
+
+	if tk.id == "" {
+		return errNoDeviceID
+	}
+
+	return tk.pins.pin(tk.id, pubkey)
+}
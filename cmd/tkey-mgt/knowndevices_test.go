@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"tkey-mgt/sim"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// newPinnedTKey returns tk using known_devices in path, as TKey "sim".
+func newPinnedTKey(tr *sim.Transport, path string, warnOnly bool) *tkey {
+	tk := newTKey(tr, &output{w: io.Discard})
+	tk.pins = &knownDevices{path: path, warnOnly: warnOnly}
+	tk.id = "sim"
+
+	return tk
+}
+
+// pinnedFor returns the pubkey pinned for id in path.
+func pinnedFor(t *testing.T, path string, id string) [ed25519.PublicKeySize]byte {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	pins, err := readPins(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pins[id]
+}
+
+func TestKnownDevicesInstall(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	path := filepath.Join(t.TempDir(), "known_devices")
+
+	// First use pins the pubkey.
+	if err := updateApp1(newPinnedTKey(tr, path, false), testApp, signApp(testKey, testApp)); err != nil {
+		t.Fatalf("updateApp1: %v", err)
+	}
+
+	if pinnedFor(t, path, "sim") != pubkeyOf(testKey) {
+		t.Fatalf("pubkey not pinned")
+	}
+
+	// A new tkey-mgt run connects once the TKey has settled.
+	tr = sim.NewTransport(d)
+
+	// install-pubkey moves the pin once read back.
+	if err := installPubkey(allowIdentityChange(newPinnedTKey(tr, path, false)), pubkeyOf(otherTestKey)); err != nil {
+		t.Fatalf("installPubkey: %v", err)
+	}
+
+	if pinnedFor(t, path, "sim") != pubkeyOf(otherTestKey) {
+		t.Fatalf("pin not updated")
+	}
+
+	if err := tr.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updateApp1(newPinnedTKey(tr, path, false), testApp, signApp(otherTestKey, testApp)); err != nil {
+		t.Fatalf("updateApp1 with new pubkey: %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp {
+		t.Errorf("expected app running, got %v", d.Mode())
+	}
+}
+
+func TestKnownDevicesMismatch(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	path := filepath.Join(t.TempDir(), "known_devices")
+	newApp := bytes.Repeat([]byte{0x42}, 3000)
+
+	pinned := fmt.Sprintf("# pins\nsim %x\n", pubkeyOf(otherTestKey))
+	if err := os.WriteFile(path, []byte(pinned), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := newPinnedTKey(tr, path, false)
+	err := updateApp1(tk, newApp, signApp(testKey, newApp))
+	if !errors.Is(err, errPinMismatch) {
+		t.Fatalf("expected pin mismatch, got %v", err)
+	}
+
+	if slices.Contains(tk.out.res.Phases, "update-init") || d.AppDigest() == blake2s.Sum256(newApp) {
+		t.Errorf("app installed despite mismatch")
+	}
+
+	err = startVerifier(newPinnedTKey(tr, path, false), pubkeyOf(testKey), newApp, signApp(testKey, newApp))
+	if !errors.Is(err, errPinMismatch) {
+		t.Fatalf("boot: expected pin mismatch, got %v", err)
+	}
+
+	if d.Mode() == sim.ModeApp {
+		t.Errorf("boot: app started despite mismatch")
+	}
+
+	// Only warning installs, keeping the pin.
+	if err := updateApp1(newPinnedTKey(tr, path, true), newApp, signApp(testKey, newApp)); err != nil {
+		t.Fatalf("updateApp1 warning only: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != pinned {
+		t.Errorf("known_devices changed to %q", data)
+	}
+}
+
+func TestKnownDevicesPin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_devices")
+	k := &knownDevices{path: path}
+
+	orig := fmt.Sprintf("# TKeys\n\na %x\n# b was here\nb %x\n", pubkeyOf(testKey), pubkeyOf(testKey))
+	if err := os.WriteFile(path, []byte(orig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.pin("a", pubkeyOf(otherTestKey)); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+
+	if first, err := k.check("c", pubkeyOf(otherTestKey)); err != nil || !first {
+		t.Fatalf("check new: %v, %v", first, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("# TKeys\n\na %x\n# b was here\nb %x\nc %x\n", pubkeyOf(otherTestKey), pubkeyOf(testKey), pubkeyOf(otherTestKey))
+	if string(data) != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, data)
+	}
+
+	if err := os.WriteFile(path, []byte("a nothex\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.check("a", pubkeyOf(testKey)); err == nil {
+		t.Errorf("expected bad known_devices")
+	}
+}
+
+func TestKnownDevicesNoID(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	path := filepath.Join(t.TempDir(), "known_devices")
+	newApp := bytes.Repeat([]byte{0x42}, 3000)
+
+	// Like an older TKey, with the USB serial number they all have.
+	tk := newPinnedTKey(tr, path, false)
+	tk.id = ""
+
+	if err := updateApp1(tk, newApp, signApp(testKey, newApp)); !errors.Is(err, errNoDeviceID) {
+		t.Fatalf("expected no device ID, got %v", err)
+	}
+
+	if d.AppDigest() == blake2s.Sum256(newApp) {
+		t.Errorf("app installed without a pin")
+	}
+
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Errorf("known_devices changed to %q", data)
+	}
+}
+
+func TestKnownDevicesInstallPubkeyBeforeTouch(t *testing.T) {
+	d, tr := newSim(t, testApp)
+
+	// Without an ID to pin the new pubkey for.
+	tk := allowIdentityChange(newPinnedTKey(tr, filepath.Join(t.TempDir(), "known_devices"), false))
+	tk.id = ""
+
+	if err := installPubkey(tk, pubkeyOf(otherTestKey)); !errors.Is(err, errNoDeviceID) {
+		t.Fatalf("expected no device ID, got %v", err)
+	}
+
+	if d.Pubkey() != pubkeyOf(testKey) {
+		t.Fatalf("pubkey stored without a pin")
+	}
+
+	// A known_devices that can't be written.
+	tr = sim.NewTransport(d)
+	tk = allowIdentityChange(newPinnedTKey(tr, filepath.Join(t.TempDir(), "missing", "known_devices"), false))
+
+	if err := installPubkey(tk, pubkeyOf(otherTestKey)); err == nil {
+		t.Fatalf("installPubkey succeeded without known_devices")
+	}
+
+	if d.Pubkey() != pubkeyOf(testKey) || slices.Contains(tk.out.res.Phases, "store-pubkey") {
+		t.Errorf("pubkey stored without a pin")
+	}
+}
@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// output tells the user what a command is doing, either as text or,
+// for scripts, as JSON lines: progress events while running and one
+// result object at the end.
+type output struct {
+	w    io.Writer
+	json bool
+	res  result
+
+	// hint tells the user what to do about an error.
+	hint string
+
+	// device names the TKey in events when provisioning several.
+	device string
+
+	// touchMu, if set, is held from asking the user to touch the
+	// TKey until the next phase, which is done when the touch is
+	// over, or until endTouch. It keeps several TKeys from asking
+	// for touch at the same time.
+	touchMu  *sync.Mutex
+	touching bool
+}
+
+// out is where the commands report to.
+var out = &output{w: os.Stdout}
+
+// result is what a command did, written at the end in JSON mode.
+type result struct {
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	// Port is the serial port of the TKey.
+	Port string `json:"port,omitempty"`
+	// USBSerial is the USB serial number of the TKey.
+	USBSerial string `json:"usb_serial,omitempty"`
+	// UDI is the Unique Device Identifier of the TKey, if firmware
+	// was asked for it.
+	UDI string `json:"udi,omitempty"`
+	// Pubkey is the vendor public key installed on the TKey, or
+	// used for booting, in hex.
+	Pubkey string `json:"pubkey,omitempty"`
+	// PreviousPubkey is the vendor public key install-pubkey,
+	// rotate-pubkey or provision found before storing the new
+	// one, in hex.
+	PreviousPubkey string `json:"previous_pubkey,omitempty"`
+	// MeasuredIDSeed and NewMeasuredIDSeed are the seeds for the
+	// verified app's identity with the pubkey before and after, in
+	// hex, and IdentityPreserved whether they are the same.
+	MeasuredIDSeed    string `json:"measured_id_seed,omitempty"`
+	NewMeasuredIDSeed string `json:"new_measured_id_seed,omitempty"`
+	IdentityPreserved *bool  `json:"identity_preserved,omitempty"`
+	// VerifierCDI, MeasuredID and CDI are the CDI of the verifier,
+	// the measured_id it leads to and the CDI of the verified app,
+	// as predicted by predict-cdi, in hex.
+	VerifierCDI string `json:"verifier_cdi,omitempty"`
+	MeasuredID  string `json:"measured_id,omitempty"`
+	CDI         string `json:"cdi,omitempty"`
+	// Running is what runs on the TKey after reset, reboot-app or
+	// enter-cmd-mode: firmware, verifier or app.
+	Running string `json:"running,omitempty"`
+	// Fingerprint is the fingerprint of Pubkey.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// PubkeyMatches tells if Pubkey is the same as the one given
+	// with -pub.
+	PubkeyMatches *bool `json:"pubkey_matches,omitempty"`
+	// AppDigest is the BLAKE2s digest of the app in hex.
+	AppDigest string `json:"app_digest,omitempty"`
+	// AppBoots tells if the app in slot 1 is signed with the
+	// pubkey install-pubkey installs, so that it still starts.
+	AppBoots *bool `json:"app_boots,omitempty"`
+	// AppSignature is the signature of the app installed in slot
+	// 1, in hex.
+	AppSignature string `json:"app_signature,omitempty"`
+	// AppMatches tells if the app installed in slot 1 is the same
+	// as the one given with -app and -sig.
+	AppMatches *bool `json:"app_matches,omitempty"`
+	// KeyNum is the key number in the signature file, in hex.
+	KeyNum string `json:"key_num,omitempty"`
+	// Devices are the TKeys found by list.
+	Devices []listedDevice `json:"devices,omitempty"`
+	// Provisioned are the results for each TKey provisioned.
+	Provisioned []result `json:"provisioned,omitempty"`
+	// Phases are the phases completed, in order.
+	Phases []string     `json:"phases"`
+	Error  *resultError `json:"error,omitempty"`
+}
+
+// listedDevice is a TKey found by list. UDI and Firmware are only
+// set for a TKey running firmware.
+type listedDevice struct {
+	Port      string `json:"port"`
+	USBSerial string `json:"usb_serial"`
+	UDI       string `json:"udi,omitempty"`
+	Firmware  string `json:"firmware,omitempty"`
+}
+
+type resultError struct {
+	Message  string `json:"message"`
+	Class    string `json:"class"`
+	ExitCode int    `json:"exit_code"`
+	Hint     string `json:"hint,omitempty"`
+}
+
+// event is a progress event in JSON mode.
+type event struct {
+	Event   string `json:"event"`
+	Device  string `json:"device,omitempty"`
+	Phase   string `json:"phase,omitempty"`
+	Message string `json:"message,omitempty"`
+	Done    int    `json:"done,omitempty"`
+	Total   int    `json:"total,omitempty"`
+}
+
+// exitClasses names the exit codes in JSON results.
+var exitClasses = map[int]string{
+	exitFailure:          "failure",
+	exitUsage:            "usage",
+	exitNoDevice:         "no-device",
+	exitConnection:       "connection",
+	exitProtocol:         "protocol",
+	exitStatus:           "status",
+	exitBadSignature:     "bad-signature",
+	exitPartialInstall:   "partial-install",
+	exitPubkeyMismatch:   "pubkey-mismatch",
+	exitAlreadyInstalled: "already-installed",
+	exitNotMatching:      "not-matching",
+	exitHalted:           "halted",
+	exitManyDevices:      "many-devices",
+	exitAuditBroken:      "audit-broken",
+	exitPinMismatch:      "pin-mismatch",
+	exitPolicy:           "policy",
+	exitIdentityChange:   "identity-change",
+	exitEventLogBroken:   "event-log-broken",
+	exitNoTouch:          "no-touch",
+	exitFlashFailed:      "flash-failed",
+}
+
+func (o *output) emit(v any) {
+	if ev, ok := v.(event); ok {
+		ev.Device = o.device
+		v = ev
+	}
+
+	_ = json.NewEncoder(o.w).Encode(v)
+}
+
+// phase records that a phase of the command is done.
+func (o *output) phase(name string) {
+	o.endTouch()
+	o.res.Phases = append(o.res.Phases, name)
+
+	if o.json {
+		o.emit(event{Event: "phase", Phase: name})
+	}
+}
+
+// info tells the user something.
+func (o *output) info(format string, a ...any) {
+	if o.json {
+		o.emit(event{Event: "message", Message: strings.TrimSpace(fmt.Sprintf(format, a...))})
+		return
+	}
+
+	fmt.Fprintf(o.w, format, a...)
+}
+
+// touch asks the user to confirm by touching the TKey.
+func (o *output) touch(lines ...string) {
+	if o.touchMu != nil && !o.touching {
+		o.touchMu.Lock()
+		o.touching = true
+	}
+
+	if o.json {
+		o.emit(event{Event: "touch", Message: strings.Join(lines, " ")})
+		return
+	}
+
+	for _, line := range lines {
+		fmt.Fprintf(o.w, "%s\n", line)
+	}
+}
+
+// endTouch lets another TKey ask for touch.
+func (o *output) endTouch() {
+	if o.touching {
+		o.touching = false
+		o.touchMu.Unlock()
+	}
+}
+
+// progress tells how many bytes of total are sent.
+func (o *output) progress(done, total int) {
+	if o.json {
+		o.emit(event{Event: "progress", Done: done, Total: total})
+	}
+}
+
+// finish writes the result in JSON mode, with err if the command
+// failed. In text mode it prints err.
+func (o *output) finish(code int, err error) {
+	if !o.json {
+		if err != nil {
+			fmt.Fprintf(o.w, "%v\n", err)
+		}
+		if err != nil && o.hint != "" {
+			fmt.Fprintf(o.w, "%s\n", o.hint)
+		}
+		return
+	}
+
+	o.res.OK = err == nil
+	if err != nil {
+		o.res.Error = &resultError{
+			Message:  err.Error(),
+			Class:    exitClasses[code],
+			ExitCode: code,
+			Hint:     o.hint,
+		}
+	}
+
+	if o.res.Phases == nil {
+		o.res.Phases = []string{}
+	}
+
+	o.emit(o.res)
+}
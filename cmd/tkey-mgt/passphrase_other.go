@@ -0,0 +1,16 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// readPassphrase can't turn off echo outside Linux, so it refuses to
+// ask.
+func readPassphrase(string) ([]byte, error) {
+	return nil, errors.New("can't ask for the USS here, use -uss-file")
+}
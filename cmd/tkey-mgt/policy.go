@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"tkey-mgt/sigfile"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// errPolicy is returned when the policy doesn't allow an operation.
+var errPolicy = errors.New("not allowed by policy")
+
+// policy restricts what may be put on TKeys. A list left out of the
+// file doesn't restrict anything, an empty one allows nothing.
+type policy struct {
+	// AllowedPubkeys are the fingerprints of the vendor public keys
+	// that may be installed or booted with, see fingerprint.
+	AllowedPubkeys []string `json:"allowed_pubkeys"`
+
+	// AllowedApps and DeniedApps are BLAKE2s digests of apps in
+	// hex. An app has to be in AllowedApps and not in DeniedApps.
+	AllowedApps []string `json:"allowed_apps"`
+	DeniedApps  []string `json:"denied_apps"`
+
+	// AllowErase allows erase-areas.
+	AllowErase bool `json:"allow_erase"`
+}
+
+// defaultPolicyDir holds the policy used without -policy, in
+// policy.json. If policy.pub is there too, the policy has to be
+// signed by it, with the signature in policy.json.sig. That way a
+// policy installed on a host isn't skipped by leaving out -policy.
+var defaultPolicyDir = "/etc/tkey-mgt"
+
+// loadPolicy returns the policy operations are held to: the one in
+// path, if given, else the one in defaultPolicyDir, or nil if there
+// is none. A policy in defaultPolicyDir that can't be read or verified
+// doesn't allow anything.
+func loadPolicy(path string, keyPath string, sigPath string) (*policy, error) {
+	if path != "" {
+		return readPolicy(path, keyPath, sigPath)
+	}
+
+	path = filepath.Join(defaultPolicyDir, "policy.json")
+	if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+		if keyPath != "" {
+			return nil, fmt.Errorf("-policy-key without -policy or a policy in %s", defaultPolicyDir)
+		}
+
+		return nil, nil
+	}
+
+	if keyPath == "" {
+		defaultKey := filepath.Join(defaultPolicyDir, "policy.pub")
+		if _, err := os.Lstat(defaultKey); !errors.Is(err, fs.ErrNotExist) {
+			keyPath = defaultKey
+		}
+	}
+
+	p, err := readPolicy(path, keyPath, sigPath)
+	if err != nil && !errors.Is(err, errPolicy) {
+		return nil, fmt.Errorf("%w: %w", errPolicy, err)
+	}
+
+	return p, err
+}
+
+// readPolicy reads the policy in path. If keyPath isn't empty the
+// policy has to be signed by that key, like an app, with the
+// signature in sigPath or, if empty, path.sig.
+func readPolicy(path string, keyPath string, sigPath string) (*policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	if keyPath != "" {
+		if sigPath == "" {
+			sigPath = path + ".sig"
+		}
+
+		key, err := sigfile.ReadKey(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read file: %w", err)
+		}
+
+		sig, err := sigfile.ReadSig(sigPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read file: %w", err)
+		}
+		if sig.Alg != [2]byte{'E', 'b'} {
+			return nil, fmt.Errorf("%w: %s isn't an ed25519 signature over a BLAKE2s digest", errPolicy, sigPath)
+		}
+
+		digest := blake2s.Sum256(data)
+		if !ed25519.Verify(key.Key[:], digest[:], sig.Sig[:]) {
+			return nil, fmt.Errorf("%w: policy %s isn't signed by the policy key", errPolicy, path)
+		}
+	}
+
+	var p policy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+
+	return &p, nil
+}
+
+// checkPubkey returns errPolicy, naming the rule, unless pubkey may be
+// installed or booted with. Any pubkey may without a policy.
+func (p *policy) checkPubkey(pubkey [ed25519.PublicKeySize]byte) error {
+	if p == nil || p.AllowedPubkeys == nil {
+		return nil
+	}
+
+	fp := fingerprint(pubkey)
+	if !slices.ContainsFunc(p.AllowedPubkeys, func(s string) bool { return strings.EqualFold(s, fp) }) {
+		return fmt.Errorf("%w: pubkey %s isn't in allowed_pubkeys", errPolicy, fp)
+	}
+
+	return nil
+}
+
+// checkApp returns errPolicy, naming the rule, unless bin may be
+// installed or booted. Any app may without a policy.
+func (p *policy) checkApp(bin []byte) error {
+	if p == nil {
+		return nil
+	}
+
+	digest := blake2s.Sum256(bin)
+	d := hex.EncodeToString(digest[:])
+	listed := func(s string) bool { return strings.EqualFold(s, d) }
+
+	if slices.ContainsFunc(p.DeniedApps, listed) {
+		return fmt.Errorf("%w: app %s is in denied_apps", errPolicy, d)
+	}
+
+	if p.AllowedApps != nil && !slices.ContainsFunc(p.AllowedApps, listed) {
+		return fmt.Errorf("%w: app %s isn't in allowed_apps", errPolicy, d)
+	}
+
+	return nil
+}
+
+// checkErase returns errPolicy unless the policy allows erase-areas.
+func (p *policy) checkErase() error {
+	if p != nil && !p.AllowErase {
+		return fmt.Errorf("%w: erase-areas needs allow_erase", errPolicy)
+	}
+
+	return nil
+}
+
+// checkShell returns errPolicy if there is a policy. The shell can
+// send anything, so it can't be held to one.
+func (p *policy) checkShell() error {
+	if p != nil {
+		return fmt.Errorf("%w: the shell can't be restricted by a policy", errPolicy)
+	}
+
+	return nil
+}
@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tkey-mgt/sigfile"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+func TestPolicy(t *testing.T) {
+	otherApp := bytes.Repeat([]byte{0x42}, 3000)
+	digest := blake2s.Sum256(testApp)
+	otherDigest := blake2s.Sum256(otherApp)
+
+	tests := []struct {
+		name   string
+		policy policy
+		// pubkeyOK, appOK, otherAppOK and eraseOK say what is
+		// allowed: the pubkey of testKey, testApp, otherApp and
+		// erase-areas.
+		pubkeyOK, appOK, otherAppOK, eraseOK bool
+		// rule is in the error when testApp isn't allowed.
+		rule string
+	}{
+		{
+			name:     "empty",
+			pubkeyOK: true, appOK: true, otherAppOK: true,
+		},
+		{
+			name:     "allowed",
+			policy:   policy{AllowedPubkeys: []string{strings.ToUpper(fingerprint(pubkeyOf(testKey)))}, AllowedApps: []string{hex.EncodeToString(digest[:])}, AllowErase: true},
+			pubkeyOK: true, appOK: true, eraseOK: true,
+		},
+		{
+			name:       "not allowed",
+			policy:     policy{AllowedPubkeys: []string{fingerprint(pubkeyOf(otherTestKey))}, AllowedApps: []string{hex.EncodeToString(otherDigest[:])}},
+			otherAppOK: true,
+			rule:       "allowed_apps",
+		},
+		{
+			name:   "nothing allowed",
+			policy: policy{AllowedPubkeys: []string{}, AllowedApps: []string{}},
+			rule:   "allowed_apps",
+		},
+		{
+			name:     "denied",
+			policy:   policy{AllowedApps: []string{hex.EncodeToString(digest[:])}, DeniedApps: []string{hex.EncodeToString(digest[:])}},
+			pubkeyOK: true,
+			rule:     "denied_apps",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := func(what string, err error, ok bool) {
+				t.Helper()
+
+				if ok && err != nil {
+					t.Errorf("%s: expected allowed, got %v", what, err)
+				}
+				if !ok && !errors.Is(err, errPolicy) {
+					t.Errorf("%s: expected not allowed, got %v", what, err)
+				}
+			}
+
+			check("pubkey", tt.policy.checkPubkey(pubkeyOf(testKey)), tt.pubkeyOK)
+			check("app", tt.policy.checkApp(testApp), tt.appOK)
+			check("other app", tt.policy.checkApp(otherApp), tt.otherAppOK)
+			check("erase", tt.policy.checkErase(), tt.eraseOK)
+
+			if err := tt.policy.checkApp(testApp); err != nil && !strings.Contains(err.Error(), tt.rule) {
+				t.Errorf("expected rule %s in %v", tt.rule, err)
+			}
+		})
+	}
+
+	// Without a policy everything is allowed.
+	var none *policy
+	if none.checkPubkey(pubkeyOf(testKey)) != nil || none.checkApp(testApp) != nil || none.checkErase() != nil || none.checkShell() != nil {
+		t.Errorf("expected everything allowed without a policy")
+	}
+
+	if err := (&policy{}).checkShell(); !errors.Is(err, errPolicy) {
+		t.Errorf("expected shell not allowed with a policy, got %v", err)
+	}
+}
+
+func TestReadPolicy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.json")
+	keyPath := filepath.Join(dir, "policy.pub")
+
+	data := []byte(fmt.Sprintf(`{"allowed_pubkeys": ["%s"], "allow_erase": true}`, fingerprint(pubkeyOf(testKey))))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sigfile.WriteBase64(keyPath, sigfile.PubKey{Alg: [2]byte{'E', 'd'}, Key: pubkeyOf(otherTestKey)}, "pubkey", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsigned, without a policy key.
+	p, err := readPolicy(path, "", "")
+	if err != nil {
+		t.Fatalf("readPolicy: %v", err)
+	}
+
+	if len(p.AllowedPubkeys) != 1 || !p.AllowErase || p.AllowedApps != nil {
+		t.Errorf("unexpected policy %+v", p)
+	}
+
+	// With a policy key the signature is required.
+	if _, err := readPolicy(path, keyPath, ""); err == nil {
+		t.Errorf("expected missing signature")
+	}
+
+	writeSig := func(key string, data []byte) {
+		t.Helper()
+
+		k := testKey
+		if key == "other" {
+			k = otherTestKey
+		}
+
+		if err := sigfile.WriteBase64(path+".sig", sigfile.Signature{Alg: [2]byte{'E', 'b'}, Sig: signApp(k, data)}, "sig", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeSig("other", data)
+	if _, err := readPolicy(path, keyPath, ""); err != nil {
+		t.Errorf("readPolicy signed: %v", err)
+	}
+
+	writeSig("test", data)
+	if _, err := readPolicy(path, keyPath, ""); !errors.Is(err, errPolicy) {
+		t.Errorf("expected signature by the wrong key refused, got %v", err)
+	}
+
+	writeSig("other", append(data, ' '))
+	if _, err := readPolicy(path, keyPath, ""); !errors.Is(err, errPolicy) {
+		t.Errorf("expected changed policy refused, got %v", err)
+	}
+
+	// Only ed25519 over a BLAKE2s digest.
+	if err := sigfile.WriteBase64(path+".sig", sigfile.Signature{Alg: [2]byte{'E', 'd'}, Sig: signApp(otherTestKey, data)}, "sig", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPolicy(path, keyPath, ""); !errors.Is(err, errPolicy) {
+		t.Errorf("expected other signature algorithm refused, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"allow_shell": true}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readPolicy(path, "", ""); err == nil {
+		t.Errorf("expected unknown rule refused")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	orig := defaultPolicyDir
+	t.Cleanup(func() { defaultPolicyDir = orig })
+	defaultPolicyDir = t.TempDir()
+
+	path := filepath.Join(defaultPolicyDir, "policy.json")
+	keyPath := filepath.Join(defaultPolicyDir, "policy.pub")
+
+	// No policy anywhere.
+	if p, err := loadPolicy("", "", ""); p != nil || err != nil {
+		t.Fatalf("expected no policy, got %+v, %v", p, err)
+	}
+
+	if _, err := loadPolicy("", keyPath, ""); err == nil || errors.Is(err, errPolicy) {
+		t.Errorf("expected -policy-key without a policy refused as usage, got %v", err)
+	}
+
+	data := []byte(`{"allow_erase": false}`)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The default policy is used without -policy.
+	p, err := loadPolicy("", "", "")
+	if err != nil || p == nil {
+		t.Fatalf("expected the default policy, got %+v, %v", p, err)
+	}
+
+	if err := p.checkErase(); !errors.Is(err, errPolicy) {
+		t.Errorf("expected erase not allowed, got %v", err)
+	}
+
+	// With a key next to it, it has to be signed.
+	if err := sigfile.WriteBase64(keyPath, sigfile.PubKey{Alg: [2]byte{'E', 'd'}, Key: pubkeyOf(otherTestKey)}, "pubkey", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadPolicy("", "", ""); !errors.Is(err, errPolicy) {
+		t.Errorf("expected unsigned default policy refused, got %v", err)
+	}
+
+	if err := sigfile.WriteBase64(path+".sig", sigfile.Signature{Alg: [2]byte{'E', 'b'}, Sig: signApp(otherTestKey, data)}, "sig", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := loadPolicy("", "", ""); err != nil || p == nil {
+		t.Errorf("expected signed default policy, got %+v, %v", p, err)
+	}
+
+	// Fails closed on a default policy that can't be read.
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadPolicy("", "", ""); !errors.Is(err, errPolicy) {
+		t.Errorf("expected unreadable default policy refused, got %v", err)
+	}
+
+	// -policy overrides it.
+	other := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(other, []byte(`{"allow_erase": true}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, err := loadPolicy(other, "", ""); err != nil || p.checkErase() != nil {
+		t.Errorf("expected -policy used, got %+v, %v", p, err)
+	}
+}
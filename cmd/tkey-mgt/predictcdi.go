@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+
+	"tkey-mgt/cdi"
+)
+
+// parseUDS parses a UDS in hex, the way tkey-sim takes it.
+func parseUDS(s string) ([32]byte, error) {
+	var uds [32]byte
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(uds) {
+		return uds, fmt.Errorf("invalid UDS, expected %d bytes in hex", len(uds))
+	}
+	copy(uds[:], b)
+
+	return uds, nil
+}
+
+// predictCDI prints the CDI an app verified with pubkey gets from a
+// TKey with uds, started from flash or by boot. uss, if set, is the
+// USS boot loads the verifier with.
+func predictCDI(o *output, uds [32]byte, verifier []byte, uss *[32]byte, pubkey [ed25519.PublicKeySize]byte) {
+	c := cdi.Chain{
+		UDS:         uds,
+		Verifier:    verifier,
+		VerifierUSS: uss,
+		Pubkey:      pubkey,
+	}
+
+	verifierCDI := c.VerifierCDI()
+	seed := cdi.MeasuredIDSeed(pubkey)
+	measuredID := c.MeasuredID()
+	appCDI := c.AppCDI()
+
+	o.res.Pubkey = hex.EncodeToString(pubkey[:])
+	o.res.VerifierCDI = hex.EncodeToString(verifierCDI[:])
+	o.res.MeasuredIDSeed = hex.EncodeToString(seed[:])
+	o.res.MeasuredID = hex.EncodeToString(measuredID[:])
+	o.res.CDI = hex.EncodeToString(appCDI[:])
+
+	o.info("Verifier CDI:     %x\n", verifierCDI)
+	o.info("Measured-ID seed: %x\n", seed)
+	o.info("Measured ID:      %x\n", measuredID)
+	o.info("App CDI:          %x\n", appCDI)
+	o.phase("predict-cdi")
+}
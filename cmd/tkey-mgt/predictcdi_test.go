@@ -0,0 +1,22 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestPredictCDI(t *testing.T) {
+	d, _ := newSim(t, testApp)
+
+	o := &output{w: io.Discard}
+	predictCDI(o, [32]byte{}, verifierBinary, nil, pubkeyOf(testKey))
+
+	cdi := d.CDI()
+	if o.res.CDI != hex.EncodeToString(cdi[:]) {
+		t.Errorf("predicted CDI %s, app got %x", o.res.CDI, cdi)
+	}
+}
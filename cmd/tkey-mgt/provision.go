@@ -0,0 +1,394 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/sigfile"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// errProvisionFailed is returned when provisioning failed on any of
+// the TKeys.
+var errProvisionFailed = errors.New("provisioning failed")
+
+// manifest says how to provision TKeys. Paths are relative to the
+// manifest file.
+type manifest struct {
+	// Pubkey is the vendor public key file to install.
+	Pubkey string `json:"pubkey"`
+	// App and Sig are the app to install in slot 1 and its
+	// signature file.
+	App string `json:"app"`
+	Sig string `json:"sig"`
+	// Erase erases all app storage areas first.
+	Erase bool `json:"erase"`
+	// Devices selects the TKeys to provision, like -device. All
+	// attached TKeys if empty.
+	Devices []string `json:"devices"`
+}
+
+// provisioning is what to put on every TKey, read from a manifest.
+type provisioning struct {
+	pubkey [ed25519.PublicKeySize]byte
+	app    []byte
+	sig    [ed25519.SignatureSize]byte
+	erase  bool
+
+	// devices are the selectors from the manifest.
+	devices []string
+}
+
+// readManifest reads the manifest in path and the files it names.
+func readManifest(path string) (*provisioning, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	var m manifest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+
+	if m.Pubkey == "" || m.App == "" || m.Sig == "" {
+		return nil, fmt.Errorf("manifest %s: missing pubkey, app or sig", path)
+	}
+
+	rel := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+
+		return filepath.Join(filepath.Dir(path), p)
+	}
+
+	var prov provisioning
+
+	pub, err := sigfile.ReadKey(rel(m.Pubkey))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file: %w", err)
+	}
+	prov.pubkey = pub.Key
+
+	if prov.app, err = os.ReadFile(rel(m.App)); err != nil {
+		return nil, fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	sig, err := sigfile.ReadSig(rel(m.Sig))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file: %w", err)
+	}
+	prov.sig = sig.Sig
+
+	// Nothing is sent to any TKey before this is known to boot.
+	if err := verifyAppSignature(prov.pubkey, prov.app, prov.sig); err != nil {
+		return nil, fmt.Errorf("%s: %w", m.App, err)
+	}
+
+	prov.erase = m.Erase
+	prov.devices = m.Devices
+
+	return &prov, nil
+}
+
+// selectPorts returns the serial ports of the TKeys selected by
+// devices, or of all attached TKeys if there are none. probe lets a
+// selector be a UDI, see bootverifier.SelectDevice.
+func selectPorts(devices []string, probe bool) ([]string, error) {
+	var ports []string
+
+	if len(devices) == 0 {
+		devs, err := bootverifier.ListDevices()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range devs {
+			ports = append(ports, d.Port)
+		}
+	}
+
+	for _, sel := range devices {
+		port, err := bootverifier.SelectDevice(sel, probe)
+		if err != nil {
+			return nil, err
+		}
+
+		if slices.Contains(ports, port) {
+			return nil, fmt.Errorf("%q selects %s twice: %w", sel, port, bootverifier.ErrManyDevices)
+		}
+		ports = append(ports, port)
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("nothing to provision: %w", bootverifier.ErrNoDevice)
+	}
+
+	return ports, nil
+}
+
+// provision provisions all TKeys in prov in parallel, asking for
+// touch on one at a time, and reports how it went for each one. If
+// auditPath isn't empty it records each TKey in that audit log. probe
+// lets the manifest select TKeys by UDI. opts apply to every TKey.
+func provision(prov *provisioning, auditPath string, probe bool, opts tkeyOptions) error {
+	var (
+		wg      sync.WaitGroup
+		writeMu sync.Mutex
+		touchMu sync.Mutex
+		auditMu sync.Mutex
+	)
+
+	ports, err := selectPorts(prov.devices, probe)
+	if err != nil {
+		return err
+	}
+
+	outs := make([]*output, len(ports))
+	auditErrs := make([]error, len(ports))
+
+	for i, port := range ports {
+		prefix := port + ": "
+		if out.json {
+			prefix = ""
+		}
+
+		outs[i] = &output{
+			w:       &prefixWriter{mu: &writeMu, w: out.w, prefix: prefix},
+			json:    out.json,
+			res:     result{Command: "provision", Port: port},
+			device:  port,
+			touchMu: &touchMu,
+		}
+
+		wg.Add(1)
+		go func(o *output, i int) {
+			defer wg.Done()
+
+			err := connectAndProvision(o, prov, opts)
+			o.endTouch()
+
+			o.res.OK = err == nil
+			if err != nil {
+				code := exitCode(err)
+				o.res.Error = &resultError{
+					Message:  err.Error(),
+					Class:    exitClasses[code],
+					ExitCode: code,
+				}
+			}
+
+			// Record each TKey as soon as it is done, whatever
+			// happens with the others.
+			if auditPath != "" {
+				auditMu.Lock()
+				if err := appendAudit(auditPath, newAuditEntry("provision", &o.res, err)); err != nil {
+					auditErrs[i] = fmt.Errorf("%s: %w", o.device, err)
+				}
+				auditMu.Unlock()
+			}
+		}(outs[i], i)
+	}
+
+	wg.Wait()
+
+	failed := 0
+	out.info("\nProvisioning report:\n")
+
+	for _, o := range outs {
+		if o.res.Phases == nil {
+			o.res.Phases = []string{}
+		}
+		out.res.Provisioned = append(out.res.Provisioned, o.res)
+
+		if o.res.OK {
+			out.info("  %s: OK\n", o.device)
+			continue
+		}
+
+		failed++
+		out.info("  %s: FAILED: %s\n", o.device, o.res.Error.Message)
+	}
+
+	if err := errors.Join(auditErrs...); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w on %d of %d TKeys", errProvisionFailed, failed, len(outs))
+	}
+
+	return nil
+}
+
+// connectAndProvision provisions the TKey on serial port o.device.
+func connectAndProvision(o *output, prov *provisioning, opts tkeyOptions) error {
+	serial, err := bootverifier.Connect(o.device)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = serial.Close() }()
+	o.res.USBSerial = serial.USBSerial()
+
+	tk := newTKey(serial, o)
+	tk.tkeyOptions = opts
+	tk.portCloses = !opts.keepsPort
+	tk.id = deviceID(serial)
+
+	return provisionOne(tk, prov)
+}
+
+// provisionOne runs the whole sequence on tk: erase if asked to,
+// install the pubkey, reading it back, install the app and check that
+// it boots.
+func provisionOne(tk *tkey, prov *provisioning) error {
+	// Each step starts by resetting into the verifier's command
+	// mode, which also works from command mode, where eraseAll
+	// leaves the TKey.
+	if prov.erase {
+		if err := eraseAll(tk); err != nil {
+			return fmt.Errorf("couldn't erase areas: %w", err)
+		}
+	}
+
+	err := installPubkey(tk, prov.pubkey)
+	switch {
+	case errors.Is(err, errAlreadyInstalled):
+		tk.out.info("Pubkey already installed\n")
+	case err != nil:
+		return fmt.Errorf("couldn't set pubkey: %w", err)
+	default:
+		// installPubkey resets the TKey to start its app.
+		if err := waitForReset(tk); err != nil {
+			return err
+		}
+	}
+
+	if err := updateApp1(tk, prov.app, prov.sig); err != nil {
+		return fmt.Errorf("couldn't update app slot 1: %w", err)
+	}
+
+	if err := confirmBooted(tk, true); err != nil {
+		return err
+	}
+
+	tk.out.info("Provisioned\n")
+
+	return tk.logBoot(measuredBoot{pubkey: prov.pubkey, app: blake2s.Sum256(prov.app)})
+}
+
+// confirmBooted waits for the TKey to start slot 1 after an install,
+// or a reset starting it. viaVerifier tells whether the verifier on
+// flash starts first, to verify slot 1.
+//
+// The verifier waits for commands if slot 1 doesn't verify, and then
+// halts on a firmware probe. So instead of asking, count resets: a
+// TKey on USB drops its serial port on each, and the verifier only
+// resets a second time, to start slot 1, once slot 1 verifies. After
+// that only firmware or an app can answer the probe: apps answer it
+// with NOK, firmware answers it, and a halted TKey doesn't answer at
+// all.
+//
+// A TKey that keeps its port, like in QEMU, can't be counted. It is
+// asked for the pubkey instead, which only the verifier answers.
+func confirmBooted(tk *tkey, viaVerifier bool) error {
+	if err := waitForReset(tk); err != nil {
+		return err
+	}
+
+	if viaVerifier {
+		// If slot 1 started before the port came back, it is
+		// taken for not started, which is the safe mistake.
+		closed, err := bootverifier.WaitForReset(tk, bootverifier.VerifyTimeout)
+		switch {
+		case err != nil:
+			return fmt.Errorf("couldn't reconnect: %w", err)
+		case !closed && tk.portCloses:
+			return fmt.Errorf("no app started, %w", errNotBooted)
+		case !closed:
+			return probeBooted(tk)
+		}
+	}
+
+	_, err := bootverifier.GetNameVersion(tk)
+	switch {
+	case errors.Is(err, tkeyclient.ErrResponseStatusNotOK):
+		tk.out.phase("booted")
+		return nil
+	case err == nil:
+		return errors.New("no app started, firmware is waiting for one")
+	case errors.Is(err, bootverifier.ErrTimeout):
+		return fmt.Errorf("no app started, %w", errHalted)
+	}
+
+	return fmt.Errorf("no app started: %w", err)
+}
+
+// probeBooted tells whether slot 1 started on a TKey that keeps its
+// serial port when resetting, after the verifier has had time to
+// verify it. The verifier left waiting for commands answers
+// CMD_GET_PUBKEY. An app answers with something else or, like the
+// test app, halts on it, so a TKey that had already halted is also
+// taken for started.
+func probeBooted(tk *tkey) error {
+	_, err := bootverifier.New(tk).GetPubkey()
+	switch {
+	case err == nil:
+		return fmt.Errorf("no app started, %w", errNotBooted)
+	case errors.Is(err, bootverifier.ErrPortClosed):
+		return fmt.Errorf("no app started: %w", err)
+	case errors.Is(err, bootverifier.ErrTimeout):
+		tk.out.info("Slot 1 started, or the TKey halted. The app might have halted on the probe\n")
+	}
+
+	tk.out.phase("booted")
+
+	return nil
+}
+
+// prefixWriter writes whole lines to w, each starting with prefix,
+// leaving out empty ones. Several can share w and mu.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf = append(pw.buf, p...)
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	for {
+		line, rest, ok := bytes.Cut(pw.buf, []byte("\n"))
+		if !ok {
+			break
+		}
+		pw.buf = rest
+
+		if len(line) > 0 {
+			fmt.Fprintf(pw.w, "%s%s\n", pw.prefix, line)
+		}
+	}
+
+	return len(p), nil
+}
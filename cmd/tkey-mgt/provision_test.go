@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"tkey-mgt/sigfile"
+	"tkey-mgt/sim"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// newProvisioning returns what to provision: the public key of
+// otherTestKey and an app signed with it.
+func newProvisioning(erase bool) *provisioning {
+	app := bytes.Repeat([]byte{0x42}, 3000)
+
+	return &provisioning{
+		pubkey: pubkeyOf(otherTestKey),
+		app:    app,
+		sig:    signApp(otherTestKey, app),
+		erase:  erase,
+	}
+}
+
+func TestProvisionOne(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	prov := newProvisioning(true)
+	o := &output{w: io.Discard}
+
+	if err := provisionOne(allowIdentityChange(newTKey(tr, o)), prov); err != nil {
+		t.Fatalf("provisionOne: %v", err)
+	}
+
+	if d.Pubkey() != prov.pubkey {
+		t.Errorf("expected new pubkey, got %x", d.Pubkey())
+	}
+
+	old := pubkeyOf(testKey)
+	if o.res.PreviousPubkey != hex.EncodeToString(old[:]) {
+		t.Errorf("expected the old pubkey recorded, got %q", o.res.PreviousPubkey)
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(prov.app) {
+		t.Errorf("expected new app running, got %v", d.Mode())
+	}
+
+	if d.AreasErased() != 1 {
+		t.Errorf("expected areas erased once, got %d", d.AreasErased())
+	}
+
+	want := []string{"erase-areas", "store-pubkey", "readback", "upload", "booted"}
+	for _, phase := range want {
+		if !slices.Contains(o.res.Phases, phase) {
+			t.Errorf("phase %s missing in %v", phase, o.res.Phases)
+		}
+	}
+}
+
+func TestProvisionOneAlreadyProvisioned(t *testing.T) {
+	_, tr := newSim(t, testApp)
+	prov := newProvisioning(false)
+	o := &output{w: io.Discard}
+
+	if err := provisionOne(allowIdentityChange(newTKey(tr, o)), prov); err != nil {
+		t.Fatalf("provisionOne: %v", err)
+	}
+
+	o = &output{w: io.Discard}
+	if err := provisionOne(allowIdentityChange(newTKey(tr, o)), prov); err != nil {
+		t.Fatalf("provisionOne again: %v", err)
+	}
+
+	if slices.Contains(o.res.Phases, "store-pubkey") {
+		t.Errorf("pubkey stored again")
+	}
+}
+
+func TestProvisionOneHalted(t *testing.T) {
+	d, tr := newFaultySim(t, testApp, sim.Faults{HaltAtChunk: 2})
+	o := &output{w: io.Discard}
+
+	err := provisionOne(allowIdentityChange(newTKey(tr, o)), newProvisioning(false))
+	if !errors.Is(err, errPartialInstall) {
+		t.Errorf("expected partial install, got %v", err)
+	}
+
+	if d.Mode() != sim.ModeHalted {
+		t.Errorf("expected halt, got %v", d.Mode())
+	}
+}
+
+func TestProvisionOneNotBooted(t *testing.T) {
+	// Slot 1 doesn't verify once installed, so the verifier waits
+	// for commands instead of starting it.
+	d, tr := newFaultySim(t, testApp, sim.Faults{CorruptSig: true})
+	o := &output{w: io.Discard}
+
+	err := provisionOne(allowIdentityChange(newTKey(tr, o)), newProvisioning(false))
+	if !errors.Is(err, errNotBooted) || slices.Contains(o.res.Phases, "booted") {
+		t.Errorf("expected slot 1 not started, got %v", err)
+	}
+
+	if d.Mode() != sim.ModeVerifier || d.VerifierState() != sim.StateWaitForCommand {
+		t.Errorf("expected verifier in command mode, got %v %v (%s)", d.Mode(), d.VerifierState(), d.HaltReason())
+	}
+}
+
+func TestProvisionOneKeepsPort(t *testing.T) {
+	// In QEMU the port stays, so resets can't be counted.
+	for _, tc := range []struct {
+		name   string
+		faults sim.Faults
+		err    error
+		mode   sim.Mode
+	}{
+		{"booted", sim.Faults{}, nil, sim.ModeHalted},
+		{"not booted", sim.Faults{CorruptSig: true}, errNotBooted, sim.ModeVerifier},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, tr := newFaultySim(t, testApp, tc.faults)
+			tr.KeepPort = true
+			o := &output{w: io.Discard}
+
+			tk := allowIdentityChange(newTKey(tr, o))
+			err := provisionOne(tk, newProvisioning(false))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+
+			if tk.portCloses {
+				t.Errorf("expected port to be known not to close")
+			}
+
+			if d.Mode() != tc.mode {
+				t.Errorf("expected %v, got %v (%s)", tc.mode, d.Mode(), d.HaltReason())
+			}
+			if tc.mode == sim.ModeHalted && d.HaltReason() != "app: unexpected command 0x05" {
+				t.Errorf("expected the app to halt on the probe, got %q", d.HaltReason())
+			}
+
+			if booted := slices.Contains(o.res.Phases, "booted"); booted != (tc.err == nil) {
+				t.Errorf("unexpected phases %v", o.res.Phases)
+			}
+		})
+	}
+}
+
+func TestProvisionTouchOneAtATime(t *testing.T) {
+	orig := verifierBinary
+	t.Cleanup(func() { verifierBinary = orig })
+	verifierBinary = bytes.Repeat([]byte("verifier"), 300)
+
+	var (
+		mu       sync.Mutex
+		touching int
+		overlaps int
+	)
+
+	touch := func() bool {
+		mu.Lock()
+		touching++
+		if touching > 1 {
+			overlaps++
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		touching--
+		mu.Unlock()
+
+		return true
+	}
+
+	prov := newProvisioning(true)
+	var touchMu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+
+	for i := range errs {
+		d := sim.New(sim.Config{
+			VerifierBinary: verifierBinary,
+			Pubkey:         pubkeyOf(testKey),
+			App:            testApp,
+			AppSig:         signApp(testKey, testApp),
+			Touch:          touch,
+		})
+		o := &output{w: io.Discard, touchMu: &touchMu}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = provisionOne(allowIdentityChange(newTKey(sim.NewTransport(d), o)), prov)
+			o.endTouch()
+		}()
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("TKey %d: %v", i, err)
+		}
+	}
+
+	if overlaps != 0 {
+		t.Errorf("%d touches while another TKey waited for one", overlaps)
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	prov := newProvisioning(false)
+
+	if err := sigfile.WriteBase64(filepath.Join(dir, "pubkey"), sigfile.PubKey{Alg: [2]byte{'E', 'd'}, Key: prov.pubkey}, "pubkey", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app.bin"), prov.app, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := sigfile.WriteBase64(filepath.Join(dir, "app.bin.sig"), sigfile.Signature{Alg: [2]byte{'E', 'b'}, Sig: prov.sig}, "sig", false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "manifest.json")
+	manifest := `{"pubkey": "pubkey", "app": "app.bin", "sig": "app.bin.sig", "erase": true, "devices": ["/dev/ttyACM0"]}`
+	if err := os.WriteFile(path, []byte(manifest), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readManifest(path)
+	if err != nil {
+		t.Fatalf("readManifest: %v", err)
+	}
+
+	if got.pubkey != prov.pubkey || !bytes.Equal(got.app, prov.app) || got.sig != prov.sig ||
+		!got.erase || !slices.Equal(got.devices, []string{"/dev/ttyACM0"}) {
+		t.Errorf("unexpected provisioning %+v", got)
+	}
+
+	// An app that wouldn't boot with the pubkey is refused
+	// before talking to any TKey.
+	otherSig := signApp(testKey, prov.app)
+	if err := sigfile.WriteBase64(filepath.Join(dir, "app.bin.sig"), sigfile.Signature{Alg: [2]byte{'E', 'b'}, Sig: otherSig}, "sig", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readManifest(path); !errors.Is(err, errBadSignature) {
+		t.Errorf("expected bad signature, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"tkey-mgt/bootverifier"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// What runs on a TKey after a reset, in the result's running field.
+const (
+	runningFirmware = "firmware"
+	runningVerifier = "verifier"
+	runningApp      = "app"
+)
+
+// notBootedHint tells what to do about errNotBooted after a reset.
+const notBootedHint = "The app in slot 1 doesn't verify with the installed pubkey. The TKey waits for commands, install an app signed with it."
+
+// resetTKey resets tk, telling firmware to start rstType and the
+// verifier, if that is what starts, to go to dst. It waits for the TKey
+// to come back and reports what runs on it.
+//
+// Probing what runs has to be done with what the reset should start
+// in mind: the verifier in command mode halts on a firmware probe, and
+// apps may halt on commands they don't know.
+func resetTKey(tk *tkey, rstType bootverifier.FwResetType, dst bootverifier.ResetDst) error {
+	bv := bootverifier.New(tk)
+
+	if err := bv.Reset(rstType, dst); err != nil {
+		return err
+	}
+	tk.out.info("Reset %s %s\n", resetTypeName(rstType), resetDstName(dst))
+	tk.out.phase("reset")
+
+	switch {
+	case rstType == bootverifier.FwResetTypeStartClient || rstType == bootverifier.FwResetTypeStartClientVer:
+		if err := waitForReset(tk); err != nil {
+			return err
+		}
+
+		return probeFirmware(tk)
+
+	case dst == bootverifier.VerifierResetDstCmdMode &&
+		rstType != bootverifier.FwResetTypeStartFlash1 && rstType != bootverifier.FwResetTypeStartFlash1Ver:
+		if err := waitForReset(tk); err != nil {
+			return err
+		}
+
+		return probeVerifier(tk)
+	}
+
+	// Slot 1 starts, directly or after the verifier on flash has
+	// verified it.
+	viaVerifier := rstType != bootverifier.FwResetTypeStartFlash1 && rstType != bootverifier.FwResetTypeStartFlash1Ver
+	if err := confirmBooted(tk, viaVerifier); err != nil {
+		return err
+	}
+	tk.out.res.Running = runningApp
+	tk.out.info("Running: an app\n")
+	tk.out.phase("running")
+
+	return nil
+}
+
+// probeFirmware checks that firmware is waiting for an app to be
+// loaded.
+func probeFirmware(tk *tkey) error {
+	nv, err := bootverifier.GetNameVersion(tk)
+	switch {
+	case errors.Is(err, tkeyclient.ErrResponseStatusNotOK):
+		tk.out.res.Running = runningApp
+		tk.out.info("Running: an app\n")
+
+		return errors.New("an app runs, not firmware")
+	case errors.Is(err, bootverifier.ErrTimeout):
+		return fmt.Errorf("nothing answers after the reset, %w", errHalted)
+	case err != nil:
+		return fmt.Errorf("no firmware after the reset: %w", err)
+	}
+
+	tk.out.res.Running = runningFirmware
+	tk.out.info("Running: firmware %s%s %d, waiting for an app\n", nv.Name0, nv.Name1, nv.Version)
+	tk.out.phase("running")
+
+	return nil
+}
+
+// probeVerifier checks that the verifier waits for commands.
+func probeVerifier(tk *tkey) error {
+	pubkey, err := bootverifier.New(tk).GetPubkey()
+	switch {
+	case errors.Is(err, bootverifier.ErrTimeout):
+		return fmt.Errorf("nothing answers after the reset, %w", errHalted)
+	case err != nil:
+		return fmt.Errorf("no verifier after the reset: %w", err)
+	}
+
+	tk.out.res.Running = runningVerifier
+	tk.out.res.Fingerprint = fingerprint(pubkey)
+	tk.out.info("Running: the verifier in command mode, pubkey fingerprint %s\n", fingerprint(pubkey))
+	tk.out.phase("running")
+
+	return nil
+}
+
+// resetTypeName returns the name of t in
+// bootverifier.FwResetTypeNames.
+func resetTypeName(t bootverifier.FwResetType) string {
+	for name, typ := range bootverifier.FwResetTypeNames {
+		if typ == t {
+			return name
+		}
+	}
+
+	return t.String()
+}
+
+// resetDstName returns the name of dst in bootverifier.ResetDstNames.
+func resetDstName(dst bootverifier.ResetDst) string {
+	for name, d := range bootverifier.ResetDstNames {
+		if d == dst {
+			return name
+		}
+	}
+
+	return dst.String()
+}
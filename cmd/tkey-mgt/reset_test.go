@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/sim"
+)
+
+func TestReset(t *testing.T) {
+	d, tr := newSim(t, testApp)
+
+	tests := []struct {
+		name    string
+		rstType bootverifier.FwResetType
+		dst     bootverifier.ResetDst
+		running string
+		mode    sim.Mode
+	}{
+		{"enter-cmd-mode", bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode, runningVerifier, sim.ModeVerifier},
+		{"reboot-app", bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstApp1, runningApp, sim.ModeApp},
+		{"client", bootverifier.FwResetTypeStartClient, bootverifier.VerifierResetDstApp1, runningFirmware, sim.ModeFirmware},
+	}
+
+	// Each starts from what the one before left running.
+	for _, tt := range tests {
+		o := &output{w: io.Discard}
+		if err := resetTKey(newTKey(tr, o), tt.rstType, tt.dst); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if o.res.Running != tt.running || d.Mode() != tt.mode {
+			t.Errorf("%s: running %s, TKey in %v", tt.name, o.res.Running, d.Mode())
+		}
+	}
+
+	// Slot 1 doesn't verify after an install, so the verifier
+	// waits for commands.
+	d, tr = newFaultySim(t, testApp, sim.Faults{CorruptSig: true})
+	newApp := bytes.Repeat([]byte{0x42}, 3000)
+
+	if err := updateApp1(newTKey(tr, &output{w: io.Discard}), newApp, signApp(testKey, newApp)); err != nil {
+		t.Fatalf("updateApp1: %v", err)
+	}
+
+	tr = sim.NewTransport(d)
+	err := resetTKey(newTKey(tr, &output{w: io.Discard}), bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstApp1)
+	if !errors.Is(err, errNotBooted) {
+		t.Fatalf("expected slot 1 not started, got %v", err)
+	}
+
+	if d.Mode() != sim.ModeVerifier || d.VerifierState() != sim.StateWaitForCommand {
+		t.Errorf("expected verifier in command mode, got %v %v (%s)", d.Mode(), d.VerifierState(), d.HaltReason())
+	}
+}
@@ -0,0 +1,550 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/sigfile"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// shell sends verifier commands typed by the user, or read from a
+// script, and prints the responses.
+type shell struct {
+	tk  *tkey
+	bv  *bootverifier.Client
+	out io.Writer
+
+	// uploadLeft is the number of bytes left to send of the app
+	// being installed.
+	uploadLeft int
+}
+
+type shellCmd struct {
+	name  string
+	args  string
+	help  string
+	nargs []int
+	run   func(sh *shell, args []string) error
+}
+
+var shellCmds []shellCmd
+
+func init() {
+	shellCmds = []shellCmd{
+		{"get-pubkey", "", "Print the vendor public key installed on flash", []int{0}, (*shell).getPubkey},
+		{"get-metadata", "", "Print the digest and signature of the app in slot 1. The verifier in verifier/ halts on it", []int{0}, (*shell).getMetadata},
+		{"set-pubkey", "pubkey", "Set the vendor public key for verify", []int{1}, (*shell).setPubkey},
+		{"store-pubkey", "pubkey", "Store a vendor public key on flash. Needs touch", []int{1}, (*shell).storePubkey},
+		{"erase", "", "Erase all app storage areas. Needs touch", []int{0}, (*shell).erase},
+		{"update-init", "app sig | size digest sig", "Start installing an app in slot 1. Needs touch", []int{2, 3}, (*shell).updateInit},
+		{"chunk", "hex", "Send one chunk of the app being installed", []int{1}, (*shell).chunk},
+		{"chunks", "app", "Send all chunks of app", []int{1}, (*shell).chunks},
+		{"verify", "app|digest sig", "Verify a digest and signature and start the app loaded by the client", []int{2}, (*shell).verify},
+		{"reset", "type [dst]", "Reset the TKey, type one of " + names(bootverifier.FwResetTypeNames) + ", dst one of " + names(bootverifier.ResetDstNames), []int{1, 2}, (*shell).reset},
+		{"raw", "hex [rsplen]", "Send a whole frame and print the response, expecting rsplen (1, 4, 32 or 128) bytes", []int{1, 2}, (*shell).raw},
+		{"reconnect", "", "Close and connect again, after the TKey has reset", []int{0}, (*shell).reconnect},
+		{"help", "", "Print this", []int{0}, (*shell).help},
+	}
+}
+
+func names[T any](m map[string]T) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return strings.Join(keys, ", ")
+}
+
+// runShell reads commands from in until EOF or quit. If script is
+// true it stops at the first command failing, otherwise it prints the
+// error and goes on.
+func runShell(tk *tkey, in io.Reader, out io.Writer, script bool) error {
+	sh := &shell{
+		tk:  tk,
+		bv:  bootverifier.New(tk),
+		out: out,
+	}
+
+	s := bufio.NewScanner(in)
+
+	for line := 1; ; line++ {
+		if !script {
+			fmt.Fprintf(out, "bv> ")
+		}
+
+		if !s.Scan() {
+			break
+		}
+
+		text, _, _ := strings.Cut(s.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return nil
+		}
+
+		if script {
+			fmt.Fprintf(out, "bv> %s\n", strings.Join(fields, " "))
+		}
+
+		if err := sh.exec(fields[0], fields[1:]); err != nil {
+			if script {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+
+			fmt.Fprintf(out, "error: %v\n", err)
+		}
+	}
+
+	if !script {
+		fmt.Fprintf(out, "\n")
+	}
+
+	return s.Err()
+}
+
+func (sh *shell) exec(name string, args []string) error {
+	for _, c := range shellCmds {
+		if c.name != name {
+			continue
+		}
+
+		if !slices.Contains(c.nargs, len(args)) {
+			return fmt.Errorf("usage: %s %s", c.name, c.args)
+		}
+
+		return c.run(sh, args)
+	}
+
+	return fmt.Errorf("unknown command %s, try help", name)
+}
+
+func (sh *shell) help([]string) error {
+	for _, c := range shellCmds {
+		fmt.Fprintf(sh.out, "  %s\n        %s\n", strings.TrimSpace(c.name+" "+c.args), c.help)
+	}
+	fmt.Fprintf(sh.out, "  quit\n")
+	fmt.Fprintf(sh.out, "A pubkey, digest or sig is given in hex or as a file. Anything after # is ignored.\n")
+
+	return nil
+}
+
+// hexArg decodes s as exactly n bytes of hex.
+func hexArg(s string, n int) ([]byte, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != n {
+		return nil, false
+	}
+
+	return b, true
+}
+
+func pubkeyArg(s string) ([ed25519.PublicKeySize]byte, error) {
+	if b, ok := hexArg(s, ed25519.PublicKeySize); ok {
+		return [ed25519.PublicKeySize]byte(b), nil
+	}
+
+	pub, err := sigfile.ReadKey(s)
+	if err != nil {
+		return [ed25519.PublicKeySize]byte{}, fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	return pub.Key, nil
+}
+
+func sigArg(s string) ([ed25519.SignatureSize]byte, error) {
+	if b, ok := hexArg(s, ed25519.SignatureSize); ok {
+		return [ed25519.SignatureSize]byte(b), nil
+	}
+
+	sig, err := sigfile.ReadSig(s)
+	if err != nil {
+		return [ed25519.SignatureSize]byte{}, fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	return sig.Sig, nil
+}
+
+// digestArg returns the digest in s, or the digest and size of the
+// app in file s.
+func digestArg(s string) ([blake2s.Size]byte, int, error) {
+	if b, ok := hexArg(s, blake2s.Size); ok {
+		return [blake2s.Size]byte(b), 0, nil
+	}
+
+	bin, err := os.ReadFile(s)
+	if err != nil {
+		return [blake2s.Size]byte{}, 0, fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	return blake2s.Sum256(bin), len(bin), nil
+}
+
+func (sh *shell) getPubkey([]string) error {
+	pubkey, err := sh.bv.GetPubkey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "pubkey %x\n", pubkey)
+
+	return nil
+}
+
+func (sh *shell) getMetadata([]string) error {
+	digest, sig, err := getMetadata(sh.tk, sh.bv)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "digest %x\nsig %x\n", digest, sig)
+
+	return nil
+}
+
+func (sh *shell) setPubkey(args []string) error {
+	pubkey, err := pubkeyArg(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := sh.bv.SetPubkey(pubkey); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "OK\n")
+
+	return nil
+}
+
+func (sh *shell) storePubkey(args []string) error {
+	pubkey, err := pubkeyArg(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "Touch the TKey three times to confirm.\n")
+
+	if err := sh.bv.StorePubkey(pubkey); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "OK\n")
+
+	return nil
+}
+
+func (sh *shell) erase([]string) error {
+	fmt.Fprintf(sh.out, "Touch the TKey three times to confirm.\n")
+
+	if err := sh.bv.EraseAreas(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "OK\n")
+
+	return nil
+}
+
+func (sh *shell) updateInit(args []string) error {
+	var size int
+	var err error
+
+	if len(args) == 3 {
+		size, err = strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid size: %w", err)
+		}
+		args = args[1:]
+	}
+
+	digest, appSize, err := digestArg(args[0])
+	if err != nil {
+		return err
+	}
+	if appSize != 0 {
+		size = appSize
+	}
+
+	sig, err := sigArg(args[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "Touch the TKey three times to confirm.\n")
+
+	if err := sh.bv.UpdateAppInit(size, digest, sig); err != nil {
+		return err
+	}
+
+	sh.uploadLeft = size
+	fmt.Fprintf(sh.out, "OK, slot 1 erased, send %d bytes\n", size)
+
+	return nil
+}
+
+// writeChunk sends chunk and waits for the TKey to reset if it was
+// the last one.
+func (sh *shell) writeChunk(chunk []byte) error {
+	if err := sh.bv.WriteChunk(chunk); err != nil {
+		return err
+	}
+
+	if sh.uploadLeft == 0 {
+		// Not after update-init, the verifier won't like it.
+		return nil
+	}
+
+	sh.uploadLeft = max(sh.uploadLeft-len(chunk), 0)
+	if sh.uploadLeft > 0 {
+		return nil
+	}
+
+	fmt.Fprintf(sh.out, "OK, app installed, TKey resets\n")
+
+	return sh.waitForReset()
+}
+
+func (sh *shell) chunk(args []string) error {
+	chunk, err := hex.DecodeString(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid hex: %w", err)
+	}
+
+	if len(chunk) == 0 || len(chunk) > bootverifier.ChunkSize {
+		return fmt.Errorf("chunk must be 1 to %d bytes", bootverifier.ChunkSize)
+	}
+
+	if err := sh.writeChunk(chunk); err != nil {
+		return err
+	}
+
+	if sh.uploadLeft > 0 {
+		fmt.Fprintf(sh.out, "OK, %d bytes left\n", sh.uploadLeft)
+	}
+
+	return nil
+}
+
+func (sh *shell) chunks(args []string) error {
+	bin, err := os.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	for written := 0; written < len(bin); written += bootverifier.ChunkSize {
+		chunk := bin[written:min(written+bootverifier.ChunkSize, len(bin))]
+		last := sh.uploadLeft == len(chunk)
+
+		if err := sh.writeChunk(chunk); err != nil {
+			return fmt.Errorf("after %d bytes: %w", written, err)
+		}
+
+		if last {
+			return nil
+		}
+	}
+
+	if sh.uploadLeft > 0 {
+		fmt.Fprintf(sh.out, "OK, %d bytes left\n", sh.uploadLeft)
+	}
+
+	return nil
+}
+
+func (sh *shell) verify(args []string) error {
+	digest, _, err := digestArg(args[0])
+	if err != nil {
+		return err
+	}
+
+	sig, err := sigArg(args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := sh.bv.Verify(digest, sig); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "Sent, the TKey resets if the signature verifies\n")
+
+	sh.uploadLeft = 0
+
+	if err := waitForVerify(sh.tk); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "Connected to firmware\n")
+
+	return nil
+}
+
+func (sh *shell) reset(args []string) error {
+	rstType, err := bootverifier.ParseFwResetType(args[0])
+	if err != nil {
+		return err
+	}
+
+	dst := bootverifier.VerifierResetDstApp1
+	if len(args) == 2 {
+		dst, err = bootverifier.ParseResetDst(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := sh.bv.Reset(rstType, dst); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "Reset %v %v\n", rstType, dst)
+
+	return sh.waitForReset()
+}
+
+func (sh *shell) waitForReset() error {
+	sh.uploadLeft = 0
+
+	if err := waitForReset(sh.tk); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "Connected\n")
+
+	return nil
+}
+
+func (sh *shell) reconnect([]string) error {
+	_ = sh.tk.Close()
+
+	if err := sh.tk.Reconnect(); err != nil {
+		return fmt.Errorf("couldn't reconnect: %w", err)
+	}
+
+	fmt.Fprintf(sh.out, "Connected\n")
+
+	return nil
+}
+
+// rawRsp is a response expected to a raw frame: any code and length,
+// on the endpoint the frame was sent to.
+type rawRsp struct {
+	code     byte
+	cmdLen   tkeyclient.CmdLen
+	endpoint tkeyclient.Endpoint
+}
+
+func (r rawRsp) Code() byte                    { return r.code }
+func (r rawRsp) CmdLen() tkeyclient.CmdLen     { return r.cmdLen }
+func (r rawRsp) Endpoint() tkeyclient.Endpoint { return r.endpoint }
+func (r rawRsp) String() string                { return fmt.Sprintf("rsp 0x%02x", r.code) }
+
+func (sh *shell) raw(args []string) error {
+	tx, err := hex.DecodeString(args[0])
+	if err != nil || len(tx) < 2 {
+		return errors.New("frame must be at least 2 bytes of hex")
+	}
+
+	hdr, err := bootverifier.ParseFramingHdr(tx[0])
+	if err != nil {
+		return err
+	}
+
+	if len(tx) > 1+hdr.CmdLen.Bytelen() {
+		return fmt.Errorf("frame longer than header says, %d bytes", 1+hdr.CmdLen.Bytelen())
+	}
+
+	// Pad like tkeyclient.NewFrameBuf.
+	tx = append(tx, make([]byte, 1+hdr.CmdLen.Bytelen()-len(tx))...)
+
+	// Expect the verifier's response to the same code, if there
+	// is one.
+	expected := rawRsp{tx[1], tkeyclient.CmdLen4, hdr.Endpoint}
+	for _, rsp := range bootverifier.VerifierResponses {
+		if hdr.Endpoint == rsp.Endpoint() && rsp.Code() == tx[1] {
+			expected.cmdLen = rsp.CmdLen()
+		}
+	}
+
+	if len(args) == 2 {
+		cmdLen, ok := map[string]tkeyclient.CmdLen{
+			"1": tkeyclient.CmdLen1, "4": tkeyclient.CmdLen4,
+			"32": tkeyclient.CmdLen32, "128": tkeyclient.CmdLen128,
+		}[args[1]]
+		if !ok {
+			return fmt.Errorf("invalid rsplen %s", args[1])
+		}
+		expected.cmdLen = cmdLen
+	}
+
+	if err := sh.tk.Write(tx); err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "tx %x\n", tx)
+
+	sh.tk.SetReadTimeoutNoErr(bootverifier.ReadTimeout)
+	defer sh.tk.SetReadTimeoutNoErr(0)
+
+	rx, rxHdr, err := sh.tk.ReadFrame(expected, int(hdr.ID))
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	fmt.Fprintf(sh.out, "rx %x\n", rx)
+	fmt.Fprintf(sh.out, "   %s\n", describeFrame(rxHdr, rx))
+
+	return nil
+}
+
+// describeFrame decodes a response frame from the verifier.
+func describeFrame(hdr tkeyclient.FramingHdr, rx []byte) string {
+	desc := fmt.Sprintf("id %d, endpoint %d, %d bytes", hdr.ID, hdr.Endpoint, hdr.CmdLen.Bytelen())
+
+	for _, rsp := range bootverifier.VerifierResponses {
+		if rsp.Endpoint() == hdr.Endpoint && rsp.Code() == rx[1] && rsp.CmdLen() == hdr.CmdLen {
+			desc += ", " + rsp.String()
+		}
+	}
+
+	if len(rx) > 2 {
+		switch rx[2] {
+		case bootverifier.StatusOK:
+			desc += ", STATUS_OK"
+		case bootverifier.StatusBad:
+			desc += ", STATUS_BAD"
+		case bootverifier.StatusPresenceTimeout:
+			desc += ", STATUS_PRESENCE_TIMEOUT"
+		case bootverifier.StatusInvalidSize:
+			desc += ", STATUS_INVALID_SIZE"
+		case bootverifier.StatusFlashFailed:
+			desc += ", STATUS_FLASH_FAILED"
+		case bootverifier.StatusBadState:
+			desc += ", STATUS_BAD_STATE"
+		default:
+			desc += fmt.Sprintf(", status 0x%02x", rx[2])
+		}
+	}
+
+	return desc
+}
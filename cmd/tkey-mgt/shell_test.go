@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tkey-mgt/sim"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+func TestShellInstall(t *testing.T) {
+	d, tr := newSim(t, testApp)
+
+	newApp := bytes.Repeat([]byte{0x42}, 300)
+	appPath := filepath.Join(t.TempDir(), "app.bin")
+	if err := os.WriteFile(appPath, newApp, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sig := signApp(testKey, newApp)
+
+	script := fmt.Sprintf(`# Install an app by hand
+reset flash0 cmd-mode
+get-pubkey
+raw 3805
+update-init %s %x
+chunk %x
+chunk %x
+chunk %x
+`, appPath, sig, newApp[:127], newApp[127:254], newApp[254:])
+
+	var out bytes.Buffer
+	if err := runShell(newTKey(tr, nil), strings.NewReader(script), &out, true); err != nil {
+		t.Fatalf("runShell: %v\n%s", err, out.String())
+	}
+
+	for _, want := range []string{
+		fmt.Sprintf("pubkey %x", pubkeyOf(testKey)),
+		"id 1, endpoint 3, 128 bytes, rspGetPubkey, STATUS_OK",
+		"send 300 bytes",
+		"173 bytes left",
+		"app installed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(newApp) {
+		t.Fatalf("expected new app running, got %v (%s)", d.Mode(), d.HaltReason())
+	}
+
+	// And again with the whole app in one go, from a new shell.
+	tr = sim.NewTransport(d)
+	script = fmt.Sprintf("reset flash0 cmd-mode\nupdate-init %s %x\nchunks %s\n", appPath, sig, appPath)
+	if err := runShell(newTKey(tr, nil), strings.NewReader(script), &out, true); err != nil {
+		t.Fatalf("runShell: %v\n%s", err, out.String())
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(newApp) {
+		t.Fatalf("expected new app running, got %v (%s)", d.Mode(), d.HaltReason())
+	}
+}
+
+func TestShellScriptStops(t *testing.T) {
+	_, tr := newSim(t, testApp)
+
+	script := "reset flash0 cmd-mode\nreset bogus\nget-pubkey\n"
+
+	var out bytes.Buffer
+	err := runShell(newTKey(tr, nil), strings.NewReader(script), &out, true)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected error on line 2, got %v", err)
+	}
+
+	if strings.Contains(out.String(), "pubkey") {
+		t.Errorf("script went on after error:\n%s", out.String())
+	}
+}
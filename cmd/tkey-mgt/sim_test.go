@@ -0,0 +1,572 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/cdi"
+	"tkey-mgt/sim"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// newSim returns a simulated TKey with the verifier in slot 0, the
+// public key of testKey and app signed with testKey in slot 1. It
+// sets verifierBinary for the duration of the test.
+func newSim(t *testing.T, app []byte) (*sim.Device, *sim.Transport) {
+	t.Helper()
+
+	return newFaultySim(t, app, sim.Faults{})
+}
+
+// newFaultySim is newSim with faults injected.
+func newFaultySim(t *testing.T, app []byte, faults sim.Faults) (*sim.Device, *sim.Transport) {
+	t.Helper()
+
+	return newSimConfig(t, sim.Config{App: app, Faults: faults})
+}
+
+// newProposedSim is newSim with a verifier having CMD_GET_METADATA.
+func newProposedSim(t *testing.T, app []byte) (*sim.Device, *sim.Transport) {
+	t.Helper()
+
+	return newSimConfig(t, sim.Config{App: app, Proposed: true})
+}
+
+func newSimConfig(t *testing.T, cfg sim.Config) (*sim.Device, *sim.Transport) {
+	t.Helper()
+
+	orig := verifierBinary
+	t.Cleanup(func() { verifierBinary = orig })
+	verifierBinary = bytes.Repeat([]byte("verifier"), 300)
+
+	cfg.VerifierBinary = verifierBinary
+	cfg.Pubkey = pubkeyOf(testKey)
+	cfg.AppSig = signApp(testKey, cfg.App)
+	d := sim.New(cfg)
+
+	return d, sim.NewTransport(d)
+}
+
+func TestSimInstall(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	newApp := bytes.Repeat([]byte{0x42}, 5000)
+
+	if err := updateApp1(newTKey(tr, out), newApp, signApp(testKey, newApp)); err != nil {
+		t.Fatalf("updateApp1: %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(newApp) {
+		t.Fatalf("expected new app running, got %v", d.Mode())
+	}
+
+	// Cold boot, reset to command mode, reset after install,
+	// verified start of slot 1.
+	resets := d.Resets()
+	if len(resets) != 4 {
+		t.Fatalf("expected 4 resets, got %d", len(resets))
+	}
+
+	last := resets[3]
+	if last.Type != bootverifier.FwResetTypeStartFlash1Ver || last.AppDigest != blake2s.Sum256(newApp) ||
+		last.MeasuredIDSeed != cdi.MeasuredIDSeed(pubkeyOf(testKey)) {
+		t.Errorf("unexpected last reset %+v", last)
+	}
+}
+
+func TestSimBoot(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	clientApp := bytes.Repeat([]byte{0x43}, 3000)
+
+	if err := startVerifier(allowIdentityChange(newTKey(tr, out)), pubkeyOf(otherTestKey), clientApp, signApp(otherTestKey, clientApp)); err != nil {
+		t.Fatalf("startVerifier: %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(clientApp) {
+		t.Fatalf("expected client app running, got %v", d.Mode())
+	}
+
+	resets := d.Resets()
+	last := resets[len(resets)-1]
+	if last.Type != bootverifier.FwResetTypeStartClientVer || last.MeasuredIDSeed != cdi.MeasuredIDSeed(pubkeyOf(otherTestKey)) {
+		t.Errorf("unexpected last reset %+v", last)
+	}
+}
+
+func TestSimInstallPubkeyThenApp(t *testing.T) {
+	d, tr := newSim(t, testApp)
+
+	if err := installPubkey(allowIdentityChange(newTKey(tr, out)), pubkeyOf(otherTestKey)); err != nil {
+		t.Fatalf("installPubkey: %v", err)
+	}
+
+	if d.Pubkey() != pubkeyOf(otherTestKey) {
+		t.Fatalf("pubkey not stored")
+	}
+
+	// The app in slot 1 is signed with the old key so the verifier
+	// stays in command mode.
+	if err := tr.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Mode() != sim.ModeVerifier || d.VerifierState() != sim.StateWaitForCommand {
+		t.Fatalf("expected verifier in command mode, got %v %v", d.Mode(), d.VerifierState())
+	}
+
+	if err := updateApp1(newTKey(tr, out), testApp, signApp(otherTestKey, testApp)); err != nil {
+		t.Fatalf("updateApp1: %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(testApp) {
+		t.Fatalf("expected app running, got %v", d.Mode())
+	}
+}
+
+func TestSimInstallPubkeyWarns(t *testing.T) {
+	_, tr := newProposedSim(t, testApp)
+
+	o := &output{w: io.Discard}
+	tk := allowIdentityChange(newTKey(tr, o))
+	tk.metadata = true
+
+	if err := installPubkey(tk, pubkeyOf(otherTestKey)); err != nil {
+		t.Fatalf("installPubkey: %v", err)
+	}
+
+	if o.res.AppBoots == nil || *o.res.AppBoots {
+		t.Errorf("expected app in slot 1 not to boot with the new pubkey")
+	}
+}
+
+func TestSimRotatePubkey(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	newApp := bytes.Repeat([]byte{0x42}, 3000)
+
+	// An app not signed with the new pubkey is refused before
+	// anything is sent.
+	err := rotatePubkey(newTKey(tr, out), pubkeyOf(otherTestKey), newApp, signApp(testKey, newApp))
+	if !errors.Is(err, errBadSignature) || len(d.Resets()) != 1 {
+		t.Fatalf("expected bad signature and nothing done, got %v", err)
+	}
+
+	o := &output{w: io.Discard}
+	if err := rotatePubkey(allowIdentityChange(newTKey(tr, o)), pubkeyOf(otherTestKey), newApp, signApp(otherTestKey, newApp)); err != nil {
+		t.Fatalf("rotatePubkey: %v", err)
+	}
+
+	if d.Pubkey() != pubkeyOf(otherTestKey) {
+		t.Errorf("pubkey not stored")
+	}
+
+	old := pubkeyOf(testKey)
+	if o.res.PreviousPubkey != hex.EncodeToString(old[:]) {
+		t.Errorf("expected the old pubkey recorded, got %q", o.res.PreviousPubkey)
+	}
+
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(newApp) {
+		t.Errorf("expected new app running, got %v", d.Mode())
+	}
+
+	if !slices.Contains(o.res.Phases, "booted") {
+		t.Errorf("expected booted in %v", o.res.Phases)
+	}
+}
+
+func TestSimRotatePubkeyNotBooted(t *testing.T) {
+	d, tr := newFaultySim(t, testApp, sim.Faults{CorruptSig: true})
+	newApp := bytes.Repeat([]byte{0x42}, 3000)
+
+	var buf bytes.Buffer
+	tk := allowIdentityChange(newTKey(tr, &output{w: &buf}))
+	tk.eventLog = filepath.Join(t.TempDir(), "events.log")
+
+	err := rotatePubkey(tk, pubkeyOf(otherTestKey), newApp, signApp(otherTestKey, newApp))
+	if !errors.Is(err, errNotBooted) {
+		t.Fatalf("expected slot 1 not started, got %v", err)
+	}
+
+	if strings.Contains(buf.String(), "App started") {
+		t.Errorf("reported the app started:\n%s", buf.String())
+	}
+
+	if _, err := os.Stat(tk.eventLog); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("boot recorded in the event log")
+	}
+
+	// Still waiting for commands, not halted, so installing again
+	// needs no replugging.
+	if d.Mode() != sim.ModeVerifier || d.VerifierState() != sim.StateWaitForCommand {
+		t.Errorf("expected verifier in command mode, got %v %v (%s)", d.Mode(), d.VerifierState(), d.HaltReason())
+	}
+}
+
+func TestSimEraseAll(t *testing.T) {
+	d, tr := newSim(t, testApp)
+
+	if err := eraseAll(newTKey(tr, out)); err != nil {
+		t.Fatalf("eraseAll: %v", err)
+	}
+
+	if d.AreasErased() != 1 {
+		t.Errorf("areas not erased")
+	}
+}
+
+// Frames from the client during an install are: reset, get pubkey,
+// update init and then the chunks. Frames from the TKey start with
+// the get pubkey response.
+func TestSimInstallPartial(t *testing.T) {
+	newApp := bytes.Repeat([]byte{0x42}, 5000)
+
+	for _, tc := range []struct {
+		name   string
+		faults sim.Faults
+		halted bool
+	}{
+		{"bad chunk", sim.Faults{BadChunk: 3}, true},
+		{"halt mid upload", sim.Faults{HaltAtChunk: 3}, true},
+		{"dropped chunk", sim.Faults{DropRx: 5}, false},
+		{"dropped chunk response", sim.Faults{DropTx: 4}, false},
+		{"corrupted chunk response", sim.Faults{CorruptTx: 4}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, tr := newFaultySim(t, testApp, tc.faults)
+
+			err := updateApp1(newTKey(tr, out), newApp, signApp(testKey, newApp))
+			if !errors.Is(err, errPartialInstall) {
+				t.Fatalf("expected partial install, got %v", err)
+			}
+
+			if halted := d.Mode() == sim.ModeHalted; halted != tc.halted {
+				t.Errorf("expected halted %v, got %v (%s)", tc.halted, d.Mode(), d.HaltReason())
+			}
+		})
+	}
+}
+
+func TestSimInstallFailsBeforeErase(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		faults sim.Faults
+	}{
+		{"no touch", sim.Faults{NoTouch: true}},
+		{"port gone", sim.Faults{PortGoneAfterReset: 2}},
+		{"dropped pubkey response", sim.Faults{DropTx: 1}},
+		{"corrupted pubkey response", sim.Faults{CorruptTx: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, tr := newFaultySim(t, testApp, tc.faults)
+			newApp := bytes.Repeat([]byte{0x42}, 5000)
+
+			err := updateApp1(newTKey(tr, out), newApp, signApp(testKey, newApp))
+			if err == nil || errors.Is(err, errPartialInstall) {
+				t.Fatalf("expected failure before erase, got %v", err)
+			}
+
+			if app, _, _ := d.Slot1(); !bytes.Equal(app, testApp) {
+				t.Errorf("slot 1 changed")
+			}
+		})
+	}
+}
+
+func TestSimTraceReplay(t *testing.T) {
+	_, tr := newSim(t, testApp)
+	newApp := bytes.Repeat([]byte{0x42}, 500)
+
+	var trace bytes.Buffer
+	cmds := slices.Concat(bootverifier.VerifierCommands, bootverifier.FwCommands)
+
+	if err := updateApp1(newTKey(bootverifier.NewTrace(tr, &trace, cmds...), out), newApp, signApp(testKey, newApp)); err != nil {
+		t.Fatalf("updateApp1: %v", err)
+	}
+
+	if !bytes.Contains(trace.Bytes(), []byte(`"cmd":"cmdUpdateAppChunk"`)) ||
+		!bytes.Contains(trace.Bytes(), []byte(`"event":"reconnect"`)) {
+		t.Errorf("trace is missing commands or reconnects:\n%s", trace.String())
+	}
+
+	replay, err := bootverifier.NewReplay(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updateApp1(newTKey(replay, out), newApp, signApp(testKey, newApp)); err != nil {
+		t.Fatalf("replayed updateApp1: %v", err)
+	}
+
+	if err := replay.Err(); err != nil {
+		t.Error(err)
+	}
+
+	// A client sending something else is caught.
+	replay, err = bootverifier.NewReplay(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherApp := bytes.Repeat([]byte{0x43}, 500)
+	if err := updateApp1(newTKey(replay, out), otherApp, signApp(testKey, otherApp)); err == nil {
+		t.Errorf("replay of another app succeeded")
+	}
+}
+
+func TestSimExitCodes(t *testing.T) {
+	newApp := bytes.Repeat([]byte{0x42}, 500)
+
+	for _, tc := range []struct {
+		name     string
+		faults   sim.Faults
+		proposed bool
+		sigKey   ed25519.PrivateKey
+		code     int
+	}{
+		{"no touch", sim.Faults{NoTouch: true}, false, testKey, exitStatus},
+		{"no touch, proposed verifier", sim.Faults{NoTouch: true}, true, testKey, exitNoTouch},
+		{"port gone", sim.Faults{PortGoneAfterReset: 2}, false, testKey, exitNoDevice},
+		{"dropped response", sim.Faults{DropTx: 1}, false, testKey, exitConnection},
+		{"corrupted response", sim.Faults{CorruptTx: 1}, false, testKey, exitProtocol},
+		{"bad chunk", sim.Faults{BadChunk: 2}, false, testKey, exitPartialInstall},
+		{"bad signature", sim.Faults{}, false, otherTestKey, exitBadSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, tr := newSimConfig(t, sim.Config{App: testApp, Faults: tc.faults, Proposed: tc.proposed})
+
+			err := updateApp1(newTKey(tr, out), newApp, signApp(tc.sigKey, newApp))
+			if code := exitCode(err); code != tc.code {
+				t.Errorf("expected exit code %d, got %d for %v", tc.code, code, err)
+			}
+		})
+	}
+}
+
+func TestExitCodeStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"no touch", &bootverifier.StatusError{Cmd: bootverifier.CmdEraseAreas, Status: bootverifier.StatusPresenceTimeout}, exitNoTouch},
+		{"flash failed", &bootverifier.StatusError{Cmd: bootverifier.CmdStorePubkey, Status: bootverifier.StatusFlashFailed}, exitFlashFailed},
+		{"invalid size", &bootverifier.StatusError{Cmd: bootverifier.CmdUpdateAppInit, Status: bootverifier.StatusInvalidSize}, exitStatus},
+		{"bad state", &bootverifier.StatusError{Cmd: bootverifier.CmdVerify, Status: bootverifier.StatusBadState}, exitStatus},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := exitCode(tc.err); code != tc.code || exitClasses[code] == "" {
+				t.Errorf("expected exit code %d, got %d (%q)", tc.code, code, exitClasses[code])
+			}
+		})
+	}
+}
+
+func TestSimJSONOutput(t *testing.T) {
+	_, tr := newSim(t, testApp)
+
+	var buf bytes.Buffer
+	orig := out
+	t.Cleanup(func() { out = orig })
+	out = &output{w: &buf, json: true, res: result{Command: "install-pubkey"}}
+
+	err := installPubkey(allowIdentityChange(newTKey(tr, out)), pubkeyOf(otherTestKey))
+	out.finish(exitCode(err), err)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	for _, line := range lines[:len(lines)-1] {
+		var ev event
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Event == "" {
+			t.Errorf("bad event %s: %v", line, err)
+		}
+	}
+
+	var res result
+	if err := json.Unmarshal(lines[len(lines)-1], &res); err != nil {
+		t.Fatal(err)
+	}
+
+	otherPub := pubkeyOf(otherTestKey)
+	if !res.OK || res.Error != nil || res.Pubkey != hex.EncodeToString(otherPub[:]) {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	want := []string{"reset-to-cmd-mode", "get-pubkey", "store-pubkey", "readback", "reset-to-app"}
+	if !slices.Equal(res.Phases, want) {
+		t.Errorf("expected phases %v, got %v", want, res.Phases)
+	}
+
+	// Installing it again fails with a class.
+	buf.Reset()
+	out.res = result{}
+
+	if err := tr.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = installPubkey(newTKey(tr, out), otherPub)
+	out.finish(exitCode(err), err)
+
+	lines = bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	res = result{}
+	if err := json.Unmarshal(lines[len(lines)-1], &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.OK || res.Error == nil || res.Error.Class != "already-installed" || res.Error.ExitCode != exitAlreadyInstalled {
+		t.Errorf("unexpected result %+v, error %+v", res, res.Error)
+	}
+}
+
+func TestSimStatus(t *testing.T) {
+	d, tr := newSim(t, testApp)
+
+	// The verifier in verifier/ isn't asked for CMD_GET_METADATA.
+	pub := pubkeyOf(testKey)
+	o := &output{w: io.Discard}
+	if err := showStatus(newTKey(tr, o), &pub); err != nil {
+		t.Fatalf("showStatus: %v", err)
+	}
+
+	if o.res.AppDigest != "" {
+		t.Errorf("expected no app digest, got %s", o.res.AppDigest)
+	}
+
+	// Back to the app in slot 1.
+	if d.Mode() != sim.ModeApp || d.AppDigest() != blake2s.Sum256(testApp) {
+		t.Errorf("expected app running, got %v", d.Mode())
+	}
+
+	// A new tkey-mgt run connects once the TKey has settled.
+	tr = sim.NewTransport(d)
+
+	other := pubkeyOf(otherTestKey)
+	if err := showStatus(newTKey(tr, out), &other); exitCode(err) != exitNotMatching {
+		t.Errorf("expected not matching, got %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp {
+		t.Errorf("expected app running, got %v", d.Mode())
+	}
+}
+
+func TestSimStatusMetadata(t *testing.T) {
+	d, tr := newProposedSim(t, testApp)
+
+	o := &output{w: io.Discard}
+	tk := newTKey(tr, o)
+	tk.metadata = true
+
+	if err := showStatus(tk, nil); err != nil {
+		t.Fatalf("showStatus: %v", err)
+	}
+
+	digest := blake2s.Sum256(testApp)
+	if o.res.AppDigest != hex.EncodeToString(digest[:]) {
+		t.Errorf("expected app digest %x, got %s", digest, o.res.AppDigest)
+	}
+
+	if d.Mode() != sim.ModeApp {
+		t.Errorf("expected app running, got %v", d.Mode())
+	}
+
+	// The verifier in verifier/ halts on it, slot 1 isn't known.
+	d, tr = newSim(t, testApp)
+
+	o = &output{w: io.Discard}
+	tk = newTKey(tr, o)
+	tk.metadata = true
+
+	if err := showStatus(tk, nil); err != nil {
+		t.Fatalf("showStatus: %v", err)
+	}
+
+	if o.res.AppDigest != "" || d.Mode() != sim.ModeHalted {
+		t.Errorf("expected halted verifier and no app digest, got %v %s", d.Mode(), o.res.AppDigest)
+	}
+}
+
+func TestSimShowInstalled(t *testing.T) {
+	d, tr := newProposedSim(t, testApp)
+
+	sig := signApp(testKey, testApp)
+	if err := showInstalled(newTKey(tr, out), testApp, &sig); err != nil {
+		t.Fatalf("showInstalled: %v", err)
+	}
+
+	if d.Mode() != sim.ModeApp {
+		t.Errorf("expected app running, got %v", d.Mode())
+	}
+
+	// A new tkey-mgt run connects once the TKey has settled.
+	tr = sim.NewTransport(d)
+
+	otherSig := signApp(otherTestKey, testApp)
+	if err := showInstalled(newTKey(tr, out), testApp, &otherSig); exitCode(err) != exitNotMatching {
+		t.Errorf("expected not matching signature, got %v", err)
+	}
+
+	tr = sim.NewTransport(d)
+
+	if err := showInstalled(newTKey(tr, out), testApp[1:], nil); exitCode(err) != exitNotMatching {
+		t.Errorf("expected not matching digest, got %v", err)
+	}
+
+	// The verifier in verifier/ can't tell.
+	_, tr = newSim(t, testApp)
+
+	if err := showInstalled(newTKey(tr, out), testApp, &sig); !errors.Is(err, errNoMetadata) || exitCode(err) != exitHalted {
+		t.Errorf("expected errNoMetadata, got %v", err)
+	}
+}
+
+func TestSimVerifyOutcomes(t *testing.T) {
+	// The verifier halts on a signature it doesn't accept.
+	d, tr := newSim(t, testApp)
+	tk := newTKey(tr, out)
+	bv := bootverifier.New(tk)
+
+	if err := bv.Reset(bootverifier.FwResetTypeStartClient, bootverifier.VerifierResetDstCmdMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitForReset(tk); err != nil {
+		t.Fatal(err)
+	}
+	if err := bootverifier.LoadApp(tr, verifierBinary, nil); err != nil {
+		t.Fatalf("LoadApp: %v", err)
+	}
+	if err := bv.SetPubkey(pubkeyOf(otherTestKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bv.Verify(blake2s.Sum256(testApp), signApp(testKey, testApp)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := waitForVerify(tk); exitCode(err) != exitHalted {
+		t.Errorf("expected halted, got %v", err)
+	}
+
+	if d.Mode() != sim.ModeHalted {
+		t.Errorf("expected halt, got %v", d.Mode())
+	}
+
+	// The TKey doesn't come back after the reset into verified
+	// client mode: cold boot, reset to client, reset after verify.
+	_, tr = newFaultySim(t, testApp, sim.Faults{PortGoneAfterReset: 3})
+	clientApp := bytes.Repeat([]byte{0x43}, 3000)
+
+	err := startVerifier(allowIdentityChange(newTKey(tr, out)), pubkeyOf(otherTestKey), clientApp, signApp(otherTestKey, clientApp))
+	if !errors.Is(err, errVanished) || exitCode(err) != exitNoDevice {
+		t.Errorf("expected vanished, got %v", err)
+	}
+}
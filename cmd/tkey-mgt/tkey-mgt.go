@@ -7,12 +7,14 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	_ "embed"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"time"
+	"slices"
 
+	"tkey-mgt/bootverifier"
 	"tkey-mgt/sigfile"
 
 	"github.com/tillitis/tkeyclient"
@@ -24,361 +26,1297 @@ import (
 //go:embed verifier.bin
 var verifierBinary []byte
 
-var expectClose = true
+// tkey is a connection to one TKey and where to report what is done
+// with it.
+type tkey struct {
+	bootverifier.Transport
+	out *output
 
-func verifyAppSignature(tk *tkeyclient.TillitisKey, pubKey [ed25519.PublicKeySize]byte, bin []byte, sig [ed25519.SignatureSize]byte) error {
+	// portCloses is whether the serial port closes when the TKey
+	// resets, as for a real TKey on USB but not in QEMU. It's
+	// learned from the first reset, unless keepsPort says so.
+	portCloses bool
+
+	tkeyOptions
+
+	// id is the TKey in known_devices.
+	id string
+}
+
+// tkeyOptions are what the command line says about every TKey.
+type tkeyOptions struct {
+	// pins, if set, is known_devices.
+	pins *knownDevices
+
+	// allowIdentityChange lets an operation change the identity of
+	// the verified app, see checkIdentity.
+	allowIdentityChange bool
+
+	// eventLog, if set, is the measured-boot event log, see
+	// logBoot.
+	eventLog string
+
+	// verifierDigest, if set, is the digest of the verifier in
+	// slot 0 for the event log, which can't be measured.
+	verifierDigest *[blake2s.Size]byte
+
+	// uss, if set, is the USS passphrase boot loads the verifier
+	// with.
+	uss []byte
+
+	// metadata lets operations ask the verifier what is in slot 1
+	// with CMD_GET_METADATA, see getMetadata.
+	metadata bool
+
+	// keepsPort tells that the serial port stays when the TKey
+	// resets, like in QEMU, so the first reset isn't waited for.
+	keepsPort bool
+}
+
+func newTKey(t bootverifier.Transport, o *output) *tkey {
+	return &tkey{Transport: t, out: o, portCloses: true}
+}
+
+// Errors from the flows below, in addition to the ones from
+// bootverifier. See exitCode.
+var (
+	// errPartialInstall is returned when installing an app fails
+	// after slot 1 was erased.
+	errPartialInstall = errors.New("install interrupted, slot 1 is erased")
+
+	errBadSignature     = errors.New("app signature invalid")
+	errPubkeyMismatch   = errors.New("something went wrong, pubkey not installed")
+	errAlreadyInstalled = errors.New("pubkey already installed")
+	errNotMatching      = errors.New("doesn't match")
+
+	// errHalted is returned when the TKey is still there but has
+	// stopped answering, like the verifier after a failed verify.
+	errHalted = errors.New("the TKey halted, remove and reinsert it")
+
+	// errVanished is returned when the TKey doesn't come back
+	// after a reset. It wraps bootverifier.ErrNoDevice.
+	errVanished = errors.New("the TKey disappeared")
+
+	// errNotBooted is returned when the verifier on flash doesn't
+	// start slot 1 after a reset, because the app there doesn't
+	// verify with the pubkey on flash.
+	errNotBooted = errors.New("slot 1 doesn't verify, the verifier waits for commands")
+
+	// errNoMetadata is returned when the verifier doesn't answer
+	// CMD_GET_METADATA. A verifier without it halts instead. It
+	// wraps errHalted.
+	errNoMetadata = errors.New("the verifier doesn't have CMD_GET_METADATA")
+)
+
+func verifyAppSignature(pubKey [ed25519.PublicKeySize]byte, bin []byte, sig [ed25519.SignatureSize]byte) error {
 	digest := blake2s.Sum256(bin)
 	if !ed25519.Verify(pubKey[:], digest[:], sig[:]) {
-		return fmt.Errorf("app signature invalid")
+		return errBadSignature
 	}
 
 	return nil
 }
 
-func eraseAll(tk *tkeyclient.TillitisKey) error {
-	err := reset(tk, fwResetTypeStartFlash0, verifierResetDstCmdMode)
+func eraseAll(tk *tkey) error {
+	bv := bootverifier.New(tk)
+
+	err := bv.Reset(bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode)
 	if err != nil {
 		return err
 	}
 
-	if expectClose {
-		waitUntilPortClosed(tk)
-		reconnect(tk)
-	} else {
-		time.Sleep(1000 * time.Millisecond)
+	if err := waitForReset(tk); err != nil {
+		return err
 	}
+	tk.out.phase("reset-to-cmd-mode")
 
-	fmt.Printf("Your TKey will begin to blink yellow.\n")
-	fmt.Printf("Any data stored by any app will be erased and cannot be restored. Confirm the erase operation by touching the TKey touch sensor three times.\n")
-	fmt.Printf("If you want to abort then wait for the process to timeout.\n")
+	tk.out.touch("Your TKey will begin to blink yellow.",
+		"Any data stored by any app will be erased and cannot be restored. Confirm the erase operation by touching the TKey touch sensor three times.",
+		"If you want to abort then wait for the process to timeout.")
 
-	err = eraseAreas(tk)
+	err = bv.EraseAreas()
 	if err != nil {
 		return err
 	}
+	tk.out.phase("erase-areas")
 
-	fmt.Printf("\nAll data erased\n")
+	tk.out.info("\nAll data erased\n")
 
 	return nil
 }
 
-func updateApp1(tk *tkeyclient.TillitisKey, bin []byte, sig [ed25519.SignatureSize]byte) error {
-	err := reset(tk, fwResetTypeStartFlash0, verifierResetDstCmdMode)
+func updateApp1(tk *tkey, bin []byte, sig [ed25519.SignatureSize]byte) error {
+	bv := bootverifier.New(tk)
+
+	err := bv.Reset(bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode)
 	if err != nil {
 		return err
 	}
 
-	if expectClose {
-		waitUntilPortClosed(tk)
-		reconnect(tk)
-	} else {
-		time.Sleep(1000 * time.Millisecond)
+	if err := waitForReset(tk); err != nil {
+		return err
 	}
+	tk.out.phase("reset-to-cmd-mode")
 
-	pubkey, err := getPubkey(tk)
+	pubkey, err := bv.GetPubkey()
 	if err != nil {
 		return err
 	}
+	tk.out.res.Pubkey = hex.EncodeToString(pubkey[:])
+	tk.out.phase("get-pubkey")
 
-	err = verifyAppSignature(tk, pubkey, bin, sig)
-	if err != nil {
+	if err := tk.checkPin(pubkey); err != nil {
 		return err
 	}
 
-	fmt.Printf("Your TKey will begin to blink yellow.\n")
-	fmt.Printf("Any installed app will be replaced. To confirm the installation, touch the TKey three times.\n")
-	fmt.Printf("If you want to abort then wait for the process to timeout.\n")
-
-	digest := blake2s.Sum256(bin)
+	// The app is verified with the same pubkey as before.
+	if err := tk.checkIdentity(pubkey, pubkey); err != nil {
+		return leaveCmdMode(bv, err)
+	}
 
-	if err := updateAppInit(tk, len(bin), digest, sig); err != nil {
+	err = verifyAppSignature(pubkey, bin, sig)
+	if err != nil {
 		return err
 	}
+	tk.out.phase("verify-signature")
 
-	// For each 127 byte
-	//   Upload chunk
-	var buf []byte
-	for _, b := range bin {
-		buf = append(buf, b)
-		if len(buf) == 127 {
-			if err := writeChunk(tk, buf); err != nil {
-				return err
-			}
+	tk.out.touch("Your TKey will begin to blink yellow.",
+		"Any installed app will be replaced. To confirm the installation, touch the TKey three times.",
+		"If you want to abort then wait for the process to timeout.")
 
-			buf = []byte{}
+	digest := blake2s.Sum256(bin)
+	tk.out.res.AppDigest = hex.EncodeToString(digest[:])
+
+	if err := bv.UpdateAppInit(len(bin), digest, sig); err != nil {
+		// The verifier might have started erasing slot 1.
+		if errors.Is(err, bootverifier.ErrFlashFailed) {
+			return fmt.Errorf("%w after 0 of %d bytes: %w", errPartialInstall, len(bin), err)
 		}
+
+		return err
 	}
+	tk.out.phase("update-init")
 
-	if len(buf) != 0 {
-		if err := writeChunk(tk, buf); err != nil {
-			return err
+	// Slot 1 is erased now. From here on, anything going wrong
+	// leaves it without a bootable app.
+	for written := 0; written < len(bin); written += bootverifier.ChunkSize {
+		chunk := bin[written:min(written+bootverifier.ChunkSize, len(bin))]
+
+		if err := bv.WriteChunk(chunk); err != nil {
+			return fmt.Errorf("%w after %d of %d bytes: %w", errPartialInstall, written, len(bin), err)
 		}
+		tk.out.progress(written+len(chunk), len(bin))
 	}
+	tk.out.phase("upload")
 
-	fmt.Printf("\nApp installed\n")
+	tk.out.info("\nApp installed\n")
 
 	return nil
 }
 
-func startVerifier(tk *tkeyclient.TillitisKey, pubKey [ed25519.PublicKeySize]byte, appBin []byte, sig [ed25519.SignatureSize]byte) error {
+func startVerifier(tk *tkey, pubKey [ed25519.PublicKeySize]byte, appBin []byte, sig [ed25519.SignatureSize]byte) error {
 	var err error
-	var secret []byte
 
-	err = verifyAppSignature(tk, pubKey, appBin, sig)
+	bv := bootverifier.New(tk)
+
+	tk.out.res.Pubkey = hex.EncodeToString(pubKey[:])
+	digest := blake2s.Sum256(appBin)
+	tk.out.res.AppDigest = hex.EncodeToString(digest[:])
+
+	err = verifyAppSignature(pubKey, appBin, sig)
 	if err != nil {
 		return err
 	}
+	tk.out.phase("verify-signature")
+
+	if len(tk.uss) > 0 {
+		if err := tk.checkUSSIdentity(); err != nil {
+			return err
+		}
+	}
+
+	// The verifier loaded by the client can't read the pubkey on
+	// flash, so read it in command mode first. That takes another
+	// reset, so only when pinning or the identity check need it.
+	if tk.pins != nil || !tk.allowIdentityChange {
+		err = bv.Reset(bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode)
+		if err != nil {
+			return err
+		}
+
+		if err := waitForReset(tk); err != nil {
+			return err
+		}
+		tk.out.phase("reset-to-cmd-mode")
+
+		installed, err := bv.GetPubkey()
+		if err != nil {
+			return err
+		}
+		tk.out.phase("get-pubkey")
+
+		if err := tk.checkPin(installed); err != nil {
+			return err
+		}
+
+		// The app gets the identity it has when started from
+		// flash only if booted with the same pubkey and without
+		// a USS.
+		if len(tk.uss) == 0 {
+			if err := tk.checkIdentity(installed, pubKey); err != nil {
+				return leaveCmdMode(bv, err)
+			}
+		}
+	}
 
-	err = reset(tk, fwResetTypeStartClient, verifierResetDstCmdMode)
+	err = bv.Reset(bootverifier.FwResetTypeStartClient, bootverifier.VerifierResetDstCmdMode)
 	if err != nil {
 		return err
 	}
 
-	if expectClose {
-		waitUntilPortClosed(tk)
-		reconnect(tk)
-	} else {
-		time.Sleep(1000 * time.Millisecond)
+	if err := waitForReset(tk); err != nil {
+		return err
+	}
+	tk.out.phase("reset-to-firmware")
+
+	// Only firmware tells the UDI, so ask before loading the
+	// verifier.
+	udi, err := bootverifier.GetUDI(tk)
+	if err != nil {
+		return fmt.Errorf("couldn't get UDI: %w", err)
 	}
+	tk.out.res.UDI = udi.String()
+	tk.out.phase("get-udi")
 
-	err = tk.LoadApp(verifierBinary, secret)
+	err = bootverifier.LoadApp(tk, verifierBinary, tk.uss)
 	if err != nil {
 		return fmt.Errorf("%w", err)
 	}
+	tk.out.phase("load-verifier")
 
-	if err := setPubkey(tk, pubKey); err != nil {
+	if err := bv.SetPubkey(pubKey); err != nil {
 		return err
 	}
+	tk.out.phase("set-pubkey")
 
-	digest := blake2s.Sum256(appBin)
-
-	err = verify(tk, digest, sig)
+	err = bv.Verify(digest, sig)
 	if err != nil {
 		return err
 	}
 
-	if expectClose {
-		waitUntilPortClosed(tk)
-		reconnect(tk)
-	} else {
-		time.Sleep(1000 * time.Millisecond)
+	if err := waitForVerify(tk); err != nil {
+		return err
 	}
+	tk.out.phase("verify")
 
-	err = tk.LoadApp(appBin, []byte{})
+	err = bootverifier.LoadApp(tk, appBin, []byte{})
 	if err != nil {
-		fmt.Printf("%v", err)
+		return fmt.Errorf("couldn't load app: %w", err)
 	}
-
-	return nil
+	tk.out.phase("load-app")
+
+	return tk.logBoot(measuredBoot{
+		client:   true,
+		verifier: verifierBinary,
+		uss:      len(tk.uss) > 0,
+		pubkey:   pubKey,
+		app:      digest,
+	})
 }
 
-func installPubkey(tk *tkeyclient.TillitisKey, pubkey [32]byte) error {
-	err := reset(tk, fwResetTypeStartFlash0, verifierResetDstCmdMode)
+func installPubkey(tk *tkey, pubkey [32]byte) error {
+	bv := bootverifier.New(tk)
+
+	err := bv.Reset(bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode)
 	if err != nil {
 		return err
 	}
 
-	if expectClose {
-		waitUntilPortClosed(tk)
-		reconnect(tk)
-	} else {
-		time.Sleep(1000 * time.Millisecond)
+	if err := waitForReset(tk); err != nil {
+		return err
 	}
+	tk.out.phase("reset-to-cmd-mode")
 
-	currentPubkey, err := getPubkey(tk)
+	currentPubkey, err := bv.GetPubkey()
 	if err != nil {
 		return err
 	}
+	tk.out.res.Pubkey = hex.EncodeToString(currentPubkey[:])
+	tk.out.res.PreviousPubkey = tk.out.res.Pubkey
+	tk.out.phase("get-pubkey")
 
 	if bytes.Equal(currentPubkey[:], pubkey[:]) {
-		return errors.New("pubkey already installed")
+		return errAlreadyInstalled
+	}
+
+	// Check the pin, and that known_devices can be written, before
+	// the touch, so the new pubkey can be pinned once stored.
+	if err := tk.checkPin(currentPubkey); err != nil {
+		return err
+	}
+
+	if err := tk.checkIdentity(currentPubkey, pubkey); err != nil {
+		return leaveCmdMode(bv, err)
 	}
 
-	fmt.Printf("Your TKey will begin to blink yellow.\n")
-	fmt.Printf("Confirm the pubkey update by touching the TKey touch sensor three times.\n")
-	fmt.Printf("If you want to abort then wait for the process to timeout.\n")
+	// The verifier only starts slot 1 if its app is signed with
+	// the pubkey, so after this an app signed with the old one is
+	// left behind. Only a verifier with CMD_GET_METADATA can say
+	// which app that is.
+	if tk.metadata {
+		digest, sig, err := getMetadata(tk, bv)
+		if err != nil {
+			return err
+		}
+
+		if digest != [blake2s.Size]byte{} {
+			checkSlot1(tk.out, pubkey, digest, sig)
+		}
+	}
 
-	err = storePubkey(tk, pubkey)
+	tk.out.touch("Your TKey will begin to blink yellow.",
+		"Confirm the pubkey update by touching the TKey touch sensor three times.",
+		"If you want to abort then wait for the process to timeout.")
+
+	err = bv.StorePubkey(pubkey)
 	if err != nil {
 		return err
 	}
+	tk.out.phase("store-pubkey")
 
-	readbackPubkey, err := getPubkey(tk)
+	readbackPubkey, err := bv.GetPubkey()
 	if err != nil {
 		return err
 	}
 
 	if !bytes.Equal(readbackPubkey[:], pubkey[:]) {
-		return errors.New("something went wrong, pubkey not installed")
+		return errPubkeyMismatch
+	}
+	tk.out.res.Pubkey = hex.EncodeToString(readbackPubkey[:])
+	tk.out.phase("readback")
+
+	if err := tk.updatePin(readbackPubkey); err != nil {
+		return fmt.Errorf("pubkey stored, but %w", err)
 	}
 
-	fmt.Printf("\nPubkey updated\n")
+	tk.out.info("\nPubkey updated\n")
 
-	err = reset(tk, fwResetTypeStartDefault, verifierResetDstApp1)
+	err = bv.Reset(bootverifier.FwResetTypeStartDefault, bootverifier.VerifierResetDstApp1)
 	if err != nil {
 		return err
 	}
+	tk.out.phase("reset-to-app")
 
 	return nil
 }
 
-func waitUntilPortClosed(tk *tkeyclient.TillitisKey) {
-	_, _, _ = tk.ReadFrame(rspVerify, 0x01)
-	_ = tk.Close()
+// leaveCmdMode resets the TKey from the verifier's command mode to
+// start slot 1 as usual, for an operation refused before changing
+// anything, and returns err.
+func leaveCmdMode(bv *bootverifier.Client, err error) error {
+	if rerr := bv.Reset(bootverifier.FwResetTypeStartDefault, bootverifier.VerifierResetDstApp1); rerr != nil {
+		return fmt.Errorf("%w, and couldn't reset: %w", err, rerr)
+	}
+
+	return err
+}
+
+// getMetadata asks the verifier in command mode for the digest and
+// signature of the app in slot 1. The verifier halts on commands it
+// doesn't have, so an unanswered CMD_GET_METADATA is errNoMetadata.
+func getMetadata(tk *tkey, bv *bootverifier.Client) ([blake2s.Size]byte, [ed25519.SignatureSize]byte, error) {
+	digest, sig, err := bv.GetMetadata()
+	if errors.Is(err, bootverifier.ErrTimeout) {
+		return digest, sig, fmt.Errorf("%w, %w", errNoMetadata, errHalted)
+	}
+	if err != nil {
+		return digest, sig, err
+	}
+	tk.out.phase("get-metadata")
+
+	return digest, sig, nil
 }
 
-func reconnect(tk *tkeyclient.TillitisKey) {
-	time.Sleep(2000 * time.Millisecond)
+// checkSlot1 warns if the app in slot 1, with digest and sig, won't
+// start once pubkey is installed.
+func checkSlot1(o *output, pubkey [ed25519.PublicKeySize]byte, digest [blake2s.Size]byte, sig [ed25519.SignatureSize]byte) {
+	boots := ed25519.Verify(pubkey[:], digest[:], sig[:])
+	o.res.AppBoots = &boots
+
+	if !boots {
+		o.info("Warning: the app in slot 1 isn't signed with the new pubkey and won't start until an app signed with it is installed.\n")
+	}
+}
+
+// rotatePubkey installs pubkey and then bin, signed with it, in slot
+// 1, so that the TKey starts an app also with the new pubkey.
+func rotatePubkey(tk *tkey, pubkey [ed25519.PublicKeySize]byte, bin []byte, sig [ed25519.SignatureSize]byte) error {
+	// Nothing is changed unless the new app will start.
+	if err := verifyAppSignature(pubkey, bin, sig); err != nil {
+		return err
+	}
+
+	if err := installPubkey(tk, pubkey); err != nil {
+		return fmt.Errorf("couldn't set pubkey: %w", err)
+	}
 
-	devPath, err := tkeyclient.DetectSerialPort(true)
+	// installPubkey resets the TKey to start slot 1. With an app
+	// signed with the old pubkey the verifier stays in command
+	// mode.
+	if err := waitForReset(tk); err != nil {
+		return err
+	}
+
+	if err := updateApp1(tk, bin, sig); err != nil {
+		return fmt.Errorf("couldn't update app slot 1: %w", err)
+	}
+
+	if err := confirmBooted(tk, true); err != nil {
+		return err
+	}
+
+	tk.out.info("App started with the new pubkey\n")
+
+	return tk.logBoot(measuredBoot{pubkey: pubkey, app: blake2s.Sum256(bin)})
+}
+
+// fingerprint returns a short fingerprint of pubkey, for showing to
+// users: the first 16 bytes of its BLAKE2s digest in hex.
+func fingerprint(pubkey [ed25519.PublicKeySize]byte) string {
+	digest := blake2s.Sum256(pubkey[:])
+
+	return hex.EncodeToString(digest[:16])
+}
+
+// showStatus shows the vendor public key installed on the TKey and
+// whether it is the same as want, if given, and with tk.metadata what
+// is in slot 1. It leaves the TKey starting its app again, unless the
+// verifier halted on CMD_GET_METADATA.
+func showStatus(tk *tkey, want *[ed25519.PublicKeySize]byte) error {
+	bv := bootverifier.New(tk)
+
+	err := bv.Reset(bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode)
 	if err != nil {
-		fmt.Printf("couldn't find any TKeys\n")
-		os.Exit(1)
+		return err
+	}
+
+	if err := waitForReset(tk); err != nil {
+		return err
+	}
+	tk.out.phase("reset-to-cmd-mode")
+
+	pubkey, err := bv.GetPubkey()
+	if err != nil {
+		return err
+	}
+	tk.out.res.Pubkey = hex.EncodeToString(pubkey[:])
+	tk.out.res.Fingerprint = fingerprint(pubkey)
+	tk.out.phase("get-pubkey")
+
+	tk.out.info("Installed pubkey: %x\n", pubkey)
+	tk.out.info("Fingerprint:      %s\n", fingerprint(pubkey))
+
+	// A verifier without CMD_GET_METADATA halts on it, and then
+	// can't be reset.
+	halted := false
+	if tk.metadata {
+		digest, sig, err := getMetadata(tk, bv)
+		switch {
+		case errors.Is(err, errNoMetadata):
+			halted = true
+			tk.out.info("Slot 1:           not known, the verifier doesn't have CMD_GET_METADATA. Remove and reinsert the TKey\n")
+		case err != nil:
+			return err
+		case digest == [blake2s.Size]byte{}:
+			tk.out.info("Slot 1:           no app installed\n")
+		default:
+			tk.out.res.AppDigest = hex.EncodeToString(digest[:])
+			tk.out.res.AppSignature = hex.EncodeToString(sig[:])
+			tk.out.info("Slot 1 digest:    %x\n", digest)
+			tk.out.info("Slot 1 signature: %x\n", sig)
+		}
 	}
 
-	if err = tk.Connect(devPath, tkeyclient.WithSpeed(tkeyclient.SerialSpeed)); err != nil {
-		fmt.Printf("Could not open %s: %v\n", devPath, err)
-		os.Exit(1)
+	var matchErr error
+	if want != nil {
+		matches := pubkey == *want
+		tk.out.res.PubkeyMatches = &matches
+
+		if matches {
+			tk.out.info("Matches the given pubkey\n")
+		} else {
+			tk.out.info("Does NOT match the given pubkey, fingerprint %s\n", fingerprint(*want))
+			matchErr = fmt.Errorf("installed pubkey %w the given pubkey", errNotMatching)
+		}
+	}
+
+	if halted {
+		return matchErr
 	}
+
+	err = bv.Reset(bootverifier.FwResetTypeStartDefault, bootverifier.VerifierResetDstApp1)
+	if err != nil {
+		return err
+	}
+	tk.out.phase("reset-to-app")
+
+	return matchErr
+}
+
+// showInstalled shows the digest and signature of the app installed
+// in slot 1 and whether they are the ones of bin and sig. sig is
+// optional. It leaves the TKey starting its app again. It needs a
+// verifier with CMD_GET_METADATA, see getMetadata.
+func showInstalled(tk *tkey, bin []byte, sig *[ed25519.SignatureSize]byte) error {
+	bv := bootverifier.New(tk)
+
+	err := bv.Reset(bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode)
+	if err != nil {
+		return err
+	}
+
+	if err := waitForReset(tk); err != nil {
+		return err
+	}
+	tk.out.phase("reset-to-cmd-mode")
+
+	installedDigest, installedSig, err := getMetadata(tk, bv)
+	if err != nil {
+		return err
+	}
+	tk.out.res.AppDigest = hex.EncodeToString(installedDigest[:])
+	tk.out.res.AppSignature = hex.EncodeToString(installedSig[:])
+
+	digest := blake2s.Sum256(bin)
+	matches := installedDigest == digest
+
+	tk.out.info("Installed digest:    %x\n", installedDigest)
+	tk.out.info("Local digest:        %x\n", digest)
+
+	if sig != nil {
+		matches = matches && installedSig == *sig
+
+		tk.out.info("Installed signature: %x\n", installedSig)
+		tk.out.info("Local signature:     %x\n", *sig)
+	}
+	tk.out.res.AppMatches = &matches
+
+	var matchErr error
+	if matches {
+		tk.out.info("Installed app matches\n")
+	} else if installedDigest == [blake2s.Size]byte{} {
+		tk.out.info("No app installed in slot 1\n")
+		matchErr = fmt.Errorf("slot 1 is empty, it %w the given app", errNotMatching)
+	} else {
+		tk.out.info("Installed app does NOT match\n")
+		matchErr = fmt.Errorf("installed app %w the given app", errNotMatching)
+	}
+
+	err = bv.Reset(bootverifier.FwResetTypeStartDefault, bootverifier.VerifierResetDstApp1)
+	if err != nil {
+		return err
+	}
+	tk.out.phase("reset-to-app")
+
+	return matchErr
+}
+
+// listDevices shows the TKeys attached over USB. If probe is set it
+// asks each one for its UDI and firmware name and version, which only
+// firmware waiting for an app answers, see bootverifier.Device.Probe.
+func listDevices(probe bool) error {
+	devs, err := bootverifier.ListDevices()
+	if err != nil {
+		return err
+	}
+
+	for i, d := range devs {
+		if probe {
+			if err := d.Probe(); err != nil {
+				return err
+			}
+		}
+
+		ld := listedDevice{Port: d.Port, USBSerial: d.Serial}
+
+		if i > 0 {
+			out.info("\n")
+		}
+		out.info("%s\n", d.Port)
+		out.info("  USB serial: %s\n", d.Serial)
+
+		switch {
+		case !probe:
+			// Nothing known about what it runs.
+		case d.UDI == nil:
+			out.info("  Firmware:   not reachable, running an app\n")
+		default:
+			ld.UDI = d.UDI.String()
+			ld.Firmware = fmt.Sprintf("%s%s %d", d.NameVersion.Name0, d.NameVersion.Name1, d.NameVersion.Version)
+			out.info("  UDI:        %s\n", ld.UDI)
+			out.info("  Firmware:   %s\n", ld.Firmware)
+		}
+
+		out.res.Devices = append(out.res.Devices, ld)
+	}
+
+	if len(devs) == 0 {
+		out.info("No TKeys found\n")
+	}
+	out.phase("list")
+
+	return nil
+}
+
+// resetTimeout returns how long, in seconds, to wait for the serial
+// port to close after a reset. Once it's known that it doesn't close,
+// wait just long enough for the TKey to reset.
+func (tk *tkey) resetTimeout(timeout int) int {
+	if !tk.portCloses {
+		return 1
+	}
+
+	return timeout
+}
+
+// waitForReset waits for the TKey to reset after a reset request
+// and connects to it again.
+func waitForReset(tk *tkey) error {
+	closed, err := bootverifier.WaitForReset(tk, tk.resetTimeout(bootverifier.ReadTimeout))
+	if err != nil {
+		return fmt.Errorf("couldn't reconnect: %w", err)
+	}
+	tk.portCloses = closed
+
+	return nil
+}
+
+// waitForVerify waits for the TKey to reset after CMD_VERIFY and
+// connects to it again. The verifier doesn't answer CMD_VERIFY, so
+// this tells a reset into firmware apart from a halted verifier,
+// still there but silent, and from a TKey that went away.
+func waitForVerify(tk *tkey) error {
+	closed, err := bootverifier.WaitForReset(tk, tk.resetTimeout(bootverifier.VerifyTimeout))
+	switch {
+	case errors.Is(err, bootverifier.ErrNoDevice):
+		return fmt.Errorf("%w after verify: %w", errVanished, err)
+	case err != nil:
+		return fmt.Errorf("after verify: %w", err)
+	case !closed && tk.portCloses:
+		return fmt.Errorf("no reset after verify, %w", errHalted)
+	}
+
+	// Firmware waiting for the verified app answers, the verifier
+	// doesn't.
+	if _, err := bootverifier.GetNameVersion(tk); err != nil {
+		if !errors.Is(err, bootverifier.ErrTimeout) {
+			return fmt.Errorf("no firmware after verify: %w", err)
+		}
+
+		return fmt.Errorf("no firmware after verify, %w", errHalted)
+	}
+
+	return nil
 }
 
 func usage() {
-	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd boot -app path -sig path -pub path-to-pubkey\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd boot -app path -sig path -pub path-to-pubkey [-uss | -uss-file path]\n", os.Args[0])
 	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd install -app path -sig path\n", os.Args[0])
-	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd install-pubkey -pub path\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd install-pubkey -pub path [-app path -sig path | -metadata]\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd rotate-pubkey -pub path -app path -sig path\n", os.Args[0])
 	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd erase-areas\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd status [-pub path] [-metadata]\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd show-installed -app path [-sig path]\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd shell [-script path]\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd reset -reset-type type [-reset-dst dst]\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd reboot-app\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd enter-cmd-mode\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd list\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd provision -manifest path\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd audit-verify -audit path\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd event-log-verify -event-log path\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -cmd predict-cdi -pub path [-uds hex] [-uss | -uss-file path] [-verifier path]\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "\nAdd -device to pick one of several TKeys, -audit path to record changes.\n")
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Add -known-devices path to pin the pubkey of each TKey, -policy path to restrict what is installed.\n")
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Add -trace path to record the session, -replay path to play it back.\n\n")
 	flag.PrintDefaults()
 }
 
 func main() {
-	var err error
-
 	cmd := flag.String("cmd", "", "Command")
 	appPath := flag.String("app", "", "Path to app")
 	sigPath := flag.String("sig", "", "Path to signature")
 	pubPath := flag.String("pub", "", "Path to pubkey")
 	port := flag.String("port", "", "TKey serial port")
-	noExpectClose := flag.Bool("no-expect-close", false, "Do not expect serial port to disappear when TKey resets")
+	device := flag.String("device", "", "TKey to use: serial port, USB serial number or, with -probe, UDI, see -cmd list")
+	probe := flag.Bool("probe", false, "Let list and -device ask TKeys for their UDI. Halts a verifier waiting for commands")
+	noExpectClose := flag.Bool("no-expect-close", false, "Don't wait for the serial port to close on reset, like in QEMU. Otherwise learned from the first reset")
+	tracePath := flag.String("trace", "", "Record every frame sent and received to this file")
+	resetType := flag.String("reset-type", "", "Reset type for reset, one of "+names(bootverifier.FwResetTypeNames))
+	resetDst := flag.String("reset-dst", "app1", "Where the verifier goes after reset, one of "+names(bootverifier.ResetDstNames))
+	scriptPath := flag.String("script", "", "Run shell commands from this file")
+	manifestPath := flag.String("manifest", "", "Provision the TKeys in this manifest")
+	eventLogPath := flag.String("event-log", "", "Record what was measured for each verified boot in this event log")
+	verifierDigestHex := flag.String("verifier-digest", "", "BLAKE2s digest in hex of the verifier on flash, for the event log. Default: recorded as unknown")
+	auditPath := flag.String("audit", "", "Record state-changing operations in this hash-chained audit log")
+	knownDevicesPath := flag.String("known-devices", "", "Pin the pubkey of each TKey in this file and refuse a TKey reporting another")
+	pinWarn := flag.Bool("pin-warn", false, "Only warn when a TKey reports another pubkey than pinned")
+	allowIdentityChange := flag.Bool("allow-identity-change", false, "Go ahead even if the identity of the verified app changes. A new pubkey always changes it, so install-pubkey and rotate-pubkey always need this")
+	metadata := flag.Bool("metadata", false, "Let install-pubkey and status ask the verifier which app is in slot 1 with CMD_GET_METADATA. A verifier without it halts")
+	policyPath := flag.String("policy", "", "Only allow what this policy file allows. Default: "+defaultPolicyDir+"/policy.json, if there")
+	policyKeyPath := flag.String("policy-key", "", "Require the policy to be signed by this pubkey")
+	policySigPath := flag.String("policy-sig", "", "Path to the policy signature. Default: <policy>.sig")
+	replayPath := flag.String("replay", "", "Play back a session recorded with -trace instead of talking to a TKey")
+	udsHex := flag.String("uds", "", "UDS in hex for predict-cdi. Default: all zeroes, like tkey-sim")
+	ussPrompt := flag.Bool("uss", false, "Ask for a USS passphrase to load the verifier with")
+	ussPath := flag.String("uss-file", "", "File with the USS passphrase to load the verifier with")
+	verifierPath := flag.String("verifier", "", "Verifier binary for predict-cdi. Default: the one built in")
+	jsonOut := flag.Bool("json", false, "Write progress events and the result as JSON lines")
 	flag.Usage = usage
 
 	flag.Parse()
 
-	expectClose = !*noExpectClose
+	out.json = *jsonOut
+	out.res.Command = *cmd
 
 	tkeyclient.SilenceLogging()
 
-	devPath := *port
-	if devPath == "" {
-		devPath, err = tkeyclient.DetectSerialPort(true)
+	var tk bootverifier.Transport
+	var replay *bootverifier.Replay
+	var id string
+
+	// auditOp is the operation to record in the audit log, set
+	// once talking to a TKey.
+	var auditOp string
+
+	// audit records auditOp in the audit log, with err if it
+	// failed.
+	audit := func(err error) error {
+		if auditOp == "" {
+			return nil
+		}
+
+		op := auditOp
+		auditOp = ""
+
+		return appendAudit(*auditPath, newAuditEntry(op, &out.res, err))
+	}
+
+	// fail reports err and exits with code.
+	fail := func(code int, err error) {
+		if auditErr := audit(err); auditErr != nil {
+			err = errors.Join(err, auditErr)
+		}
+		out.finish(code, err)
+		if tk != nil {
+			_ = tk.Close()
+		}
+		os.Exit(code)
+	}
+
+	usageErr := func(what string) {
+		if !out.json {
+			flag.Usage()
+		}
+		fail(exitUsage, errors.New(what))
+	}
+
+	readSig := func() *sigfile.Signature {
+		appSig, err := sigfile.ReadSig(*sigPath)
+		if err != nil {
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+		}
+		if appSig.Alg != [2]byte{'E', 'b'} {
+			fail(exitUsage, errors.New("incompatible sig file, expected ed25519 signature over blake2s digest"))
+		}
+		out.res.KeyNum = hex.EncodeToString(appSig.KeyNum[:])
+
+		return appSig
+	}
+
+	if *port != "" && *device != "" {
+		usageErr("give -port or -device, not both")
+	}
+
+	if *probe && *cmd != "list" && *cmd != "provision" && *device == "" {
+		usageErr("-probe only goes with list, provision and -device")
+	}
+
+	// The shell can erase areas and store pubkeys one command at a
+	// time, which isn't recorded as operations.
+	if *auditPath != "" && *cmd == "shell" {
+		usageErr("shell can't be audited, don't give -audit")
+	}
+
+	if *ussPrompt && *ussPath != "" {
+		usageErr("give -uss or -uss-file, not both")
+	}
+
+	if (*ussPrompt || *ussPath != "") && *cmd != "boot" && *cmd != "predict-cdi" {
+		usageErr("-uss and -uss-file only go with boot and predict-cdi")
+	}
+
+	if *verifierDigestHex != "" && *eventLogPath == "" {
+		usageErr("-verifier-digest only goes with -event-log")
+	}
+
+	// readUSS returns the USS passphrase, asking for it with -uss,
+	// or nil if none is given.
+	readUSS := func() []byte {
+		var phrase []byte
+		var err error
+
+		switch {
+		case *ussPrompt:
+			phrase, err = readPassphrase("Enter USS passphrase: ")
+		case *ussPath != "":
+			phrase, err = readUSSFile(*ussPath)
+		}
+		if err != nil {
+			fail(exitUsage, err)
+		}
+
+		return phrase
+	}
+
+	pol, err := loadPolicy(*policyPath, *policyKeyPath, *policySigPath)
+	if err != nil {
+		code := exitUsage
+		if errors.Is(err, errPolicy) {
+			code = exitPolicy
+		}
+		fail(code, err)
+	}
+
+	// enforce stops with err, from checking the policy, if the
+	// operation isn't allowed.
+	enforce := func(err error) {
+		if err != nil {
+			fail(exitCode(err), err)
+		}
+	}
+
+	opts := tkeyOptions{allowIdentityChange: *allowIdentityChange, eventLog: *eventLogPath, metadata: *metadata, keepsPort: *noExpectClose}
+	if *knownDevicesPath != "" {
+		opts.pins = &knownDevices{path: *knownDevicesPath, warnOnly: *pinWarn}
+	}
+	if *verifierDigestHex != "" {
+		digest, err := parseVerifierDigest(*verifierDigestHex)
+		if err != nil {
+			usageErr(err.Error())
+		}
+		opts.verifierDigest = &digest
+	}
+
+	// Commands for several TKeys connect by themselves.
+	switch *cmd {
+	case "list":
+		if err := listDevices(*probe); err != nil {
+			fail(exitCode(err), fmt.Errorf("list: %w", err))
+		}
+		out.finish(exitOK, nil)
+
+		return
+
+	case "provision":
+		if *manifestPath == "" {
+			usageErr("missing -manifest")
+		}
+
+		prov, err := readManifest(*manifestPath)
+		if err != nil {
+			fail(exitUsage, err)
+		}
+
+		enforce(pol.checkPubkey(prov.pubkey))
+		enforce(pol.checkApp(prov.app))
+		if prov.erase {
+			enforce(pol.checkErase())
+		}
+
+		if *auditPath != "" {
+			if err := checkAudit(*auditPath); err != nil {
+				fail(exitCode(err), err)
+			}
+		}
+
+		if err := provision(prov, *auditPath, *probe, opts); err != nil {
+			fail(exitCode(err), err)
+		}
+		out.finish(exitOK, nil)
+
+		return
+
+	case "audit-verify":
+		if *auditPath == "" {
+			usageErr("missing -audit")
+		}
+
+		if err := verifyAudit(*auditPath); err != nil {
+			fail(exitCode(err), fmt.Errorf("audit-verify: %w", err))
+		}
+		out.finish(exitOK, nil)
+
+		return
+
+	case "event-log-verify":
+		if *eventLogPath == "" {
+			usageErr("missing -event-log")
+		}
+
+		if err := verifyEventLog(*eventLogPath); err != nil {
+			fail(exitCode(err), fmt.Errorf("event-log-verify: %w", err))
+		}
+		out.finish(exitOK, nil)
+
+		return
+
+	case "predict-cdi":
+		if *pubPath == "" {
+			usageErr("missing -pub")
+		}
+
+		appPub, err := sigfile.ReadKey(*pubPath)
 		if err != nil {
-			fmt.Printf("couldn't find any TKeys\n")
-			os.Exit(1)
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+		}
+
+		var uds [32]byte
+		if *udsHex != "" {
+			if uds, err = parseUDS(*udsHex); err != nil {
+				fail(exitUsage, err)
+			}
+		}
+
+		var uss *[32]byte
+		if phrase := readUSS(); phrase != nil {
+			u := ussOf(phrase)
+			uss = &u
+		}
+
+		verifier := verifierBinary
+		if *verifierPath != "" {
+			if verifier, err = os.ReadFile(*verifierPath); err != nil {
+				fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+			}
 		}
+
+		predictCDI(out, uds, verifier, uss, appPub.Key)
+		out.finish(exitOK, nil)
+
+		return
 	}
 
-	tk := tkeyclient.New()
-	if err = tk.Connect(devPath, tkeyclient.WithSpeed(tkeyclient.SerialSpeed)); err != nil {
-		fmt.Printf("Could not open %s: %v\n", devPath, err)
-		os.Exit(1)
+	if *auditPath != "" && *replayPath == "" {
+		switch *cmd {
+		case "erase-areas", "install", "install-pubkey", "rotate-pubkey", "boot":
+			if err := checkAudit(*auditPath); err != nil {
+				fail(exitCode(err), err)
+			}
+		}
+	}
+
+	if *replayPath != "" {
+		f, err := os.Open(*replayPath)
+		if err != nil {
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+		}
+
+		replay, err = bootverifier.NewReplay(f)
+		_ = f.Close()
+		if err != nil {
+			fail(exitUsage, err)
+		}
+		tk = replay
+	} else {
+		devPath := *port
+		if *device != "" {
+			var err error
+			if devPath, err = bootverifier.SelectDevice(*device, *probe); err != nil {
+				if errors.Is(err, bootverifier.ErrNoDevice) && !*probe {
+					out.hint = "To select a TKey running firmware by UDI, add -probe."
+				}
+				fail(exitCode(err), err)
+			}
+		}
+
+		serial, err := bootverifier.Connect(devPath)
+		if err != nil {
+			if errors.Is(err, bootverifier.ErrManyDevices) {
+				out.hint = "Select one with -device, see -cmd list."
+			}
+			fail(exitCode(err), err)
+		}
+		out.res.Port = serial.Port()
+		out.res.USBSerial = serial.USBSerial()
+		tk = serial
+		id = deviceID(serial)
+
+		switch *cmd {
+		case "erase-areas", "install", "install-pubkey", "rotate-pubkey", "boot":
+			if *auditPath != "" {
+				auditOp = *cmd
+			}
+		}
+	}
+
+	if *tracePath != "" {
+		f, err := os.Create(*tracePath)
+		if err != nil {
+			fail(exitUsage, fmt.Errorf("couldn't create trace: %w", err))
+		}
+		defer func() { _ = f.Close() }()
+
+		tk = bootverifier.NewTrace(tk, f, slices.Concat(bootverifier.VerifierCommands, bootverifier.FwCommands)...)
 	}
 	defer func() { _ = tk.Close() }()
 
-	exit := func(code int) {
-		_ = tk.Close()
-		os.Exit(code)
+	dev := newTKey(tk, out)
+	dev.allowIdentityChange = opts.allowIdentityChange
+	dev.metadata = opts.metadata
+	dev.keepsPort = opts.keepsPort
+	dev.portCloses = !opts.keepsPort
+	if replay == nil {
+		dev.eventLog = opts.eventLog
+		dev.verifierDigest = opts.verifierDigest
+		dev.pins = opts.pins
+		dev.id = id
 	}
 
 	switch *cmd {
 	case "erase-areas":
-		if err := eraseAll(tk); err != nil {
-			fmt.Printf("couldn't erase areas: %v\n", err)
-			exit(1)
+		enforce(pol.checkErase())
+
+		if err := eraseAll(dev); err != nil {
+			fail(exitCode(err), fmt.Errorf("couldn't erase areas: %w", err))
 		}
 
 	case "install":
 		if *appPath == "" {
-			flag.Usage()
-			os.Exit(1)
+			usageErr("missing -app")
 		}
 
 		if *sigPath == "" {
-			flag.Usage()
-			os.Exit(1)
+			usageErr("missing -sig")
 		}
 
 		appBin, err := os.ReadFile(*appPath)
 		if err != nil {
-			fmt.Printf("couldn't read file: %v\n", err)
-			os.Exit(1)
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
 		}
 
-		appSig, err := sigfile.ReadSig(*sigPath)
-		if err != nil {
-			fmt.Printf("couldn't read file: %v\n", err)
-			os.Exit(1)
-		}
-		if appSig.Alg != [2]byte{'E', 'b'} {
-			fmt.Printf("incompatible sig file, expected ed25519 signature over blake2s digest\n")
-			os.Exit(1)
-		}
+		appSig := readSig()
 
-		if err := updateApp1(tk, appBin, appSig.Sig); err != nil {
-			fmt.Printf("couldn't update app slot 1: %v\n", err)
-			exit(1)
+		enforce(pol.checkApp(appBin))
+
+		if err := updateApp1(dev, appBin, appSig.Sig); err != nil {
+			if errors.Is(err, errPartialInstall) {
+				out.hint = "There is no app to start in slot 1. Remove and reinsert the TKey, it will wait for commands, and run install again."
+			}
+			if errors.Is(err, errPinMismatch) {
+				out.hint = pinHint
+			}
+			fail(exitCode(err), fmt.Errorf("couldn't update app slot 1: %w", err))
 		}
 
 	case "boot":
 		if *appPath == "" || *sigPath == "" || *pubPath == "" {
-			flag.Usage()
-			os.Exit(1)
+			usageErr("missing -app, -sig or -pub")
 		}
 
 		appPub, err := sigfile.ReadKey(*pubPath)
 		if err != nil {
-			fmt.Printf("couldn't read file: %v\n", err)
-			os.Exit(1)
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
 		}
 
 		appBin, err := os.ReadFile(*appPath)
 		if err != nil {
-			fmt.Printf("couldn't read file: %v\n", err)
-			os.Exit(1)
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
 		}
 
-		appSig, err := sigfile.ReadSig(*sigPath)
+		appSig := readSig()
+
+		enforce(pol.checkPubkey(appPub.Key))
+		enforce(pol.checkApp(appBin))
+
+		dev.uss = readUSS()
+
+		if err := startVerifier(dev, appPub.Key, appBin, appSig.Sig); err != nil {
+			if errors.Is(err, errPinMismatch) {
+				out.hint = pinHint
+			}
+			fail(exitCode(err), fmt.Errorf("couldn't load and start verifier: %w", err))
+		}
+
+	case "install-pubkey":
+		if *pubPath == "" {
+			usageErr("missing -pub")
+		}
+
+		appPub, err := sigfile.ReadKey(*pubPath)
 		if err != nil {
-			fmt.Printf("couldn't read file: %v\n", err)
-			os.Exit(1)
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
 		}
-		if appSig.Alg != [2]byte{'E', 'b'} {
-			fmt.Printf("incompatible sig file, expected ed25519 signature over blake2s digest\n")
-			os.Exit(1)
+
+		enforce(pol.checkPubkey(appPub.Key))
+
+		// With the app in slot 1 given, check it here instead of
+		// asking the verifier.
+		if *appPath != "" {
+			if *sigPath == "" {
+				usageErr("missing -sig")
+			}
+
+			appBin, err := os.ReadFile(*appPath)
+			if err != nil {
+				fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+			}
+
+			checkSlot1(out, appPub.Key, blake2s.Sum256(appBin), readSig().Sig)
+		} else if !dev.metadata {
+			out.info("Not checking that the app in slot 1 starts with the new pubkey, give it with -app and -sig\n")
 		}
 
-		if err := startVerifier(tk, appPub.Key, appBin, appSig.Sig); err != nil {
-			fmt.Printf("couldn't load and start verifier: %v\n", err)
-			exit(1)
+		if err := installPubkey(dev, appPub.Key); err != nil {
+			if errors.Is(err, errNoMetadata) {
+				out.hint = "Nothing was changed. Remove and reinsert the TKey and run install-pubkey without -metadata, giving the app in slot 1 with -app and -sig."
+			}
+			fail(exitCode(err), fmt.Errorf("couldn't set pubkey: %w", err))
 		}
 
-	case "install-pubkey":
-		if *pubPath == "" {
-			flag.Usage()
-			os.Exit(1)
+	case "rotate-pubkey":
+		if *pubPath == "" || *appPath == "" || *sigPath == "" {
+			usageErr("missing -pub, -app or -sig")
 		}
 
 		appPub, err := sigfile.ReadKey(*pubPath)
 		if err != nil {
-			fmt.Printf("couldn't read file: %v\n", err)
-			os.Exit(1)
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
 		}
 
-		if err := installPubkey(tk, appPub.Key); err != nil {
-			fmt.Printf("couldn't set pubkey: %v\n", err)
-			exit(1)
+		appBin, err := os.ReadFile(*appPath)
+		if err != nil {
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+		}
+
+		appSig := readSig()
+
+		enforce(pol.checkPubkey(appPub.Key))
+		enforce(pol.checkApp(appBin))
+
+		if err := rotatePubkey(dev, appPub.Key, appBin, appSig.Sig); err != nil {
+			switch {
+			case errors.Is(err, errPartialInstall):
+				out.hint = "The new pubkey is installed but there is no app to start in slot 1. Remove and reinsert the TKey, it will wait for commands, and run install with the new app."
+			case errors.Is(err, errNotBooted):
+				out.hint = "The new pubkey and the app are installed, but the app doesn't verify. The TKey waits for commands, run install with the new app again."
+			case errors.Is(err, errPinMismatch):
+				out.hint = pinHint
+			}
+			fail(exitCode(err), fmt.Errorf("rotate-pubkey: %w", err))
+		}
+
+	case "reset":
+		if *resetType == "" {
+			usageErr("missing -reset-type")
+		}
+
+		rstType, err := bootverifier.ParseFwResetType(*resetType)
+		if err != nil {
+			usageErr(err.Error())
+		}
+
+		dst, err := bootverifier.ParseResetDst(*resetDst)
+		if err != nil {
+			usageErr(err.Error())
+		}
+
+		if err := resetTKey(dev, rstType, dst); err != nil {
+			if errors.Is(err, errNotBooted) {
+				out.hint = notBootedHint
+			}
+			fail(exitCode(err), fmt.Errorf("reset: %w", err))
+		}
+
+	case "reboot-app":
+		if err := resetTKey(dev, bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstApp1); err != nil {
+			if errors.Is(err, errNotBooted) {
+				out.hint = notBootedHint
+			}
+			fail(exitCode(err), fmt.Errorf("reboot-app: %w", err))
+		}
+
+	case "enter-cmd-mode":
+		if err := resetTKey(dev, bootverifier.FwResetTypeStartFlash0, bootverifier.VerifierResetDstCmdMode); err != nil {
+			fail(exitCode(err), fmt.Errorf("enter-cmd-mode: %w", err))
+		}
+
+	case "status":
+		var want *[ed25519.PublicKeySize]byte
+		if *pubPath != "" {
+			appPub, err := sigfile.ReadKey(*pubPath)
+			if err != nil {
+				fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+			}
+			want = &appPub.Key
+		}
+
+		if err := showStatus(dev, want); err != nil {
+			fail(exitCode(err), fmt.Errorf("status: %w", err))
+		}
+
+	case "show-installed":
+		if *appPath == "" {
+			usageErr("missing -app")
+		}
+
+		appBin, err := os.ReadFile(*appPath)
+		if err != nil {
+			fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+		}
+
+		var sig *[ed25519.SignatureSize]byte
+		if *sigPath != "" {
+			sig = &readSig().Sig
+		}
+
+		if err := showInstalled(dev, appBin, sig); err != nil {
+			if errors.Is(err, errNoMetadata) {
+				out.hint = "The verifier on this TKey can't tell what is in slot 1. Remove and reinsert the TKey."
+			}
+			fail(exitCode(err), fmt.Errorf("show-installed: %w", err))
+		}
+
+	case "shell":
+		enforce(pol.checkShell())
+
+		in := os.Stdin
+		if *scriptPath != "" {
+			f, err := os.Open(*scriptPath)
+			if err != nil {
+				fail(exitUsage, fmt.Errorf("couldn't read file: %w", err))
+			}
+			in = f
+		}
+
+		if err := runShell(dev, in, os.Stdout, *scriptPath != ""); err != nil {
+			fail(exitCode(err), err)
 		}
 
 	default:
-		flag.Usage()
-		exit(1)
+		usageErr(fmt.Sprintf("unknown command %q", *cmd))
+	}
+
+	if replay != nil {
+		_ = tk.Close()
+		if err := replay.Err(); err != nil {
+			fail(exitFailure, err)
+		}
 	}
+
+	if err := audit(nil); err != nil {
+		fail(exitFailure, err)
+	}
+
+	out.finish(exitOK, nil)
 }
@@ -0,0 +1,380 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/internal/fakedev"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+var (
+	testKey      = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x01}, ed25519.SeedSize))
+	otherTestKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x02}, ed25519.SeedSize))
+	testApp      = bytes.Repeat([]byte{0xaa, 0x55, 0x17}, 300)
+)
+
+func pubkeyOf(key ed25519.PrivateKey) [ed25519.PublicKeySize]byte {
+	return [ed25519.PublicKeySize]byte(key.Public().(ed25519.PublicKey))
+}
+
+func signApp(key ed25519.PrivateKey, bin []byte) [ed25519.SignatureSize]byte {
+	digest := blake2s.Sum256(bin)
+
+	return [ed25519.SignatureSize]byte(ed25519.Sign(key, digest[:]))
+}
+
+// expectCmdMode scripts the reset into the flash verifier's command
+// mode that most flows begin with.
+func expectCmdMode(f *fakedev.Transport) {
+	f.Expect(bootverifier.CmdReset).Drop()
+	f.ExpectReconnect()
+}
+
+// allowIdentityChange returns tk, allowed to change the identity of
+// the verified app.
+func allowIdentityChange(tk *tkey) *tkey {
+	tk.allowIdentityChange = true
+
+	return tk
+}
+
+// testUDI is the UDI of fakedev TKeys, packed as firmware sends it.
+var testUDI = [8]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+func expectGetPubkey(f *fakedev.Transport, pubkey [ed25519.PublicKeySize]byte) {
+	f.Expect(bootverifier.CmdGetPubkey).Reply(bootverifier.RspGetPubkey, append([]byte{tkeyclient.StatusOK}, pubkey[:]...)...)
+}
+
+func expectGetMetadata(f *fakedev.Transport, app []byte, sig [ed25519.SignatureSize]byte) {
+	digest := blake2s.Sum256(app)
+	f.Expect(bootverifier.CmdGetMetadata).Reply(bootverifier.RspGetMetadata, slices.Concat([]byte{tkeyclient.StatusOK}, digest[:], sig[:])...)
+}
+
+func TestUpdateApp1(t *testing.T) {
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	f.Expect(bootverifier.CmdUpdateAppInit).Reply(bootverifier.RspUpdateAppInit, tkeyclient.StatusOK)
+
+	chunks := (len(testApp) + bootverifier.ChunkSize - 1) / bootverifier.ChunkSize
+	for i := 0; i < chunks; i++ {
+		f.Expect(bootverifier.CmdUpdateAppChunk).Reply(bootverifier.RspUpdateAppChunk, tkeyclient.StatusOK)
+	}
+
+	if err := updateApp1(newTKey(f, out), testApp, signApp(testKey, testApp)); err != nil {
+		t.Fatalf("updateApp1: %v", err)
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	init := f.Written[2]
+	if size := int(init[2]) | int(init[3])<<8 | int(init[4])<<16 | int(init[5])<<24; size != len(testApp) {
+		t.Errorf("app size sent: %d, expected %d", size, len(testApp))
+	}
+
+	var uploaded []byte
+	for _, tx := range f.Written[3:] {
+		uploaded = append(uploaded, tx[2:2+bootverifier.ChunkSize]...)
+	}
+	if !bytes.Equal(uploaded[:len(testApp)], testApp) {
+		t.Errorf("uploaded app differs from app")
+	}
+}
+
+func TestUpdateApp1WrongPubkey(t *testing.T) {
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(otherTestKey))
+
+	if err := updateApp1(newTKey(f, out), testApp, signApp(testKey, testApp)); err == nil {
+		t.Fatalf("updateApp1 succeeded with app signed by another key")
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateApp1InitNotOK(t *testing.T) {
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	f.Expect(bootverifier.CmdUpdateAppInit).Reply(bootverifier.RspUpdateAppInit, tkeyclient.StatusBad)
+
+	err := updateApp1(newTKey(f, out), testApp, signApp(testKey, testApp))
+
+	var statusErr *bootverifier.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Cmd != bootverifier.CmdUpdateAppInit {
+		t.Fatalf("expected status error for cmdUpdateAppInit, got %v", err)
+	}
+}
+
+func TestInstallPubkey(t *testing.T) {
+	newPubkey := pubkeyOf(otherTestKey)
+
+	// Without -metadata only what the verifier on TKeys today has
+	// is sent.
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	f.Expect(bootverifier.CmdStorePubkey).Reply(bootverifier.RspStorePubkey, tkeyclient.StatusOK)
+	expectGetPubkey(f, newPubkey)
+	f.Expect(bootverifier.CmdReset)
+
+	if err := installPubkey(allowIdentityChange(newTKey(f, out)), newPubkey); err != nil {
+		t.Fatalf("installPubkey: %v", err)
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := f.Written[2][2 : 2+ed25519.PublicKeySize]; !bytes.Equal(stored, newPubkey[:]) {
+		t.Errorf("stored pubkey %x, expected %x", stored, newPubkey)
+	}
+
+	reset := f.Written[4]
+	if bootverifier.FwResetType(reset[2]) != bootverifier.FwResetTypeStartDefault ||
+		bootverifier.ResetDst(reset[3]) != bootverifier.VerifierResetDstApp1 {
+		t.Errorf("unexpected final reset %x", reset[2:4])
+	}
+}
+
+func TestInstallPubkeyMetadata(t *testing.T) {
+	newPubkey := pubkeyOf(otherTestKey)
+
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	expectGetMetadata(f, testApp, signApp(otherTestKey, testApp))
+	f.Expect(bootverifier.CmdStorePubkey).Reply(bootverifier.RspStorePubkey, tkeyclient.StatusOK)
+	expectGetPubkey(f, newPubkey)
+	f.Expect(bootverifier.CmdReset)
+
+	o := &output{w: io.Discard}
+	tk := allowIdentityChange(newTKey(f, o))
+	tk.metadata = true
+
+	if err := installPubkey(tk, newPubkey); err != nil {
+		t.Fatalf("installPubkey: %v", err)
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if o.res.AppBoots == nil || !*o.res.AppBoots {
+		t.Errorf("expected app in slot 1 to boot with the new pubkey")
+	}
+}
+
+func TestInstallPubkeyNoMetadata(t *testing.T) {
+	// A verifier without CMD_GET_METADATA halts on it.
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	f.Expect(bootverifier.CmdGetMetadata)
+
+	tk := allowIdentityChange(newTKey(f, out))
+	tk.metadata = true
+
+	err := installPubkey(tk, pubkeyOf(otherTestKey))
+	if !errors.Is(err, errNoMetadata) || exitCode(err) != exitHalted {
+		t.Fatalf("expected errNoMetadata, got %v", err)
+	}
+
+	// Nothing was stored.
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallPubkeyAlreadyInstalled(t *testing.T) {
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+
+	if err := installPubkey(newTKey(f, out), pubkeyOf(testKey)); err == nil {
+		t.Fatalf("installPubkey succeeded with the installed pubkey")
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstallPubkeyReadbackMismatch(t *testing.T) {
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	f.Expect(bootverifier.CmdStorePubkey).Reply(bootverifier.RspStorePubkey, tkeyclient.StatusOK)
+	expectGetPubkey(f, pubkeyOf(testKey))
+
+	if err := installPubkey(allowIdentityChange(newTKey(f, out)), pubkeyOf(otherTestKey)); err == nil {
+		t.Fatalf("installPubkey succeeded without the pubkey being stored")
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartVerifier(t *testing.T) {
+	defer func(bin []byte) { verifierBinary = bin }(verifierBinary)
+	verifierBinary = bytes.Repeat([]byte{0x13}, 1000)
+
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	expectCmdMode(f)
+	f.ExpectGetUDI(testUDI)
+	f.ExpectLoadApp(verifierBinary)
+	f.Expect(bootverifier.CmdSetPubkey).Reply(bootverifier.RspSetPubkey, tkeyclient.StatusOK)
+	f.Expect(bootverifier.CmdVerify).Drop()
+	f.ExpectReconnect()
+	f.ExpectGetNameVersion()
+	f.ExpectLoadApp(testApp)
+
+	o := &output{w: io.Discard}
+	if err := startVerifier(newTKey(f, o), pubkeyOf(testKey), testApp, signApp(testKey, testApp)); err != nil {
+		t.Fatalf("startVerifier: %v", err)
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if o.res.UDI != "04030:8:1:08070605" {
+		t.Errorf("expected the UDI, got %q", o.res.UDI)
+	}
+
+	reset := f.Written[2]
+	if bootverifier.FwResetType(reset[2]) != bootverifier.FwResetTypeStartClient {
+		t.Errorf("expected reset to START_CLIENT, got %v", bootverifier.FwResetType(reset[2]))
+	}
+}
+
+func TestStartVerifierIdentityChangeAllowed(t *testing.T) {
+	defer func(bin []byte) { verifierBinary = bin }(verifierBinary)
+	verifierBinary = bytes.Repeat([]byte{0x13}, 1000)
+
+	// Without pins and with identity change allowed there's no need
+	// for the pubkey on flash, so straight to the client.
+	f := fakedev.New()
+	expectCmdMode(f)
+	f.ExpectGetUDI(testUDI)
+	f.ExpectLoadApp(verifierBinary)
+	f.Expect(bootverifier.CmdSetPubkey).Reply(bootverifier.RspSetPubkey, tkeyclient.StatusOK)
+	f.Expect(bootverifier.CmdVerify).Drop()
+	f.ExpectReconnect()
+	f.ExpectGetNameVersion()
+	f.ExpectLoadApp(testApp)
+
+	if err := startVerifier(allowIdentityChange(newTKey(f, out)), pubkeyOf(testKey), testApp, signApp(testKey, testApp)); err != nil {
+		t.Fatalf("startVerifier: %v", err)
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	reset := f.Written[0]
+	if bootverifier.FwResetType(reset[2]) != bootverifier.FwResetTypeStartClient {
+		t.Errorf("expected reset to START_CLIENT, got %v", bootverifier.FwResetType(reset[2]))
+	}
+}
+
+func TestStartVerifierHalted(t *testing.T) {
+	defer func(bin []byte) { verifierBinary = bin }(verifierBinary)
+	verifierBinary = bytes.Repeat([]byte{0x13}, 1000)
+
+	// The verifier doesn't accept the signature and halts, leaving
+	// the port open.
+	f := fakedev.New()
+	expectCmdMode(f)
+	expectGetPubkey(f, pubkeyOf(testKey))
+	expectCmdMode(f)
+	f.ExpectGetUDI(testUDI)
+	f.ExpectLoadApp(verifierBinary)
+	f.Expect(bootverifier.CmdSetPubkey).Reply(bootverifier.RspSetPubkey, tkeyclient.StatusOK)
+	f.Expect(bootverifier.CmdVerify)
+
+	err := startVerifier(newTKey(f, out), pubkeyOf(testKey), testApp, signApp(testKey, testApp))
+	if !errors.Is(err, errHalted) || exitCode(err) != exitHalted {
+		t.Fatalf("expected halted, got %v", err)
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForResetPortStaysOpen(t *testing.T) {
+	// QEMU keeps the port when the TKey resets.
+	f := fakedev.New()
+	f.Expect(bootverifier.CmdReset)
+	tk := newTKey(f, out)
+
+	bv := bootverifier.New(tk)
+	if err := bv.Reset(bootverifier.FwResetTypeStartClient, bootverifier.VerifierResetDstCmdMode); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := waitForReset(tk); err != nil {
+		t.Fatalf("waitForReset: %v", err)
+	}
+
+	if tk.portCloses {
+		t.Errorf("expected port to be known not to close")
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartVerifierBadSignature(t *testing.T) {
+	f := fakedev.New()
+
+	if err := startVerifier(newTKey(f, out), pubkeyOf(otherTestKey), testApp, signApp(testKey, testApp)); err == nil {
+		t.Fatalf("startVerifier succeeded with app signed by another key")
+	}
+
+	if len(f.Written) != 0 {
+		t.Errorf("%d frames sent to device with bad signature", len(f.Written))
+	}
+}
+
+func TestEraseAll(t *testing.T) {
+	f := fakedev.New()
+	expectCmdMode(f)
+	f.Expect(bootverifier.CmdEraseAreas).Reply(bootverifier.RspEraseAreas, tkeyclient.StatusOK)
+
+	if err := eraseAll(newTKey(f, out)); err != nil {
+		t.Fatalf("eraseAll: %v", err)
+	}
+
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last timeout set before going back to none is the
+	// erase's, the ones before are from waiting for the reset.
+	eraseTimeout := f.Timeouts[len(f.Timeouts)-2]
+	if eraseTimeout < bootverifier.UserPresenceTimeout {
+		t.Errorf("read timeout %d s shorter than user presence timeout", eraseTimeout)
+	}
+}
@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// readUSSFile reads the USS passphrase in path, without a trailing
+// newline.
+func readUSSFile(path string) ([]byte, error) {
+	phrase, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file: %w", err)
+	}
+
+	phrase = bytes.TrimRight(phrase, "\r\n")
+	if len(phrase) == 0 {
+		return nil, fmt.Errorf("empty USS in %s", path)
+	}
+
+	return phrase, nil
+}
+
+// ussOf returns the USS firmware gets for phrase. LoadApp hashes it
+// the same way, like other TKey clients.
+func ussOf(phrase []byte) [32]byte {
+	return blake2s.Sum256(phrase)
+}
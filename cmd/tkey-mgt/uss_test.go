@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tkey-mgt/cdi"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+func TestBootUSS(t *testing.T) {
+	d, tr := newSim(t, testApp)
+	clientApp := bytes.Repeat([]byte{0x43}, 3000)
+
+	o := &output{w: io.Discard}
+	tk := newTKey(tr, o)
+	tk.uss = []byte("secret")
+
+	// Another identity than from flash, even with the same pubkey,
+	// so it has to be allowed. Refused before anything is sent.
+	err := startVerifier(tk, pubkeyOf(testKey), clientApp, signApp(testKey, clientApp))
+	if !errors.Is(err, errIdentityChange) || exitCode(err) != exitIdentityChange || len(d.Resets()) != 1 {
+		t.Fatalf("expected identity change refused, got %v", err)
+	}
+
+	if o.res.IdentityPreserved == nil || *o.res.IdentityPreserved {
+		t.Errorf("identity change not reported")
+	}
+
+	if err := startVerifier(allowIdentityChange(tk), pubkeyOf(testKey), clientApp, signApp(testKey, clientApp)); err != nil {
+		t.Fatalf("startVerifier: %v", err)
+	}
+
+	uss := ussOf(tk.uss)
+	c := cdi.Chain{Verifier: verifierBinary, VerifierUSS: &uss, Pubkey: pubkeyOf(testKey)}
+	if d.CDI() != c.AppCDI() {
+		t.Errorf("app got CDI %x, expected %x with the USS", d.CDI(), c.AppCDI())
+	}
+
+	c.VerifierUSS = nil
+	if d.CDI() == c.AppCDI() {
+		t.Errorf("app got the CDI without USS")
+	}
+}
+
+func TestReadUSSFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uss")
+	if err := os.WriteFile(path, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	phrase, err := readUSSFile(path)
+	if err != nil {
+		t.Fatalf("readUSSFile: %v", err)
+	}
+
+	// Hashed like LoadApp does, without the newline.
+	if ussOf(phrase) != blake2s.Sum256([]byte("secret")) {
+		t.Errorf("unexpected USS %x", ussOf(phrase))
+	}
+
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readUSSFile(path); err == nil {
+		t.Errorf("expected empty USS refused")
+	}
+}
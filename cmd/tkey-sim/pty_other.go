@@ -0,0 +1,24 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+type pty struct {
+	master *os.File
+	name   string
+}
+
+func openPTY() (*pty, error) {
+	return nil, errors.New("tkey-sim only runs on Linux")
+}
+
+func (p *pty) Close() error {
+	return nil
+}
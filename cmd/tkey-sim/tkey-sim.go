@@ -0,0 +1,276 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/sigfile"
+	"tkey-mgt/sim"
+)
+
+func usage() {
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s -verifier path [-app path -sig path] [-pub path] [-port path]\n\n", os.Args[0])
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Simulate a TKey with the boot verifier in slot 0 on a pseudo-terminal.\n")
+	_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Point tkey-mgt or testapp-probe to it with -port.\n\n")
+	flag.PrintDefaults()
+}
+
+var errPortGone = errors.New("serial port gone for good")
+
+// server connects a simulated TKey to a pty, and replaces the pty
+// every time the TKey resets.
+type server struct {
+	d          *sim.Device
+	link       string
+	pty        *pty
+	noClose    bool
+	resetDelay time.Duration
+	verbose    bool
+}
+
+func (s *server) logf(format string, a ...any) {
+	_, _ = fmt.Fprintf(os.Stderr, format, a...)
+}
+
+// attach opens a new pty and points the link to it.
+func (s *server) attach() error {
+	p, err := openPTY()
+	if err != nil {
+		return err
+	}
+
+	_ = os.Remove(s.link)
+	if err = os.Symlink(p.name, s.link); err != nil {
+		_ = p.Close()
+		return fmt.Errorf("symlink: %w", err)
+	}
+
+	s.pty = p
+	s.logf("TKey on %s (%s)\n", s.link, p.name)
+
+	return nil
+}
+
+// detach hangs up the pty and removes the link, like a TKey dropping
+// off USB.
+func (s *server) detach() {
+	_ = os.Remove(s.link)
+	_ = s.pty.Close()
+	s.pty = nil
+}
+
+// reset models the TKey's USB port going away and coming back for
+// each of the resets from index first in the device's reset log.
+// Between resets the port stays for a while, like while the verifier
+// checks slot 1 before resetting to start it.
+func (s *server) reset(first int) error {
+	resets := s.d.Resets()[first:]
+	for _, rst := range resets {
+		s.logf("reset: %v\n", rst.Type)
+	}
+	s.logf("now running %v\n", s.d.Mode())
+
+	if !s.d.PortUp() {
+		s.detach()
+		return errPortGone
+	}
+
+	if s.noClose {
+		return nil
+	}
+
+	// Let the client read anything sent before the reset.
+	time.Sleep(100 * time.Millisecond)
+
+	for i := range resets {
+		if i > 0 {
+			time.Sleep(s.resetDelay)
+		}
+
+		s.detach()
+		time.Sleep(s.resetDelay)
+
+		if err := s.attach(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *server) serve() error {
+	var rx []byte
+	buf := make([]byte, 256)
+
+	for {
+		n, err := s.pty.master.Read(buf)
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		rx = append(rx, buf[:n]...)
+
+		for len(rx) > 0 {
+			frameLen := 1
+			if hdr, err := bootverifier.ParseFramingHdr(rx[0]); err == nil {
+				frameLen += hdr.CmdLen.Bytelen()
+			}
+
+			if len(rx) < frameLen {
+				break
+			}
+
+			frame := rx[:frameLen]
+			rx = rx[frameLen:]
+
+			gen := s.d.PortGeneration()
+			nresets := len(s.d.Resets())
+			out := s.d.Write(frame)
+
+			if s.verbose {
+				s.logf("rx %x\ntx %x\n", frame, out)
+			}
+
+			if len(out) > 0 {
+				if _, err = s.pty.master.Write(out); err != nil {
+					return fmt.Errorf("write: %w", err)
+				}
+			}
+
+			if s.d.Mode() == sim.ModeHalted {
+				s.logf("halted: %s\n", s.d.HaltReason())
+			}
+
+			if s.d.PortGeneration() != gen {
+				rx = nil
+
+				if err = s.reset(nresets); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func main() {
+	verifierPath := flag.String("verifier", "", "Path to verifier binary in slot 0")
+	appPath := flag.String("app", "", "Path to app installed in slot 1")
+	sigPath := flag.String("sig", "", "Path to signature of app in slot 1")
+	pubPath := flag.String("pub", "", "Path to vendor pubkey installed on flash")
+	port := flag.String("port", "tkey-sim.pty", "Path of symlink to the simulated serial port")
+	udsHex := flag.String("uds", "", "UDS in hex, for computing CDIs. Default: all zeroes")
+	bootIntoCmd := flag.Bool("boot-into-cmd", false, "Simulate a verifier built with BOOT_INTO_WAIT_FOR_COMMAND")
+	proposed := flag.Bool("proposed", false, "Simulate a verifier with the proposed CMD_GET_METADATA")
+	noClose := flag.Bool("no-close", false, "Keep the serial port when the TKey resets, like QEMU")
+	resetDelay := flag.Duration("reset-delay", 500*time.Millisecond, "Time the serial port is gone during a reset")
+	verbose := flag.Bool("v", false, "Log every frame")
+
+	var faults sim.Faults
+	flag.IntVar(&faults.DropRx, "drop-rx", 0, "Lose the Nth frame from the client")
+	flag.IntVar(&faults.CorruptRx, "corrupt-rx", 0, "Corrupt the Nth frame from the client")
+	flag.IntVar(&faults.DropTx, "drop-tx", 0, "Lose the Nth frame from the TKey")
+	flag.IntVar(&faults.CorruptTx, "corrupt-tx", 0, "Corrupt the Nth frame from the TKey")
+	flag.IntVar(&faults.PortGoneAfterReset, "port-gone-after-reset", 0, "Never bring the serial port back after the Nth reset, counting power on")
+	flag.BoolVar(&faults.NoTouch, "no-touch", false, "Time out every wait for user presence")
+	flag.IntVar(&faults.BadChunk, "bad-chunk", 0, "Fail writing the Nth app chunk to flash")
+	flag.IntVar(&faults.HaltAtChunk, "halt-at-chunk", 0, "Halt the verifier at the Nth app chunk")
+	flag.Usage = usage
+
+	flag.Parse()
+
+	if *verifierPath == "" || (*appPath == "") != (*sigPath == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var cfg sim.Config
+	var err error
+
+	cfg.VerifierBinary, err = os.ReadFile(*verifierPath)
+	if err != nil {
+		fmt.Printf("couldn't read file: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *appPath != "" {
+		cfg.App, err = os.ReadFile(*appPath)
+		if err != nil {
+			fmt.Printf("couldn't read file: %v\n", err)
+			os.Exit(1)
+		}
+
+		appSig, err := sigfile.ReadSig(*sigPath)
+		if err != nil {
+			fmt.Printf("couldn't read file: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.AppSig = appSig.Sig
+	}
+
+	if *pubPath != "" {
+		appPub, err := sigfile.ReadKey(*pubPath)
+		if err != nil {
+			fmt.Printf("couldn't read file: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Pubkey = appPub.Key
+	}
+
+	if *udsHex != "" {
+		uds, err := hex.DecodeString(*udsHex)
+		if err != nil || len(uds) != len(cfg.UDS) {
+			fmt.Printf("invalid UDS, expected %d bytes in hex\n", len(cfg.UDS))
+			os.Exit(1)
+		}
+		copy(cfg.UDS[:], uds)
+	}
+
+	cfg.BootIntoWaitForCommand = *bootIntoCmd
+	cfg.Proposed = *proposed
+	cfg.Faults = faults
+
+	s := &server{
+		d:          sim.New(cfg),
+		link:       *port,
+		noClose:    *noClose,
+		resetDelay: *resetDelay,
+		verbose:    *verbose,
+	}
+
+	s.logf("powered on, running %v\n", s.d.Mode())
+
+	if err := s.attach(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		_ = os.Remove(s.link)
+		os.Exit(0)
+	}()
+
+	err = s.serve()
+	if errors.Is(err, errPortGone) {
+		// Like a TKey that never comes back, until unplugged.
+		s.logf("%v\n", err)
+		select {}
+	}
+
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		_ = os.Remove(s.link)
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -2,11 +2,14 @@ module tkey-mgt
 
 go 1.24.1
 
+require (
+	github.com/tillitis/tkeyclient v1.2.0
+	golang.org/x/crypto v0.40.0
+	golang.org/x/sys v0.34.0
+)
+
 require (
 	github.com/ccoveille/go-safecast v1.1.0 // indirect
 	github.com/creack/goselect v0.1.2 // indirect
-	github.com/tillitis/tkeyclient v1.2.0 // indirect
 	go.bug.st/serial v1.6.2 // indirect
-	golang.org/x/crypto v0.40.0 // indirect
-	golang.org/x/sys v0.34.0 // indirect
 )
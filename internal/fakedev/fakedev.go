@@ -0,0 +1,250 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package fakedev provides a bootverifier.Transport that plays back
+// scripted device responses, so client flows can be tested without
+// a TKey.
+//
+// A script is a list of expected events. Each written frame is
+// matched against the next expected command, and the replies of that
+// step are then returned by ReadFrame:
+//
+//	f := fakedev.New()
+//	f.Expect(bootverifier.CmdReset).Drop()
+//	f.ExpectReconnect()
+//	f.Expect(bootverifier.CmdGetPubkey).Reply(bootverifier.RspGetPubkey, tkeyclient.StatusOK, pubkey[:]...)
+package fakedev
+
+import (
+	"errors"
+	"fmt"
+
+	"tkey-mgt/bootverifier"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// ErrPortClosed is returned when reading from or writing to a port
+// the device has dropped, or that the client has closed.
+var ErrPortClosed = bootverifier.ErrPortClosed
+
+// ErrReadTimeout is returned by ReadFrame when there is nothing more
+// to read.
+var ErrReadTimeout = bootverifier.ErrTimeout
+
+type stepKind int
+
+const (
+	stepWrite stepKind = iota
+	stepReconnect
+)
+
+// Step is one expected event in a script.
+type Step struct {
+	kind    stepKind
+	cmd     tkeyclient.Cmd
+	replies [][]byte
+	drop    bool
+}
+
+// Reply adds a response frame with rsp's code and payload after it to
+// the step. The frame ID is the same as in the written frame.
+func (s *Step) Reply(rsp tkeyclient.Cmd, payload ...byte) *Step {
+	frame := make([]byte, 1+rsp.CmdLen().Bytelen())
+	frame[0] = byte(rsp.Endpoint())<<3 | byte(rsp.CmdLen())
+	frame[1] = rsp.Code()
+	copy(frame[2:], payload)
+
+	s.replies = append(s.replies, frame)
+
+	return s
+}
+
+// Drop makes the device drop the port after the step, like a TKey
+// does when it resets.
+func (s *Step) Drop() *Step {
+	s.drop = true
+
+	return s
+}
+
+// Transport is a bootverifier.Transport following a script.
+type Transport struct {
+	script  []*Step
+	pending [][]byte
+	closed  bool
+	dropped bool
+	err     error
+
+	// Written holds every frame written, in order.
+	Written [][]byte
+	// Timeouts holds every read timeout set, in order.
+	Timeouts []int
+}
+
+// New returns a Transport with an empty script.
+func New() *Transport {
+	return &Transport{}
+}
+
+// Expect adds a step expecting the client to write cmd.
+func (f *Transport) Expect(cmd tkeyclient.Cmd) *Step {
+	s := &Step{kind: stepWrite, cmd: cmd}
+	f.script = append(f.script, s)
+
+	return s
+}
+
+// ExpectReconnect adds a step expecting the client to reconnect.
+func (f *Transport) ExpectReconnect() *Step {
+	s := &Step{kind: stepReconnect}
+	f.script = append(f.script, s)
+
+	return s
+}
+
+// ExpectLoadApp adds the steps of firmware successfully loading and
+// starting bin.
+func (f *Transport) ExpectLoadApp(bin []byte) {
+	f.Expect(bootverifier.FwCmdLoadApp).Reply(bootverifier.FwRspLoadApp, tkeyclient.StatusOK)
+
+	digest := blake2s.Sum256(bin)
+	chunkLen := bootverifier.FwCmdLoadAppData.CmdLen().Bytelen() - 1
+
+	for offset := 0; offset < len(bin); offset += chunkLen {
+		s := f.Expect(bootverifier.FwCmdLoadAppData)
+		if len(bin)-offset <= chunkLen {
+			s.Reply(bootverifier.FwRspLoadAppDataReady, append([]byte{tkeyclient.StatusOK}, digest[:]...)...)
+		} else {
+			s.Reply(bootverifier.FwRspLoadAppData, tkeyclient.StatusOK)
+		}
+	}
+}
+
+// ExpectGetNameVersion adds the step of firmware answering a probe
+// for its name and version.
+func (f *Transport) ExpectGetNameVersion() {
+	f.Expect(bootverifier.FwCmdGetNameVersion).Reply(bootverifier.FwRspGetNameVersion, 't', 'k', '1', ' ', 'm', 'k', 'd', 'f', 6)
+}
+
+// ExpectGetUDI adds the step of firmware answering a request for the
+// UDI with udi, packed as by firmware.
+func (f *Transport) ExpectGetUDI(udi [8]byte) {
+	f.Expect(bootverifier.FwCmdGetUDI).Reply(bootverifier.FwRspGetUDI, append([]byte{tkeyclient.StatusOK}, udi[:]...)...)
+}
+
+// Err returns the first deviation from the script, or an error if
+// the script wasn't followed to the end.
+func (f *Transport) Err() error {
+	if f.err != nil {
+		return f.err
+	}
+
+	if len(f.script) != 0 {
+		return fmt.Errorf("%d steps left in script", len(f.script))
+	}
+
+	return nil
+}
+
+func (f *Transport) fail(format string, a ...any) error {
+	err := fmt.Errorf(format, a...)
+	if f.err == nil {
+		f.err = err
+	}
+
+	return err
+}
+
+func (f *Transport) next(kind stepKind) (*Step, error) {
+	if len(f.script) == 0 {
+		return nil, f.fail("unexpected event after end of script")
+	}
+
+	s := f.script[0]
+	if s.kind != kind {
+		return nil, f.fail("unexpected event, script expected kind %d, got %d", s.kind, kind)
+	}
+	f.script = f.script[1:]
+
+	return s, nil
+}
+
+func (f *Transport) Write(d []byte) error {
+	if f.closed || f.dropped {
+		return fmt.Errorf("Write: %w", ErrPortClosed)
+	}
+
+	f.Written = append(f.Written, d)
+
+	s, err := f.next(stepWrite)
+	if err != nil {
+		return err
+	}
+
+	if len(d) < 2 {
+		return f.fail("short frame written: %x", d)
+	}
+
+	endpoint := tkeyclient.Endpoint((d[0] & 0b0001_1000) >> 3)
+	if endpoint != s.cmd.Endpoint() || d[1] != s.cmd.Code() {
+		return f.fail("expected %v, got frame %x", s.cmd, d[:2])
+	}
+
+	id := (d[0] & 0b0110_0000)
+	for _, r := range s.replies {
+		r[0] |= id
+		f.pending = append(f.pending, r)
+	}
+
+	f.dropped = s.drop
+
+	return nil
+}
+
+func (f *Transport) ReadFrame(expectedResp tkeyclient.Cmd, expectedID int) ([]byte, tkeyclient.FramingHdr, error) {
+	if f.closed {
+		return nil, tkeyclient.FramingHdr{}, fmt.Errorf("Read: %w", ErrPortClosed)
+	}
+
+	if len(f.pending) == 0 {
+		if f.dropped {
+			return nil, tkeyclient.FramingHdr{}, fmt.Errorf("Read: %w", ErrPortClosed)
+		}
+
+		return nil, tkeyclient.FramingHdr{}, ErrReadTimeout
+	}
+
+	rx := f.pending[0]
+	f.pending = f.pending[1:]
+
+	hdr, err := bootverifier.CheckFrame(rx, expectedResp, expectedID)
+	if err != nil && !errors.Is(err, tkeyclient.ErrResponseStatusNotOK) {
+		return nil, hdr, err
+	}
+
+	return rx, hdr, err
+}
+
+func (f *Transport) SetReadTimeoutNoErr(seconds int) {
+	f.Timeouts = append(f.Timeouts, seconds)
+}
+
+func (f *Transport) Close() error {
+	f.closed = true
+
+	return nil
+}
+
+func (f *Transport) Reconnect() error {
+	if _, err := f.next(stepReconnect); err != nil {
+		return err
+	}
+
+	f.closed = false
+	f.dropped = false
+	f.pending = nil
+
+	return nil
+}
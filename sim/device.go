@@ -0,0 +1,437 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+// Package sim is a reference model of a Castor TKey running the boot
+// verifier. It models the parts of firmware the verifier depends on
+// (resets, loading apps from the client, the preloaded app slots)
+// and the verifier's state machine in verifier/main.c, frame by
+// frame.
+//
+// Connect a client to a Device with NewTransport:
+//
+//	d := sim.New(sim.Config{VerifierBinary: bin})
+//	bv := bootverifier.New(sim.NewTransport(d))
+//
+// A Device is not safe for concurrent use.
+package sim
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/cdi"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// AppMaxSize is TK1_APP_MAX_SIZE, the size of app slot 1 and of app
+// RAM.
+const AppMaxSize = tkeyclient.AppMaxSize
+
+// Config is the initial state of a simulated TKey.
+type Config struct {
+	// VerifierBinary is the verifier in app slot 0. Its digest is
+	// also what firmware expects in slot 0, and any app with the
+	// same digest loaded from the client runs the verifier model.
+	VerifierBinary []byte
+
+	// Pubkey is the vendor public key in the preload metadata.
+	Pubkey [ed25519.PublicKeySize]byte
+
+	// App is the app installed in slot 1, signed with AppSig.
+	// Leave empty for an empty slot.
+	App    []byte
+	AppSig [ed25519.SignatureSize]byte
+
+	// BootIntoWaitForCommand models a verifier built with
+	// BOOT_INTO_WAIT_FOR_COMMAND.
+	BootIntoWaitForCommand bool
+
+	// Proposed models a verifier with the protocol changes
+	// tkey-mgt supports but verifier/ doesn't have:
+	// CMD_GET_METADATA and distinct failure statuses, see the
+	// README. Without it the verifier halts on CMD_GET_METADATA
+	// and replies STATUS_BAD on any failure, like the one on TKeys
+	// today.
+	Proposed bool
+
+	// Touch is called for every touch the verifier waits for and
+	// returns whether the user touched before the timeout. If nil
+	// the user always touches.
+	Touch func() bool
+
+	// UDS is the Unique Device Secret used when computing CDIs.
+	UDS [32]byte
+
+	// UDI is the Unique Device Identifier firmware reports, as
+	// sent on the wire.
+	UDI [8]byte
+
+	// Faults to inject.
+	Faults Faults
+}
+
+// Mode is what a simulated TKey is currently running.
+type Mode int
+
+const (
+	// ModeFirmware is firmware waiting for an app from the client.
+	ModeFirmware Mode = iota
+	// ModeVerifier is the boot verifier.
+	ModeVerifier
+	// ModeApp is any other app. It is modelled as the test app
+	// in testapp/.
+	ModeApp
+	// ModeHalted is a TKey that has halted execution, typically
+	// after a failed assert.
+	ModeHalted
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeFirmware:
+		return "firmware"
+	case ModeVerifier:
+		return "verifier"
+	case ModeApp:
+		return "app"
+	case ModeHalted:
+		return "halted"
+	}
+
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// Sizes in struct reset, see tkey/syscall.h in tkey-libs.
+const (
+	ResetDigestSize = 32
+	ResetSeedSize   = 32
+	ResetDataSize   = 220
+)
+
+// ResetSeed is the RESET_SEED bit in Reset.Mask.
+const ResetSeed = 1 << 0
+
+// Reset is a struct reset passed to firmware by sys_reset.
+type Reset struct {
+	Type           bootverifier.FwResetType
+	Mask           uint32
+	AppDigest      [ResetDigestSize]byte
+	MeasuredIDSeed [ResetSeedSize]byte
+	NextAppData    [ResetDataSize]byte
+	// NextAppDataLen is the len argument to sys_reset.
+	NextAppDataLen int
+}
+
+// Device is a simulated TKey.
+type Device struct {
+	cfg Config
+
+	verifierDigest [blake2s.Size]byte
+
+	flash flash
+
+	mode Mode
+	// resetInfo is the reset that started the current app, or
+	// is waited on by firmware.
+	resetInfo Reset
+	// privileged is true when the running app was started from
+	// slot 0 and may use the preload syscalls.
+	privileged bool
+	appDigest  [blake2s.Size]byte
+	cdi        [32]byte
+
+	// measuredID is computed by firmware when an app resets with
+	// a seed and used for the next app's CDI if chained is set.
+	measuredID [32]byte
+	chained    bool
+
+	load     loadCtx
+	verifier verifierCtx
+
+	resets  []Reset
+	portGen int
+	halt    string
+
+	faults   Faults
+	counters faultCounters
+}
+
+// New returns a simulated TKey in cfg's initial state, powered on.
+func New(cfg Config) *Device {
+	d := &Device{
+		cfg:            cfg,
+		verifierDigest: blake2s.Sum256(cfg.VerifierBinary),
+		faults:         cfg.Faults,
+	}
+
+	d.flash.init(cfg)
+	d.start(Reset{Type: bootverifier.FwResetTypeStartDefault})
+
+	return d
+}
+
+// Mode returns what the TKey is running.
+func (d *Device) Mode() Mode {
+	return d.mode
+}
+
+// HaltReason returns why the TKey halted, or "" if it hasn't.
+func (d *Device) HaltReason() string {
+	return d.halt
+}
+
+// AppDigest returns the digest of the running app.
+func (d *Device) AppDigest() [blake2s.Size]byte {
+	return d.appDigest
+}
+
+// CDI returns the CDI firmware computed for the running app.
+func (d *Device) CDI() [32]byte {
+	return d.cdi
+}
+
+// Resets returns every reset requested from firmware, in order.
+func (d *Device) Resets() []Reset {
+	return d.resets
+}
+
+// Pubkey returns the vendor public key in the preload metadata.
+func (d *Device) Pubkey() [ed25519.PublicKeySize]byte {
+	return d.flash.pubkey
+}
+
+// Slot1 returns the app installed in slot 1, its digest and
+// signature from the preload metadata. The app is nil if slot 1 is
+// empty.
+func (d *Device) Slot1() ([]byte, [blake2s.Size]byte, [ed25519.SignatureSize]byte) {
+	return d.flash.app(), d.flash.digest, d.flash.sig
+}
+
+// AreasErased returns the number of times all app storage areas
+// have been erased.
+func (d *Device) AreasErased() int {
+	return d.flash.erasures
+}
+
+// PortGeneration is incremented every time the TKey drops its serial
+// port, that is on every reset.
+func (d *Device) PortGeneration() int {
+	return d.portGen
+}
+
+// Write handles a whole frame, header byte included, sent by the
+// client and returns whatever the TKey sends back.
+func (d *Device) Write(frame []byte) []byte {
+	frame = d.rxFault(frame)
+	if len(frame) == 0 {
+		return nil
+	}
+
+	return d.txFaults(d.handle(frame))
+}
+
+// handle is Write without faults.
+func (d *Device) handle(frame []byte) []byte {
+	hdr, err := bootverifier.ParseFramingHdr(frame[0])
+	if err != nil || len(frame) != 1+hdr.CmdLen.Bytelen() {
+		// Real firmware and apps get out of sync here.
+		d.halted(fmt.Sprintf("bad frame %x", frame))
+		return nil
+	}
+
+	cmd := frame[1:]
+
+	switch d.mode {
+	case ModeFirmware:
+		return d.firmwareCmd(hdr, cmd)
+
+	case ModeVerifier:
+		return d.verifierCmd(hdr, cmd)
+
+	case ModeApp:
+		return d.appCmd(hdr, cmd)
+	}
+
+	// Halted: nothing happens
+	return nil
+}
+
+// halted stops the TKey like a failed assert does. The port stays
+// open but nothing answers.
+func (d *Device) halted(reason string) {
+	d.mode = ModeHalted
+	d.halt = reason
+}
+
+// sysReset models the sys_reset syscall: firmware remembers rst and
+// the TKey resets, dropping the serial port.
+func (d *Device) sysReset(rst Reset, nextAppDataLen int) {
+	rst.NextAppDataLen = nextAppDataLen
+	d.resets = append(d.resets, rst)
+	d.portGen++
+
+	d.chained = rst.Mask&ResetSeed != 0
+	if d.chained {
+		d.measuredID = cdi.MeasuredID(d.cdi, rst.MeasuredIDSeed)
+	}
+
+	d.start(rst)
+}
+
+// start is firmware starting after a reset, with rst in the resetinfo
+// area.
+func (d *Device) start(rst Reset) {
+	d.resetInfo = rst
+	d.privileged = false
+	d.load = loadCtx{}
+	d.verifier = verifierCtx{}
+	d.appDigest = [blake2s.Size]byte{}
+	d.cdi = [32]byte{}
+	d.halt = ""
+
+	switch rst.Type {
+	case bootverifier.FwResetTypeStartDefault, bootverifier.FwResetTypeStartFlash0:
+		// Slot 0 is always checked against the digest in ROM.
+		d.startApp(d.cfg.VerifierBinary, true, false, [32]byte{})
+
+	case bootverifier.FwResetTypeStartFlash0Ver:
+		if rst.AppDigest != d.verifierDigest {
+			d.halted("slot 0 digest mismatch")
+			return
+		}
+		d.startApp(d.cfg.VerifierBinary, true, false, [32]byte{})
+
+	case bootverifier.FwResetTypeStartFlash1:
+		d.startApp(d.flash.app(), false, false, [32]byte{})
+
+	case bootverifier.FwResetTypeStartFlash1Ver:
+		app := d.flash.app()
+		if blake2s.Sum256(app) != rst.AppDigest {
+			d.halted("slot 1 digest mismatch")
+			return
+		}
+		d.startApp(app, false, false, [32]byte{})
+
+	case bootverifier.FwResetTypeStartClient, bootverifier.FwResetTypeStartClientVer:
+		d.mode = ModeFirmware
+
+	default:
+		d.halted(fmt.Sprintf("unknown reset type %d", rst.Type))
+	}
+}
+
+// startApp starts bin. privileged apps started from slot 0 may use
+// the preload syscalls. Apps loaded by the client may come with a
+// USS.
+func (d *Device) startApp(bin []byte, privileged bool, useUSS bool, uss [32]byte) {
+	d.appDigest = blake2s.Sum256(bin)
+	d.privileged = privileged
+
+	if d.chained {
+		d.cdi = cdi.Compute(d.cfg.UDS, true, d.measuredID, useUSS, uss)
+	} else {
+		d.cdi = cdi.Compute(d.cfg.UDS, false, d.appDigest, useUSS, uss)
+	}
+
+	if d.appDigest == d.verifierDigest {
+		d.mode = ModeVerifier
+		d.verifierStart()
+		return
+	}
+
+	d.mode = ModeApp
+}
+
+// Commands in the test app's protocol, see testapp/app_proto.h.
+var (
+	cmdGetCDI         = bootverifier.NewAppCmd(0x01, "cmdGetCDI", tkeyclient.CmdLen1)
+	rspGetCDI         = bootverifier.NewAppCmd(0x01, "rspGetCDI", tkeyclient.CmdLen128)
+	cmdGetNameVersion = bootverifier.NewAppCmd(0x02, "cmdGetNameVersion", tkeyclient.CmdLen1)
+	rspGetNameVersion = bootverifier.NewAppCmd(0x02, "rspGetNameVersion", tkeyclient.CmdLen32)
+)
+
+// Name and version reported by the simulated test app.
+var (
+	AppName0   = [4]byte{'t', 'k', '1', ' '}
+	AppName1   = [4]byte{'s', 'i', 'm', ' '}
+	AppVersion = uint32(0)
+)
+
+// appCmd models a device app that isn't the verifier, speaking the
+// same protocol as the test app in testapp/.
+func (d *Device) appCmd(hdr tkeyclient.FramingHdr, cmd []byte) []byte {
+	if hdr.Endpoint == tkeyclient.DestFW {
+		return replyNOK(hdr)
+	}
+
+	switch cmd[0] {
+	case cmdGetCDI.Code():
+		if hdr.CmdLen != cmdGetCDI.CmdLen() {
+			break
+		}
+
+		return reply(hdr, rspGetCDI, d.cdi[:]...)
+
+	case cmdGetNameVersion.Code():
+		if hdr.CmdLen != cmdGetNameVersion.CmdLen() {
+			break
+		}
+
+		rsp := make([]byte, 12)
+		copy(rsp[0:], AppName0[:])
+		copy(rsp[4:], AppName1[:])
+		binary.LittleEndian.PutUint32(rsp[8:], AppVersion)
+
+		return reply(hdr, rspGetNameVersion, rsp...)
+
+	case bootverifier.CmdReset.Code():
+		if hdr.CmdLen != bootverifier.CmdReset.CmdLen() {
+			break
+		}
+
+		d.appReset(cmd[1], cmd[2])
+
+		return nil
+	}
+
+	d.halted(fmt.Sprintf("app: unexpected command 0x%02x", cmd[0]))
+
+	return nil
+}
+
+// appReset is reset() in verifier/main.c and testapp/main.c.
+func (d *Device) appReset(resetType byte, resetDst byte) {
+	if resetDst > byte(bootverifier.VerifierResetDstCmdMode) {
+		d.halted(fmt.Sprintf("bad reset dst %d", resetDst))
+		return
+	}
+
+	if resetType > byte(bootverifier.FwResetTypeStartClientVer) {
+		d.halted(fmt.Sprintf("sys_reset failed, bad reset type %d", resetType))
+		return
+	}
+
+	rst := Reset{Type: bootverifier.FwResetType(resetType)}
+	rst.NextAppData[0] = resetDst
+
+	d.sysReset(rst, 1)
+}
+
+// reply builds an app reply frame like appreply() in the device apps.
+func reply(hdr tkeyclient.FramingHdr, rsp tkeyclient.Cmd, data ...byte) []byte {
+	frame := make([]byte, 1+rsp.CmdLen().Bytelen())
+	frame[0] = hdr.ID<<5 | byte(hdr.Endpoint)<<3 | byte(rsp.CmdLen())
+	frame[1] = rsp.Code()
+	copy(frame[2:], data)
+
+	return frame
+}
+
+// replyNOK builds a reply like appreply_nok().
+func replyNOK(hdr tkeyclient.FramingHdr) []byte {
+	return []byte{hdr.ID<<5 | byte(hdr.Endpoint)<<3 | 1<<2 | byte(tkeyclient.CmdLen1), 0}
+}
@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package sim
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"tkey-mgt/bootverifier"
+)
+
+// Faults are failures to inject into a simulated TKey. Frames,
+// resets and chunks are counted from 1 since power on, 0 means
+// never.
+type Faults struct {
+	// DropRx is the frame from the client that is lost on the
+	// way to the TKey.
+	DropRx int
+	// CorruptRx is the frame from the client that arrives with
+	// its command code flipped.
+	CorruptRx int
+	// DropTx is the frame from the TKey that is lost on the way
+	// to the client.
+	DropTx int
+	// CorruptTx is the frame from the TKey that arrives with its
+	// response code flipped.
+	CorruptTx int
+
+	// PortGoneAfterReset is the reset after which the serial port
+	// never comes back.
+	PortGoneAfterReset int
+
+	// NoTouch makes every wait for user presence time out.
+	NoTouch bool
+
+	// BadChunk is the CMD_UPDATE_APP_CHUNK for which writing to
+	// flash fails. The verifier answers STATUS_BAD and halts.
+	BadChunk int
+	// HaltAtChunk is the CMD_UPDATE_APP_CHUNK at which the
+	// verifier halts without answering, as if an assert failed.
+	HaltAtChunk int
+
+	// CorruptSig flips a bit of the app signature stored in slot 1
+	// when an install finishes, so that slot 1 doesn't verify.
+	CorruptSig bool
+}
+
+// faultCounters keeps count of what the faults refer to.
+type faultCounters struct {
+	rx     int
+	tx     int
+	chunks int
+}
+
+// PortUp returns false if the serial port has gone for good.
+func (d *Device) PortUp() bool {
+	return d.faults.PortGoneAfterReset == 0 || len(d.resets) < d.faults.PortGoneAfterReset
+}
+
+// rxFault applies faults to a frame from the client. It returns nil
+// if the frame is lost.
+func (d *Device) rxFault(frame []byte) []byte {
+	d.counters.rx++
+
+	switch d.counters.rx {
+	case d.faults.DropRx:
+		return nil
+
+	case d.faults.CorruptRx:
+		frame = append([]byte{}, frame...)
+		if len(frame) > 1 {
+			frame[1] ^= 0xff
+		}
+	}
+
+	return frame
+}
+
+// txFaults applies faults to the frames in out, sent by the TKey.
+func (d *Device) txFaults(out []byte) []byte {
+	var faulty []byte
+
+	for len(out) > 0 {
+		n := 1
+		if hdr, err := bootverifier.ParseFramingHdr(out[0]); err == nil {
+			n += hdr.CmdLen.Bytelen()
+		}
+		n = min(n, len(out))
+
+		frame := append([]byte{}, out[:n]...)
+		out = out[n:]
+
+		d.counters.tx++
+
+		switch d.counters.tx {
+		case d.faults.DropTx:
+			continue
+
+		case d.faults.CorruptTx:
+			if len(frame) > 1 {
+				frame[1] ^= 0xff
+			}
+		}
+
+		faulty = append(faulty, frame...)
+	}
+
+	return faulty
+}
+
+// chunkFault returns an error if writing the current chunk should
+// fail, and halts the TKey if it should halt.
+func (d *Device) chunkFault() (bool, error) {
+	d.counters.chunks++
+
+	switch d.counters.chunks {
+	case d.faults.HaltAtChunk:
+		d.halted(fmt.Sprintf("injected halt at chunk %d", d.counters.chunks))
+		return true, nil
+
+	case d.faults.BadChunk:
+		return false, fmt.Errorf("injected flash write failure at chunk %d", d.counters.chunks)
+	}
+
+	return false, nil
+}
+
+// sigFault returns the app signature to store in slot 1.
+func (d *Device) sigFault(sig [ed25519.SignatureSize]byte) [ed25519.SignatureSize]byte {
+	if d.faults.CorruptSig {
+		sig[0] ^= 0x01
+	}
+
+	return sig
+}
@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package sim
+
+import (
+	"encoding/binary"
+
+	"tkey-mgt/bootverifier"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// Name and version reported by the simulated firmware.
+var (
+	FwName0   = [4]byte{'t', 'k', '1', ' '}
+	FwName1   = [4]byte{'m', 'k', 'd', 'f'}
+	FwVersion = uint32(6)
+)
+
+// loadCtx is firmware's state while loading an app from the client.
+type loadCtx struct {
+	size   int
+	useUSS bool
+	uss    [32]byte
+	bin    []byte
+}
+
+// firmwareCmd handles a command sent to firmware waiting for an app
+// from the client.
+func (d *Device) firmwareCmd(hdr tkeyclient.FramingHdr, cmd []byte) []byte {
+	if hdr.Endpoint != tkeyclient.DestFW {
+		return replyNOK(hdr)
+	}
+
+	switch cmd[0] {
+	case bootverifier.FwCmdGetNameVersion.Code():
+		rsp := make([]byte, 12)
+		copy(rsp[0:], FwName0[:])
+		copy(rsp[4:], FwName1[:])
+		binary.LittleEndian.PutUint32(rsp[8:], FwVersion)
+
+		return reply(hdr, bootverifier.FwRspGetNameVersion, rsp...)
+
+	case bootverifier.FwCmdGetUDI.Code():
+		return reply(hdr, bootverifier.FwRspGetUDI, append([]byte{tkeyclient.StatusOK}, d.cfg.UDI[:]...)...)
+
+	case bootverifier.FwCmdLoadApp.Code():
+		if hdr.CmdLen != bootverifier.FwCmdLoadApp.CmdLen() {
+			return replyNOK(hdr)
+		}
+
+		size := int(binary.LittleEndian.Uint32(cmd[1:5]))
+		if size == 0 || size > AppMaxSize {
+			return reply(hdr, bootverifier.FwRspLoadApp, tkeyclient.StatusBad)
+		}
+
+		d.load = loadCtx{size: size, useUSS: cmd[5] != 0}
+		copy(d.load.uss[:], cmd[6:])
+
+		return reply(hdr, bootverifier.FwRspLoadApp, tkeyclient.StatusOK)
+
+	case bootverifier.FwCmdLoadAppData.Code():
+		if hdr.CmdLen != bootverifier.FwCmdLoadAppData.CmdLen() || d.load.size == 0 {
+			return replyNOK(hdr)
+		}
+
+		n := min(d.load.size-len(d.load.bin), len(cmd)-1)
+		d.load.bin = append(d.load.bin, cmd[1:1+n]...)
+
+		if len(d.load.bin) < d.load.size {
+			return reply(hdr, bootverifier.FwRspLoadAppData, tkeyclient.StatusOK)
+		}
+
+		digest := blake2s.Sum256(d.load.bin)
+		rsp := reply(hdr, bootverifier.FwRspLoadAppDataReady, append([]byte{tkeyclient.StatusOK}, digest[:]...)...)
+
+		if d.resetInfo.Type == bootverifier.FwResetTypeStartClientVer && digest != d.resetInfo.AppDigest {
+			d.halted("client app digest mismatch")
+			return rsp
+		}
+
+		d.startApp(d.load.bin, false, d.load.useUSS, d.load.uss)
+
+		return rsp
+	}
+
+	return replyNOK(hdr)
+}
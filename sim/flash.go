@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package sim
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+var errNotPrivileged = errors.New("syscall only allowed from app slot 0")
+
+// flash is app slot 1 and its preload metadata.
+type flash struct {
+	pubkey [ed25519.PublicKeySize]byte
+	slot1  [AppMaxSize]byte
+	size   int
+	digest [blake2s.Size]byte
+	sig    [ed25519.SignatureSize]byte
+
+	erasures int
+}
+
+func (f *flash) init(cfg Config) {
+	f.pubkey = cfg.Pubkey
+	f.delete()
+
+	if len(cfg.App) > 0 {
+		copy(f.slot1[:], cfg.App)
+		f.size = len(cfg.App)
+		f.digest = blake2s.Sum256(cfg.App)
+		f.sig = cfg.AppSig
+	}
+}
+
+// app returns a copy of the app in slot 1, or nil if it is empty.
+func (f *flash) app() []byte {
+	if f.size == 0 {
+		return nil
+	}
+
+	return append([]byte{}, f.slot1[:f.size]...)
+}
+
+// delete is sys_preload_delete: slot 1 is erased and its metadata,
+// except the pubkey, cleared.
+func (f *flash) delete() {
+	for i := range f.slot1 {
+		f.slot1[i] = 0xff
+	}
+
+	f.size = 0
+	f.digest = [blake2s.Size]byte{}
+	f.sig = [ed25519.SignatureSize]byte{}
+}
+
+// store is sys_preload_store. Programming flash can only clear bits,
+// which is why write_app() pads with 0xff.
+func (f *flash) store(offset int, data []byte) error {
+	if offset < 0 || offset+len(data) > len(f.slot1) {
+		return errors.New("write outside slot 1")
+	}
+
+	for i, b := range data {
+		f.slot1[offset+i] &= b
+	}
+
+	return nil
+}
+
+// storeFin is sys_preload_store_fin.
+func (f *flash) storeFin(size int, digest [blake2s.Size]byte, sig [ed25519.SignatureSize]byte) error {
+	if size == 0 || size > len(f.slot1) {
+		return errors.New("bad app size")
+	}
+
+	f.size = size
+	f.digest = digest
+	f.sig = sig
+
+	return nil
+}
@@ -0,0 +1,319 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package sim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"tkey-mgt/bootverifier"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+var (
+	testVerifier = bytes.Repeat([]byte("verifier"), 100)
+	testKey      = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x01}, ed25519.SeedSize))
+	testPubkey   = [ed25519.PublicKeySize]byte(testKey.Public().(ed25519.PublicKey))
+)
+
+func testApp(size int) []byte {
+	bin := make([]byte, size)
+	for i := range bin {
+		bin[i] = byte(i*7 + i>>8)
+	}
+
+	return bin
+}
+
+func sign(bin []byte) [ed25519.SignatureSize]byte {
+	digest := blake2s.Sum256(bin)
+
+	return [ed25519.SignatureSize]byte(ed25519.Sign(testKey, digest[:]))
+}
+
+func TestColdBootVerifiesSlot1(t *testing.T) {
+	app := testApp(1000)
+	d := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, App: app, AppSig: sign(app)})
+
+	if d.Mode() != ModeApp || d.AppDigest() != blake2s.Sum256(app) {
+		t.Fatalf("expected app in slot 1 running, got %v", d.Mode())
+	}
+
+	resets := d.Resets()
+	if len(resets) != 1 {
+		t.Fatalf("expected 1 reset, got %d", len(resets))
+	}
+
+	rst := resets[0]
+	if rst.Type != bootverifier.FwResetTypeStartFlash1Ver || rst.Mask != ResetSeed ||
+		rst.AppDigest != blake2s.Sum256(app) || rst.MeasuredIDSeed != blake2s.Sum256(testPubkey[:]) ||
+		rst.NextAppDataLen != 0 {
+		t.Errorf("unexpected reset %+v", rst)
+	}
+}
+
+func TestColdBootBadSignature(t *testing.T) {
+	app := testApp(1000)
+	d := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, App: app, AppSig: sign(app[1:])})
+
+	if d.Mode() != ModeVerifier || d.VerifierState() != StateWaitForCommand {
+		t.Fatalf("expected verifier in command mode, got %v %v", d.Mode(), d.VerifierState())
+	}
+
+	if len(d.Resets()) != 0 {
+		t.Errorf("unexpected reset")
+	}
+}
+
+func TestInstallUnaligned(t *testing.T) {
+	for _, size := range []int{1, 127, 128, 255, 256, 257, 1000, AppMaxSize} {
+		d := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, BootIntoWaitForCommand: true})
+		tr := NewTransport(d)
+		bv := bootverifier.New(tr)
+
+		app := testApp(size)
+		if err := bv.UpdateAppInit(len(app), blake2s.Sum256(app), sign(app)); err != nil {
+			t.Fatalf("size %d: UpdateAppInit: %v", size, err)
+		}
+
+		for offset := 0; offset < len(app); offset += bootverifier.ChunkSize {
+			if err := bv.WriteChunk(app[offset:min(offset+bootverifier.ChunkSize, len(app))]); err != nil {
+				t.Fatalf("size %d: WriteChunk at %d: %v", size, offset, err)
+			}
+		}
+
+		installed, _, _ := d.Slot1()
+		if !bytes.Equal(installed, app) {
+			t.Errorf("size %d: installed app differs", size)
+		}
+
+		rst := d.Resets()[0]
+		if rst.Type != bootverifier.FwResetTypeStartDefault || rst.NextAppData[0] != byte(bootverifier.VerifierResetDstApp1) {
+			t.Errorf("size %d: unexpected reset after install %+v", size, rst)
+		}
+
+		// Verifier with BOOT_INTO_WAIT_FOR_COMMAND never boots slot 1.
+		if d.Mode() != ModeVerifier {
+			t.Errorf("size %d: expected verifier after reset, got %v", size, d.Mode())
+		}
+	}
+}
+
+func TestTouchTimeout(t *testing.T) {
+	for _, proposed := range []bool{false, true} {
+		d := New(Config{VerifierBinary: testVerifier, BootIntoWaitForCommand: true, Proposed: proposed, Touch: func() bool { return false }})
+		bv := bootverifier.New(NewTransport(d))
+
+		// The verifier in verifier/ only has STATUS_BAD.
+		err := bv.StorePubkey(testPubkey)
+		if !errors.Is(err, bootverifier.ErrStatus) || errors.Is(err, bootverifier.ErrNoTouch) != proposed {
+			t.Fatalf("proposed %v: unexpected error %v", proposed, err)
+		}
+
+		if d.Pubkey() != [ed25519.PublicKeySize]byte{} || d.VerifierState() != StateWaitForCommand {
+			t.Errorf("proposed %v: state changed without touch", proposed)
+		}
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	d := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, BootIntoWaitForCommand: true, Proposed: true})
+	bv := bootverifier.New(NewTransport(d))
+
+	// Refused before asking for touch.
+	app := testApp(AppMaxSize + 1)
+	if err := bv.UpdateAppInit(len(app), blake2s.Sum256(app), sign(app)); !errors.Is(err, bootverifier.ErrInvalidSize) {
+		t.Errorf("expected invalid size, got %v", err)
+	}
+
+	if err := bv.WriteChunk([]byte{1, 2, 3}); !errors.Is(err, bootverifier.ErrBadState) {
+		t.Errorf("expected bad state for chunk without install, got %v", err)
+	}
+
+	app = testApp(1000)
+	if err := bv.UpdateAppInit(len(app), blake2s.Sum256(app), sign(app)); err != nil {
+		t.Fatalf("UpdateAppInit: %v", err)
+	}
+
+	if err := bv.EraseAreas(); !errors.Is(err, bootverifier.ErrBadState) {
+		t.Errorf("expected bad state for erase during install, got %v", err)
+	}
+
+	// The install goes on.
+	if err := bv.WriteChunk(app[:bootverifier.ChunkSize]); err != nil {
+		t.Errorf("WriteChunk: %v", err)
+	}
+
+	if d.Mode() != ModeVerifier || d.VerifierState() != StateWaitForAppChunk {
+		t.Errorf("expected verifier waiting for chunks, got %v %v", d.Mode(), d.VerifierState())
+	}
+}
+
+func TestStatusBad(t *testing.T) {
+	// The verifier in verifier/ asks for touch first and then
+	// halts on a bad size.
+	touches := 0
+	d := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, BootIntoWaitForCommand: true, Touch: func() bool {
+		touches++
+		return true
+	}})
+	bv := bootverifier.New(NewTransport(d))
+
+	app := testApp(AppMaxSize + 1)
+	err := bv.UpdateAppInit(len(app), blake2s.Sum256(app), sign(app))
+
+	var statusErr *bootverifier.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != bootverifier.StatusBad {
+		t.Errorf("expected STATUS_BAD, got %v", err)
+	}
+
+	if touches != 3 || d.Mode() != ModeHalted {
+		t.Errorf("expected halt after touch, got %d touches and %v", touches, d.Mode())
+	}
+
+	// And halts on a chunk without an install.
+	d = New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, BootIntoWaitForCommand: true})
+	bv = bootverifier.New(NewTransport(d))
+
+	if err := bv.WriteChunk([]byte{1, 2, 3}); !errors.Is(err, bootverifier.ErrTimeout) || d.Mode() != ModeHalted {
+		t.Errorf("expected halt, got %v and %v", err, d.Mode())
+	}
+}
+
+func TestClientVerifierIsUnprivileged(t *testing.T) {
+	d := New(Config{VerifierBinary: testVerifier})
+	tr := NewTransport(d)
+	bv := bootverifier.New(tr)
+
+	if err := bv.Reset(bootverifier.FwResetTypeStartClient, bootverifier.VerifierResetDstCmdMode); err != nil {
+		t.Fatal(err)
+	}
+	_ = tr.Reconnect()
+
+	if err := bootverifier.LoadApp(tr, testVerifier, nil); err != nil {
+		t.Fatalf("LoadApp: %v", err)
+	}
+
+	if d.Mode() != ModeVerifier || d.VerifierState() != StateWaitForCommand {
+		t.Fatalf("expected verifier in command mode, got %v %v", d.Mode(), d.VerifierState())
+	}
+
+	if _, err := bv.GetPubkey(); err == nil {
+		t.Fatalf("GetPubkey succeeded from client loaded verifier")
+	}
+
+	if d.Mode() != ModeHalted {
+		t.Errorf("expected halt, got %v", d.Mode())
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	app := testApp(1000)
+	d := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, App: app, AppSig: sign(app), BootIntoWaitForCommand: true, Proposed: true})
+	bv := bootverifier.New(NewTransport(d))
+
+	digest, sig, err := bv.GetMetadata()
+	if err != nil {
+		t.Fatalf("GetMetadata: %v", err)
+	}
+
+	if digest != blake2s.Sum256(app) || sig != sign(app) {
+		t.Errorf("unexpected metadata %x %x", digest, sig)
+	}
+
+	if d.VerifierState() != StateWaitForCommand {
+		t.Errorf("expected verifier in command mode, got %v", d.VerifierState())
+	}
+
+	// The verifier in verifier/ doesn't have the command.
+	d = New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, App: app, AppSig: sign(app), BootIntoWaitForCommand: true})
+	bv = bootverifier.New(NewTransport(d))
+
+	if _, _, err := bv.GetMetadata(); !errors.Is(err, bootverifier.ErrTimeout) {
+		t.Errorf("expected no answer, got %v", err)
+	}
+
+	if d.Mode() != ModeHalted {
+		t.Errorf("expected halt, got %v", d.Mode())
+	}
+}
+
+func TestGetUDI(t *testing.T) {
+	udi := [8]byte{0x08, 0x37, 0x01, 0x00, 0x11, 0x00, 0x00, 0x00}
+	d := New(Config{VerifierBinary: testVerifier, UDI: udi})
+	tr := NewTransport(d)
+	bv := bootverifier.New(tr)
+
+	if err := bv.Reset(bootverifier.FwResetTypeStartClient, bootverifier.VerifierResetDstCmdMode); err != nil {
+		t.Fatal(err)
+	}
+	_ = tr.Reconnect()
+
+	got, err := bootverifier.GetUDI(tr)
+	if err != nil {
+		t.Fatalf("GetUDI: %v", err)
+	}
+
+	if !bytes.Equal(got.RawBytes(), udi[:]) {
+		t.Errorf("expected UDI %x, got %x", udi, got.RawBytes())
+	}
+}
+
+func TestFirmwareProbeHaltsCommandMode(t *testing.T) {
+	d := New(Config{VerifierBinary: testVerifier, BootIntoWaitForCommand: true})
+	tr := NewTransport(d)
+
+	tx, _ := tkeyclient.NewFrameBuf(bootverifier.FwCmdGetNameVersion, 2)
+	if err := tr.Write(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := tr.ReadFrame(bootverifier.FwRspGetNameVersion, 2); err != tkeyclient.ErrResponseStatusNotOK {
+		t.Errorf("expected NOK, got %v", err)
+	}
+
+	if d.Mode() != ModeHalted {
+		t.Errorf("expected halt, got %v", d.Mode())
+	}
+}
+
+func TestCDIFollowsVendorKey(t *testing.T) {
+	uds := [32]byte{1, 2, 3}
+	appA := testApp(1000)
+	appB := testApp(2000)
+
+	a := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, App: appA, AppSig: sign(appA), UDS: uds})
+	b := New(Config{VerifierBinary: testVerifier, Pubkey: testPubkey, App: appB, AppSig: sign(appB), UDS: uds})
+
+	if a.Mode() != ModeApp || b.Mode() != ModeApp {
+		t.Fatalf("expected apps running")
+	}
+
+	// Updating the app under the same vendor key keeps the CDI.
+	if a.CDI() != b.CDI() {
+		t.Errorf("CDI changed with app")
+	}
+
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x02}, ed25519.SeedSize))
+	digest := blake2s.Sum256(appA)
+	c := New(Config{
+		VerifierBinary: testVerifier,
+		Pubkey:         [ed25519.PublicKeySize]byte(otherKey.Public().(ed25519.PublicKey)),
+		App:            appA,
+		AppSig:         [ed25519.SignatureSize]byte(ed25519.Sign(otherKey, digest[:])),
+		UDS:            uds,
+	})
+
+	if c.Mode() != ModeApp {
+		t.Fatalf("expected app running")
+	}
+
+	if a.CDI() == c.CDI() {
+		t.Errorf("CDI unchanged with other vendor key")
+	}
+}
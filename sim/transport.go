@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package sim
+
+import (
+	"errors"
+	"fmt"
+
+	"tkey-mgt/bootverifier"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// ErrPortClosed is returned when using a serial port the TKey has
+// dropped by resetting, or that the client has closed.
+var ErrPortClosed = bootverifier.ErrPortClosed
+
+// ErrReadTimeout is returned by ReadFrame when the TKey has nothing
+// to say. Time doesn't pass in the simulation so this happens
+// immediately.
+var ErrReadTimeout = bootverifier.ErrTimeout
+
+// Transport is a bootverifier.Transport connected to a simulated
+// TKey.
+type Transport struct {
+	// KeepPort keeps the serial port when the TKey resets, like
+	// QEMU does.
+	KeepPort bool
+
+	d      *Device
+	gen    int
+	closed bool
+	rx     []byte
+}
+
+// NewTransport returns a Transport connected to d.
+func NewTransport(d *Device) *Transport {
+	return &Transport{d: d, gen: d.PortGeneration()}
+}
+
+// dropped returns true if the TKey has reset since we connected.
+func (t *Transport) dropped() bool {
+	return !t.KeepPort && t.gen != t.d.PortGeneration()
+}
+
+func (t *Transport) Write(d []byte) error {
+	if t.closed || t.dropped() {
+		return fmt.Errorf("Write: %w", ErrPortClosed)
+	}
+
+	t.rx = append(t.rx, t.d.Write(d)...)
+
+	return nil
+}
+
+func (t *Transport) ReadFrame(expectedResp tkeyclient.Cmd, expectedID int) ([]byte, tkeyclient.FramingHdr, error) {
+	if t.closed {
+		return nil, tkeyclient.FramingHdr{}, fmt.Errorf("Read: %w", ErrPortClosed)
+	}
+
+	// Anything sent before a reset can still be read.
+	if len(t.rx) == 0 {
+		if t.dropped() {
+			return nil, tkeyclient.FramingHdr{}, fmt.Errorf("Read: %w", ErrPortClosed)
+		}
+
+		return nil, tkeyclient.FramingHdr{}, ErrReadTimeout
+	}
+
+	hdr, err := bootverifier.ParseFramingHdr(t.rx[0])
+	if err != nil {
+		t.rx = nil
+		return nil, hdr, fmt.Errorf("Couldn't parse framing header: %w", err)
+	}
+
+	n := min(1+hdr.CmdLen.Bytelen(), len(t.rx))
+	rx := t.rx[:n]
+	t.rx = t.rx[n:]
+
+	hdr, err = bootverifier.CheckFrame(rx, expectedResp, expectedID)
+	if err != nil && !errors.Is(err, tkeyclient.ErrResponseStatusNotOK) {
+		return nil, hdr, err
+	}
+
+	return rx, hdr, err
+}
+
+func (t *Transport) SetReadTimeoutNoErr(seconds int) {
+}
+
+func (t *Transport) Close() error {
+	t.closed = true
+	t.rx = nil
+
+	return nil
+}
+
+// Reconnect connects to the TKey again after it has reset. The client
+// sees every reset: after several, like the verifier resetting to
+// start slot 1, the port drops once more for each of the rest.
+func (t *Transport) Reconnect() error {
+	if !t.d.PortUp() {
+		return fmt.Errorf("couldn't find any TKeys: %w", bootverifier.ErrNoDevice)
+	}
+
+	t.gen++
+	t.closed = false
+	t.rx = nil
+
+	return nil
+}
@@ -0,0 +1,483 @@
+// SPDX-FileCopyrightText: 2025 Tillitis AB <tillitis.se>
+// SPDX-License-Identifier: BSD-2-Clause
+
+package sim
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"tkey-mgt/bootverifier"
+	"tkey-mgt/cdi"
+
+	"github.com/tillitis/tkeyclient"
+	"golang.org/x/crypto/blake2s"
+)
+
+// VerifierState is the state of the verifier's main loop, enum state
+// in verifier/main.c.
+type VerifierState int
+
+const (
+	StateStarted VerifierState = iota
+	StateVerifyFlash
+	StateWaitForCommand
+	StateWaitForAppChunk
+)
+
+func (s VerifierState) String() string {
+	switch s {
+	case StateStarted:
+		return "STATE_STARTED"
+	case StateVerifyFlash:
+		return "STATE_VERIFY_FLASH"
+	case StateWaitForCommand:
+		return "STATE_WAIT_FOR_COMMAND"
+	case StateWaitForAppChunk:
+		return "STATE_WAIT_FOR_APP_CHUNK"
+	}
+
+	return fmt.Sprintf("VerifierState(%d)", int(s))
+}
+
+// cmdFwProbe is what read_command() returns after answering a frame
+// meant for firmware.
+const cmdFwProbe = 0xff
+
+// writeSize is WRITE_SIZE in verifier/update.c.
+const writeSize = 256
+
+// verifierCtx is struct context in verifier/main.c and the state of
+// the main loop.
+type verifierCtx struct {
+	state VerifierState
+
+	// update_ctx
+	uploadSize   int
+	uploadOffset int
+	appDigest    [blake2s.Size]byte
+	appSignature [ed25519.SignatureSize]byte
+
+	// vendor_ctx
+	pubkey    [ed25519.PublicKeySize]byte
+	pubkeySet bool
+}
+
+// VerifierState returns the state of the verifier's main loop. It is
+// only meaningful when Mode is ModeVerifier.
+func (d *Device) VerifierState() VerifierState {
+	return d.verifier.state
+}
+
+// verifierStart runs the verifier's main loop from the start until
+// it needs input from the client.
+func (d *Device) verifierStart() {
+	d.verifier.state = StateStarted
+	if d.cfg.BootIntoWaitForCommand {
+		d.verifier.state = StateWaitForCommand
+	}
+
+	if d.verifier.state == StateStarted {
+		// started()
+		if bootverifier.ResetDst(d.resetInfo.NextAppData[0]) == bootverifier.VerifierResetDstCmdMode {
+			d.verifier.state = StateWaitForCommand
+		} else {
+			d.verifier.state = StateVerifyFlash
+		}
+	}
+
+	if d.verifier.state == StateVerifyFlash {
+		if !d.privileged {
+			d.halted("sys_preload_get_metadata failed")
+			return
+		}
+
+		if d.resetIfVerified(d.flash.pubkey, bootverifier.FwResetTypeStartFlash1Ver, d.flash.digest, d.flash.sig) {
+			return
+		}
+
+		// signal_issue()
+		d.verifier.state = StateWaitForCommand
+	}
+}
+
+// resetIfVerified is reset_if_verified(). It returns true if the
+// signature verified and the TKey was reset.
+func (d *Device) resetIfVerified(pubkey [ed25519.PublicKeySize]byte, resetType bootverifier.FwResetType, digest [blake2s.Size]byte, sig [ed25519.SignatureSize]byte) bool {
+	if !ed25519.Verify(pubkey[:], digest[:], sig[:]) {
+		return false
+	}
+
+	rst := Reset{
+		Type:           resetType,
+		Mask:           ResetSeed,
+		MeasuredIDSeed: cdi.MeasuredIDSeed(pubkey),
+		AppDigest:      digest,
+	}
+
+	d.sysReset(rst, 0)
+
+	return true
+}
+
+// userIsPresent is user_is_present(): three touches, each within the
+// timeout.
+func (d *Device) userIsPresent() bool {
+	if d.faults.NoTouch {
+		return false
+	}
+
+	for i := 0; i < 3; i++ {
+		if d.cfg.Touch != nil && !d.cfg.Touch() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifierCmd handles a frame sent to the verifier, like
+// read_command() followed by one turn of the main loop.
+func (d *Device) verifierCmd(hdr tkeyclient.FramingHdr, cmd []byte) []byte {
+	var out []byte
+
+	if hdr.Endpoint == tkeyclient.DestFW {
+		out = replyNOK(hdr)
+		cmd = []byte{cmdFwProbe}
+	} else if hdr.Endpoint != tkeyclient.DestApp {
+		d.halted("read_command: message not meant for app")
+		return nil
+	}
+
+	switch d.verifier.state {
+	case StateWaitForCommand:
+		return append(out, d.waitForCommand(hdr, cmd)...)
+
+	case StateWaitForAppChunk:
+		return append(out, d.waitForAppChunk(hdr, cmd)...)
+	}
+
+	d.halted(fmt.Sprintf("input in %v", d.verifier.state))
+
+	return out
+}
+
+// waitForCommand is wait_for_command().
+func (d *Device) waitForCommand(hdr tkeyclient.FramingHdr, cmd []byte) []byte {
+	cmdLen := hdr.CmdLen.Bytelen()
+
+	switch cmd[0] {
+	case bootverifier.CmdEraseAreas.Code():
+		if cmdLen != 1 {
+			d.halted("CMD_ERASE_AREAS: bad length")
+			return nil
+		}
+
+		if !d.userIsPresent() {
+			return reply(hdr, bootverifier.RspEraseAreas, d.status(bootverifier.StatusPresenceTimeout))
+		}
+
+		if !d.privileged {
+			d.halted("sys_erase_areas failed")
+			return reply(hdr, bootverifier.RspEraseAreas, d.status(bootverifier.StatusFlashFailed))
+		}
+
+		d.flash.erasures++
+
+		return reply(hdr, bootverifier.RspEraseAreas, tkeyclient.StatusOK)
+
+	case bootverifier.CmdGetPubkey.Code():
+		if cmdLen != 1 {
+			d.halted("CMD_GET_PUBKEY: bad length")
+			return nil
+		}
+
+		if !d.privileged {
+			d.halted("sys_preload_get_metadata failed")
+			return reply(hdr, bootverifier.RspGetPubkey, d.status(bootverifier.StatusFlashFailed))
+		}
+
+		return reply(hdr, bootverifier.RspGetPubkey, append([]byte{tkeyclient.StatusOK}, d.flash.pubkey[:]...)...)
+
+	case bootverifier.CmdGetMetadata.Code():
+		if !d.cfg.Proposed {
+			break
+		}
+
+		if cmdLen != 1 {
+			d.halted("CMD_GET_METADATA: bad length")
+			return nil
+		}
+
+		if !d.privileged {
+			d.halted("sys_preload_get_metadata failed")
+			return reply(hdr, bootverifier.RspGetMetadata, d.status(bootverifier.StatusFlashFailed))
+		}
+
+		return reply(hdr, bootverifier.RspGetMetadata, slices.Concat([]byte{tkeyclient.StatusOK}, d.flash.digest[:], d.flash.sig[:])...)
+
+	case bootverifier.CmdStorePubkey.Code():
+		if cmdLen != 128 {
+			d.halted("CMD_STORE_PUBKEY: bad length")
+			return nil
+		}
+
+		if !d.userIsPresent() {
+			return reply(hdr, bootverifier.RspStorePubkey, d.status(bootverifier.StatusPresenceTimeout))
+		}
+
+		if !d.privileged {
+			d.halted("sys_preload_set_pubkey failed")
+			return reply(hdr, bootverifier.RspStorePubkey, d.status(bootverifier.StatusFlashFailed))
+		}
+
+		copy(d.flash.pubkey[:], cmd[1:])
+
+		return reply(hdr, bootverifier.RspStorePubkey, tkeyclient.StatusOK)
+
+	case bootverifier.CmdSetPubkey.Code():
+		if cmdLen != 128 {
+			d.halted("CMD_SET_PUBKEY: bad length")
+			return nil
+		}
+
+		copy(d.verifier.pubkey[:], cmd[1:])
+		d.verifier.pubkeySet = true
+
+		return reply(hdr, bootverifier.RspSetPubkey, tkeyclient.StatusOK)
+
+	case bootverifier.CmdVerify.Code():
+		if cmdLen != 128 {
+			d.halted("CMD_VERIFY: bad length")
+			return nil
+		}
+
+		digest := [blake2s.Size]byte(cmd[1:33])
+		sig := [ed25519.SignatureSize]byte(cmd[33:97])
+
+		if d.verifier.pubkeySet {
+			if d.resetIfVerified(d.verifier.pubkey, bootverifier.FwResetTypeStartClientVer, digest, sig) {
+				return nil
+			}
+		}
+
+		// Pubkey is expected to be set and reset_if_verified()
+		// should only return if we didn't reset.
+		d.halted("CMD_VERIFY: not verified")
+
+		return nil
+
+	case bootverifier.CmdReset.Code():
+		if cmdLen != 4 {
+			d.halted("CMD_RESET: bad length")
+			return nil
+		}
+
+		// Either resets or halts.
+		d.appReset(cmd[1], cmd[2])
+
+		return nil
+
+	case bootverifier.CmdUpdateAppChunk.Code():
+		if cmdLen != 128 {
+			d.halted("CMD_UPDATE_APP_CHUNK: bad length")
+			return nil
+		}
+
+		if !d.cfg.Proposed {
+			break
+		}
+
+		// No app is being installed.
+		return reply(hdr, bootverifier.RspUpdateAppChunk, bootverifier.StatusBadState)
+
+	case bootverifier.CmdUpdateAppInit.Code():
+		if cmdLen != 128 {
+			d.halted("CMD_UPDATE_APP_INIT: bad length")
+			return nil
+		}
+
+		// The proposed verifier checks the size before asking for
+		// touch, the one in verifier/ only in update_init().
+		size := int(binary.LittleEndian.Uint32(cmd[1:5]))
+		if d.cfg.Proposed && !updateSizeIsValid(size) {
+			return reply(hdr, bootverifier.RspUpdateAppInit, bootverifier.StatusInvalidSize)
+		}
+
+		if !d.userIsPresent() {
+			return reply(hdr, bootverifier.RspUpdateAppInit, d.status(bootverifier.StatusPresenceTimeout))
+		}
+
+		if err := d.updateInit(size, [blake2s.Size]byte(cmd[5:37]), [ed25519.SignatureSize]byte(cmd[37:101])); err != nil {
+			d.halted(fmt.Sprintf("update_init: %v", err))
+			return reply(hdr, bootverifier.RspUpdateAppInit, d.status(bootverifier.StatusFlashFailed))
+		}
+
+		d.verifier.state = StateWaitForAppChunk
+
+		return reply(hdr, bootverifier.RspUpdateAppInit, tkeyclient.StatusOK)
+	}
+
+	d.halted(fmt.Sprintf("unknown command 0x%02x", cmd[0]))
+
+	return nil
+}
+
+// waitForAppChunk is wait_for_app_chunk().
+func (d *Device) waitForAppChunk(hdr tkeyclient.FramingHdr, cmd []byte) []byte {
+	switch {
+	case cmd[0] == bootverifier.CmdUpdateAppChunk.Code():
+		// Handled below.
+
+	// Not while an app is being installed. Keep waiting for the
+	// rest of it.
+	case !d.cfg.Proposed:
+		d.halted(fmt.Sprintf("expected CMD_UPDATE_APP_CHUNK, got 0x%02x", cmd[0]))
+		return nil
+	case cmd[0] == bootverifier.CmdEraseAreas.Code():
+		return reply(hdr, bootverifier.RspEraseAreas, bootverifier.StatusBadState)
+	case cmd[0] == bootverifier.CmdStorePubkey.Code():
+		return reply(hdr, bootverifier.RspStorePubkey, bootverifier.StatusBadState)
+	case cmd[0] == bootverifier.CmdUpdateAppInit.Code():
+		return reply(hdr, bootverifier.RspUpdateAppInit, bootverifier.StatusBadState)
+
+	default:
+		d.halted(fmt.Sprintf("expected CMD_UPDATE_APP_CHUNK, got 0x%02x", cmd[0]))
+		return nil
+	}
+
+	if hdr.CmdLen.Bytelen() != 128 {
+		d.halted("CMD_UPDATE_APP_CHUNK: bad length")
+		return nil
+	}
+
+	halted, err := d.chunkFault()
+	if halted {
+		return nil
+	}
+
+	if err == nil {
+		err = d.updateWrite(cmd[1:])
+	}
+
+	if err != nil {
+		d.halted(fmt.Sprintf("update_write: %v", err))
+		return reply(hdr, bootverifier.RspUpdateAppChunk, d.status(bootverifier.StatusFlashFailed))
+	}
+
+	out := reply(hdr, bootverifier.RspUpdateAppChunk, tkeyclient.StatusOK)
+
+	if d.verifier.uploadOffset >= d.verifier.uploadSize {
+		if err := d.updateFinalize(); err != nil {
+			d.halted(fmt.Sprintf("update_finalize: %v", err))
+			return append(out, reply(hdr, bootverifier.RspUpdateAppChunk, d.status(bootverifier.StatusFlashFailed))...)
+		}
+
+		rst := Reset{Type: bootverifier.FwResetTypeStartDefault}
+		rst.NextAppData[0] = byte(bootverifier.VerifierResetDstApp1)
+		d.sysReset(rst, 1)
+	}
+
+	return out
+}
+
+// status returns the status the verifier replies with on a failure:
+// proposed with the proposed verifier, else STATUS_BAD like the one in
+// verifier/ for all of them.
+func (d *Device) status(proposed byte) byte {
+	if d.cfg.Proposed {
+		return proposed
+	}
+
+	return tkeyclient.StatusBad
+}
+
+// updateSizeIsValid is the size check in update_init() in
+// verifier/update.c.
+func updateSizeIsValid(size int) bool {
+	return size != 0 && size <= AppMaxSize
+}
+
+// updateInit is update_init() in verifier/update.c.
+func (d *Device) updateInit(size int, digest [blake2s.Size]byte, sig [ed25519.SignatureSize]byte) error {
+	if !updateSizeIsValid(size) {
+		return fmt.Errorf("invalid app size %d", size)
+	}
+
+	d.verifier.uploadOffset = 0
+	d.verifier.uploadSize = size
+	d.verifier.appDigest = digest
+	d.verifier.appSignature = sig
+
+	if !d.privileged {
+		return errNotPrivileged
+	}
+
+	d.flash.delete()
+
+	return nil
+}
+
+// updateWrite is update_write() in verifier/update.c.
+func (d *Device) updateWrite(data []byte) error {
+	if d.verifier.uploadSize <= d.verifier.uploadOffset {
+		return fmt.Errorf("assert: nothing left to upload")
+	}
+
+	n := min(d.verifier.uploadSize-d.verifier.uploadOffset, len(data))
+	if err := d.writeApp(d.verifier.uploadOffset, data[:n]); err != nil {
+		return err
+	}
+
+	d.verifier.uploadOffset += n
+
+	return nil
+}
+
+// writeApp is write_app() in verifier/update.c, writing 256 byte
+// aligned blocks padded with 0xff.
+func (d *Device) writeApp(addr int, data []byte) error {
+	bufOffset := addr % writeSize
+
+	for i, n := 0, 0; i < len(data); i += n {
+		n = min(len(data)-i, writeSize, writeSize-bufOffset)
+
+		buf := make([]byte, writeSize)
+		for j := range buf {
+			buf[j] = 0xff
+		}
+		copy(buf[bufOffset:], data[i:i+n])
+
+		if !d.privileged {
+			return errNotPrivileged
+		}
+
+		if err := d.flash.store(addr-addr%writeSize, buf); err != nil {
+			return err
+		}
+
+		bufOffset = 0
+		addr += n
+	}
+
+	return nil
+}
+
+// updateFinalize is update_finalize() in verifier/update.c.
+func (d *Device) updateFinalize() error {
+	if !d.privileged {
+		return errNotPrivileged
+	}
+
+	if err := d.flash.storeFin(d.verifier.uploadSize, d.verifier.appDigest, d.sigFault(d.verifier.appSignature)); err != nil {
+		return err
+	}
+
+	d.verifier.uploadSize = 0
+	d.verifier.appDigest = [blake2s.Size]byte{}
+	d.verifier.appSignature = [ed25519.SignatureSize]byte{}
+
+	return nil
+}